@@ -42,7 +42,7 @@ func (c *dbCmd) Desc() string {
 func newDbCmd() *dbCmd {
 	cmd := new(dbCmd)
 	flags := gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
-	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration file")
+	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration files, separated by commas")
 	flags.BoolVar(&cmd.crTables, "create-tables", true, "Create tables if they don't exist")
 	flags.BoolVar(&cmd.drConstraints, "drop-constraints", false,
 		"Drop all primary key, unique and foreign key constraints")
@@ -50,7 +50,7 @@ func (ec *deleteCmd) Desc() string { return "Delete key hash from prefix tree" }
 func newDeleteCmd() *deleteCmd {
 	cmd := new(deleteCmd)
 	flags := gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
-	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration file")
+	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration files, separated by commas")
 	flags.StringVar(&cmd.keyHash, "keyHash", "", "Delete key hash")
 	flags.StringVar(&cmd.fingerprint, "fingerprint", "", "Delete key fingerprint")
 	cmd.flags = flags
@@ -125,7 +125,7 @@ func (ec *deleteCmd) deleteKeyHash() {
 	}
 	var uuid string
 	row, err := ec.db.Query(
-		"SELECT uuid FROM openpgp_pubkey WHERE md5 = $1", ec.keyHash)
+		"SELECT uuid FROM openpgp_pubkey WHERE "+openpgp.Config().ReconDigestExpr()+" = $1", ec.keyHash)
 	if err != nil {
 		die(err)
 	}
@@ -143,7 +143,7 @@ func (ec *deleteCmd) deleteKeyHash() {
 func (ec *deleteCmd) deleteFingerprint() {
 	uuid := strings.ToLower(util.Reverse(ec.fingerprint))
 	row, err := ec.db.Query(
-		"SELECT md5 FROM openpgp_pubkey WHERE uuid = $1", uuid)
+		"SELECT "+openpgp.Config().ReconDigestExpr()+" FROM openpgp_pubkey WHERE uuid = $1", uuid)
 	if err != nil {
 		die(err)
 	}
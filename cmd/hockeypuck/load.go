@@ -57,7 +57,7 @@ func (ec *loadCmd) Desc() string { return "Load OpenPGP keyring files into datab
 func newLoadCmd() *loadCmd {
 	cmd := new(loadCmd)
 	flags := gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
-	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration file")
+	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration files, separated by commas")
 	flags.StringVar(&cmd.path, "path", "", "OpenPGP keyring file path or glob pattern")
 	flags.IntVar(&cmd.txnSize, "txn-size", 5000, "Transaction size; public keys per commit")
 	flags.BoolVar(&cmd.ignoreDups, "ignore-dups", false, "Ignore duplicate entries")
@@ -79,6 +79,9 @@ func (ec *loadCmd) Main() {
 	ec.configuredCmd.Main()
 	InitLog()
 	var err error
+	if err = openpgp.Config().Validate(); err != nil {
+		die(err)
+	}
 	if ec.db, err = openpgp.NewDB(); err != nil {
 		die(err)
 	}
@@ -187,9 +190,33 @@ func (ec *loadCmd) loadAllKeys(path string) {
 				log.Println("Error reading key:", keyRead.Error)
 				continue
 			}
-			digest, err := hex.DecodeString(keyRead.Pubkey.Md5)
+			if err = openpgp.CheckSelfSigs(keyRead.Pubkey); err == nil {
+				err = openpgp.CheckUserId(keyRead.Pubkey)
+			}
+			if err == nil {
+				err = openpgp.CheckKeyLimits(keyRead.Pubkey)
+			}
+			if err == nil {
+				err = openpgp.CheckCreation(keyRead.Pubkey)
+			}
+			if err != nil {
+				log.Println("Rejected key", keyRead.Pubkey.Fingerprint(), ":", err)
+				continue
+			}
+			openpgp.FilterTrustedSigners(keyRead.Pubkey)
+			openpgp.FilterNoModify(keyRead.Pubkey)
+			openpgp.ApplyReconExclusion(keyRead.Pubkey)
+			openpgp.ApplyImageIndex(keyRead.Pubkey)
+			if keyRead.Pubkey.IsReconExcluded() {
+				// Stored, but kept out of the prefix tree.
+				if err = ec.insertKey(keyRead); err != nil {
+					log.Println("Error inserting key", keyRead.Pubkey.Md5, "into database:", err)
+				}
+				continue
+			}
+			digest, err := hex.DecodeString(keyRead.Pubkey.ReconDigest())
 			if err != nil {
-				log.Println("bad digest:", keyRead.Pubkey.Md5)
+				log.Println("bad digest:", keyRead.Pubkey.ReconDigest())
 				continue
 			}
 			digest = recon.PadSksElement(digest)
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"strings"
 
 	. "github.com/hockeypuck/hockeypuck"
 	"launchpad.net/gnuflag"
@@ -166,14 +167,18 @@ type configuredCmd struct {
 
 func (c *configuredCmd) Main() {
 	if c.configPath != "" {
-		var err error
-		if c.configPath, err = filepath.Abs(c.configPath); err != nil {
-			die(err)
+		// Later configuration files override settings in earlier ones.
+		paths := strings.Split(c.configPath, ",")
+		for i := range paths {
+			var err error
+			if paths[i], err = filepath.Abs(paths[i]); err != nil {
+				die(err)
+			}
 		}
-		if err = LoadConfigFile(c.configPath); err != nil {
+		if err := LoadConfigFiles(paths...); err != nil {
 			die(err)
 		}
-		c.configDir = filepath.Dir(c.configPath)
+		c.configDir = filepath.Dir(paths[0])
 	} else {
 		// Fall back on default empty config
 		SetConfig("")
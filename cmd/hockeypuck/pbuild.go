@@ -47,7 +47,7 @@ func (c *pbuildCmd) Desc() string {
 func newPbuildCmd() *pbuildCmd {
 	cmd := new(pbuildCmd)
 	flags := gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
-	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration file")
+	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration files, separated by commas")
 	flags.IntVar(&cmd.cache, "cache", 64, "Max diskv cache size (MB)")
 	flags.BoolVar(&cmd.ignoreDups, "ignore-dups", false, "Ignore duplicate entries")
 	cmd.flags = flags
@@ -98,18 +98,19 @@ func readHashes(db *openpgp.DB) chan *conflux.Zp {
 	hashes := make(chan *conflux.Zp)
 	go func() {
 		defer close(hashes)
-		rows, err := db.DB.Query("SELECT md5 FROM openpgp_pubkey")
+		rows, err := db.DB.Query("SELECT " + openpgp.Config().ReconDigestExpr() +
+			" FROM openpgp_pubkey WHERE " + openpgp.ReconIncludedExpr())
 		if err != nil {
 			die(err)
 		}
 		for rows.Next() {
-			var md5str string
-			if err = rows.Scan(&md5str); err != nil {
+			var digestStr string
+			if err = rows.Scan(&digestStr); err != nil {
 				die(err)
 			}
-			digest, err := hex.DecodeString(md5str)
+			digest, err := hex.DecodeString(digestStr)
 			if err != nil {
-				log.Println("Bad md5:", md5str)
+				log.Println("Bad digest:", digestStr)
 				continue
 			}
 			digest = recon.PadSksElement(digest)
@@ -40,7 +40,7 @@ func (rc *recoverCmd) Desc() string { return "Recover prefix tree" }
 func newRecoverCmd() *recoverCmd {
 	cmd := new(recoverCmd)
 	flags := gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
-	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration file")
+	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration files, separated by commas")
 	cmd.flags = flags
 	return cmd
 }
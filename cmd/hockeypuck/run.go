@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"path/filepath"
@@ -24,7 +25,7 @@ func (c *runCmd) Desc() string { return "Run Hockeypuck services" }
 func newRunCmd() *runCmd {
 	cmd := &runCmd{}
 	flags := gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
-	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration file")
+	flags.StringVar(&cmd.configPath, "config", "", "Hockeypuck configuration files, separated by commas")
 	cmd.flags = flags
 	return cmd
 }
@@ -32,6 +33,12 @@ func newRunCmd() *runCmd {
 func (c *runCmd) Main() {
 	c.configuredCmd.Main()
 	InitLog()
+	if err := openpgp.Config().Validate(); err != nil {
+		die(err)
+	}
+	if err := hkp.Config().Validate(); err != nil {
+		die(err)
+	}
 	// Create an HTTP request router
 	r := mux.NewRouter()
 	// Add common static routes
@@ -57,8 +64,7 @@ func (c *runCmd) Main() {
 	// Bind the router to the built-in webserver root
 	http.Handle("/", r)
 
-	var hkpsConfigured bool
-	var tlsCertPath, tlsKeyPath string
+	var tlsConfig *tls.Config
 	if hkp.Config().HttpsBind() != "" {
 		if hkp.Config().TLSCertificate() == "" {
 			err = fmt.Errorf("no TLS certificate provided")
@@ -70,34 +76,43 @@ func (c *runCmd) Main() {
 			die(err)
 		}
 
-		if filepath.IsAbs(hkp.Config().TLSCertificate()) {
-			tlsCertPath = hkp.Config().TLSCertificate()
-		} else {
-			tlsCertPath = filepath.Join(c.configDir, hkp.Config().TLSCertificate())
+		// The certificate and key may be given inline, or as paths
+		// relative to the configuration directory.
+		tlsCert, tlsKey := hkp.Config().TLSCertificate(), hkp.Config().TLSKey()
+		if !hkp.IsInlinePEM(tlsCert) && !filepath.IsAbs(tlsCert) {
+			tlsCert = filepath.Join(c.configDir, tlsCert)
 		}
-
-		if filepath.IsAbs(hkp.Config().TLSKey()) {
-			tlsKeyPath = hkp.Config().TLSKey()
-		} else {
-			tlsKeyPath = filepath.Join(c.configDir, hkp.Config().TLSKey())
+		if !hkp.IsInlinePEM(tlsKey) && !filepath.IsAbs(tlsKey) {
+			tlsKey = filepath.Join(c.configDir, tlsKey)
+		}
+		if err = hkp.CheckTLSKeyPair(tlsCert, tlsKey); err != nil {
+			die(err)
+		}
+		pair, err := hkp.LoadTLSKeyPair(tlsCert, tlsKey)
+		if err != nil {
+			die(err)
 		}
-		hkpsConfigured = true
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
 	}
 
-	if hkpsConfigured {
-		if hkp.Config().HttpBind() != "" {
-			go func() {
-				// Start the built-in webserver, run forever
-				err = http.ListenAndServe(hkp.Config().HttpBind(), nil)
-				die(err)
-			}()
+	listen := func(bind string) {
+		// Start the built-in webserver, run forever
+		die(http.ListenAndServe(bind, nil))
+	}
+	httpBinds := hkp.Config().HttpBinds()
+	if tlsConfig != nil {
+		for _, bind := range httpBinds {
+			go listen(bind)
 		}
-		err = http.ListenAndServeTLS(hkp.Config().HttpsBind(),
-			tlsCertPath, tlsKeyPath, nil)
-		die(err)
+		l, err := tls.Listen("tcp", hkp.Config().HttpsBind(), tlsConfig)
+		if err != nil {
+			die(err)
+		}
+		die(http.Serve(l, nil))
 	} else {
-		// Start the built-in webserver, run forever
-		err = http.ListenAndServe(hkp.Config().HttpBind(), nil)
-		die(err)
+		for _, bind := range httpBinds[1:] {
+			go listen(bind)
+		}
+		listen(httpBinds[0])
 	}
 }
@@ -23,7 +23,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/pelletier/go-toml"
 )
@@ -124,11 +128,145 @@ func (s *Settings) GetStrings(key string) (value []string) {
 	return
 }
 
+// Hostname returns the public hostname of this keyserver,
+// defaulting to the system hostname.
+func (s *Settings) Hostname() string {
+	if hostname := s.GetString("hockeypuck.hostname"); hostname != "" {
+		return hostname
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// NodeName returns the name by which this keyserver identifies itself
+// to peers, defaulting to the hostname.
+func (s *Settings) NodeName() string {
+	return s.GetStringDefault("hockeypuck.nodename", s.Hostname())
+}
+
+// AdminContact returns the contact address of the keyserver operator, if set.
+func (s *Settings) AdminContact() string {
+	return s.GetString("hockeypuck.contact")
+}
+
+// ReadOnly returns whether the keyserver is a read-only mirror, which serves
+// keys but refuses all submissions.
+func (s *Settings) ReadOnly() bool {
+	return s.GetBool("hockeypuck.readOnly")
+}
+
+var hostnameRegex = regexp.MustCompile(
+	`^([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]{0,61}[a-zA-Z0-9])(\.([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]{0,61}[a-zA-Z0-9]))*$`)
+
+// Validate checks the general settings for invalid values.
+func (s *Settings) Validate() error {
+	// The system hostname is used as given; only a configured one is checked.
+	if hostname := s.GetString("hockeypuck.hostname"); hostname != "" &&
+		(len(hostname) > 253 || !hostnameRegex.MatchString(hostname)) {
+		return fmt.Errorf("Invalid hostname: %q", hostname)
+	}
+	if s.NodeName() == "" {
+		return fmt.Errorf("Node name must not be empty")
+	}
+	switch v := s.Get("hockeypuck.readOnly").(type) {
+	case nil, bool:
+	default:
+		return fmt.Errorf("hockeypuck.readOnly: invalid boolean value %v", v)
+	}
+	return nil
+}
+
+// ConfigError describes a syntax error in a TOML configuration, with the
+// position and, where it can be determined, the key and text of the offending
+// line.
+type ConfigError struct {
+	Path    string
+	Line    int
+	Column  int
+	Key     string
+	InValue bool
+	Snippet string
+	Err     string
+}
+
+func (e *ConfigError) Error() string {
+	var buf bytes.Buffer
+	if e.Path != "" {
+		fmt.Fprintf(&buf, "%s: ", e.Path)
+	}
+	fmt.Fprintf(&buf, "line %d", e.Line)
+	if e.Key != "" && e.InValue {
+		fmt.Fprintf(&buf, ": invalid value for %s", e.Key)
+	} else if e.Key != "" {
+		fmt.Fprintf(&buf, ": %s", e.Key)
+	}
+	fmt.Fprintf(&buf, ": %s", e.Err)
+	if e.Snippet != "" {
+		fmt.Fprintf(&buf, "\n\t%d | %s", e.Line, e.Snippet)
+	}
+	return buf.String()
+}
+
+// tomlErrorRegex matches the "(line, column): message" form of go-toml
+// parse errors.
+var tomlErrorRegex = regexp.MustCompile(`^\((\d+), (\d+)\): (.*)$`)
+
+// tomlKeyRegex matches a key assignment at the start of a TOML line.
+var tomlKeyRegex = regexp.MustCompile(`^\s*([A-Za-z0-9_.-]+)\s*=`)
+
+// tomlTableRegex matches a TOML table header.
+var tomlTableRegex = regexp.MustCompile(`^\s*\[([A-Za-z0-9_.-]+)\]`)
+
+// configError adds the key path and line context to a go-toml parse error,
+// returning other errors unchanged.
+func configError(path, contents string, err error) error {
+	m := tomlErrorRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	e := &ConfigError{Path: path, Err: m[3]}
+	e.Line, _ = strconv.Atoi(m[1])
+	e.Column, _ = strconv.Atoi(m[2])
+	lines := strings.Split(contents, "\n")
+	if e.Line < 1 || e.Line > len(lines) {
+		return e
+	}
+	e.Snippet = strings.TrimSpace(lines[e.Line-1])
+	if km := tomlKeyRegex.FindStringSubmatchIndex(lines[e.Line-1]); km != nil {
+		e.Key = lines[e.Line-1][km[2]:km[3]]
+		e.InValue = e.Column > km[1]
+		for i := e.Line - 2; i >= 0; i-- {
+			if tm := tomlTableRegex.FindStringSubmatch(lines[i]); tm != nil {
+				e.Key = tm[1] + "." + e.Key
+				break
+			}
+		}
+	}
+	return e
+}
+
+// loadTomlFile parses the TOML file at path, describing any syntax error
+// with its position in the file.
+func loadTomlFile(path string) (*toml.TomlTree, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := toml.Load(string(contents))
+	if err != nil {
+		return nil, configError(path, string(contents), err)
+	}
+	return tree, nil
+}
+
 // SetConfig sets the global configuration to the TOML-formatted string contents.
 func SetConfig(contents string) (err error) {
 	var tree *toml.TomlTree
 	if tree, err = toml.Load(contents); err != nil {
-		return
+		return configError("", contents, err)
 	}
 	config = &Settings{tree}
 	return
@@ -143,18 +281,63 @@ func LoadConfig(r io.Reader) (err error) {
 	}
 	var tree *toml.TomlTree
 	if tree, err = toml.Load(buf.String()); err != nil {
-		return
+		return configError("", buf.String(), err)
 	}
 	config = &Settings{tree}
 	return
 }
 
-// LoadConfigFile sets the global configuration to the contents from the TOML file path.
+// LoadConfigFiles sets the global configuration to the contents of the TOML
+// files, in order. Settings in later files override those in earlier ones.
+// Tables are merged setting by setting, so that a later file may override
+// one setting in a table without discarding the others. The combined
+// configuration is validated before it is set.
+func LoadConfigFiles(paths ...string) error {
+	if len(paths) == 0 {
+		return SetConfig("")
+	}
+	var settings *Settings
+	for _, path := range paths {
+		tree, err := loadTomlFile(path)
+		if err != nil {
+			return err
+		}
+		if settings == nil {
+			settings = &Settings{tree}
+		} else {
+			mergeTree(settings.TomlTree, tree, "")
+		}
+	}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	config = settings
+	return nil
+}
+
+// mergeTree sets each value found in src on dst, descending into tables.
+func mergeTree(dst, src *toml.TomlTree, prefix string) {
+	for _, key := range src.Keys() {
+		switch v := src.Get(key).(type) {
+		case *toml.TomlTree:
+			mergeTree(dst, v, prefix+key+".")
+		default:
+			dst.Set(prefix+key, v)
+		}
+	}
+}
+
+// LoadConfigFile sets the global configuration to the contents from the TOML
+// file path. The configuration is validated before it is set.
 func LoadConfigFile(path string) (err error) {
 	var tree *toml.TomlTree
-	if tree, err = toml.LoadFile(path); err != nil {
+	if tree, err = loadTomlFile(path); err != nil {
 		return
 	}
-	config = &Settings{tree}
+	settings := &Settings{tree}
+	if err = settings.Validate(); err != nil {
+		return
+	}
+	config = settings
 	return
 }
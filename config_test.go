@@ -0,0 +1,144 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hockeypuck
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigError(t *testing.T) {
+	contents := `
+[hockeypuck.openpgp]
+nworkers = fourteen
+`
+	err := configError("/etc/hockeypuck/hockeypuck.conf", contents,
+		errors.New("(3, 12): keys cannot contain f character"))
+	cerr, is := err.(*ConfigError)
+	if !assert.True(t, is) {
+		return
+	}
+	assert.Equal(t, 3, cerr.Line)
+	assert.Equal(t, 12, cerr.Column)
+	assert.Equal(t, "hockeypuck.openpgp.nworkers", cerr.Key)
+	assert.Equal(t, "nworkers = fourteen", cerr.Snippet)
+	assert.Equal(t, "/etc/hockeypuck/hockeypuck.conf: line 3: invalid value for hockeypuck.openpgp.nworkers: keys cannot contain f character\n\t3 | nworkers = fourteen", err.Error())
+
+	// Errors without a position are returned as is.
+	other := errors.New("unexpected EOF")
+	assert.Equal(t, other, configError("", contents, other))
+}
+
+func TestConfigErrorInKey(t *testing.T) {
+	err := configError("", "[hockeypuck]\nlog$file = \"x\"\n",
+		errors.New("(2, 4): keys cannot contain $ character"))
+	assert.Equal(t, "line 2: keys cannot contain $ character\n\t2 | log$file = \"x\"", err.Error())
+}
+
+func TestValidateHostname(t *testing.T) {
+	defer SetConfig("")
+	SetConfig(`
+[hockeypuck]
+hostname="keyserver.example.com"
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, "keyserver.example.com", Config().Hostname())
+
+	SetConfig(`
+[hockeypuck]
+hostname="not a hostname"
+`)
+	assert.NotNil(t, Config().Validate())
+
+	// The system hostname is not checked when none is configured.
+	SetConfig(`
+[hockeypuck]
+nodename="node"
+`)
+	assert.Nil(t, Config().Validate())
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	defer SetConfig("")
+	dir, err := ioutil.TempDir("", "hockeypuck-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hockeypuck.conf")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+[hockeypuck]
+hostname="keyserver.example.com"
+`), 0600))
+	assert.Nil(t, LoadConfigFile(path))
+	assert.Equal(t, "keyserver.example.com", Config().Hostname())
+
+	// An invalid configuration is rejected, and the current one kept.
+	invalid := filepath.Join(dir, "invalid.conf")
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte(`
+[hockeypuck]
+hostname="not a hostname"
+`), 0600))
+	assert.NotNil(t, LoadConfigFile(invalid))
+	assert.Equal(t, "keyserver.example.com", Config().Hostname())
+
+	assert.NotNil(t, LoadConfigFile(filepath.Join(dir, "missing.conf")))
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	defer SetConfig("")
+	dir, err := ioutil.TempDir("", "hockeypuck-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.conf")
+	assert.Nil(t, ioutil.WriteFile(base, []byte(`
+[hockeypuck]
+hostname="base.example.com"
+nodename="base"
+contact="admin@example.com"
+`), 0600))
+	local := filepath.Join(dir, "local.conf")
+	assert.Nil(t, ioutil.WriteFile(local, []byte(`
+[hockeypuck]
+hostname="local.example.com"
+nodename="local"
+`), 0600))
+
+	assert.Nil(t, LoadConfigFiles(base, local))
+	assert.Equal(t, "local.example.com", Config().Hostname())
+	assert.Equal(t, "local", Config().NodeName())
+	// Settings not overridden are kept from the earlier file.
+	assert.Equal(t, "admin@example.com", Config().AdminContact())
+
+	assert.Nil(t, LoadConfigFiles(local, base))
+	assert.Equal(t, "base.example.com", Config().Hostname())
+
+	assert.NotNil(t, LoadConfigFiles(base, filepath.Join(dir, "missing.conf")))
+
+	// The merged configuration is validated.
+	invalid := filepath.Join(dir, "invalid.conf")
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte(`
+[hockeypuck]
+hostname="not a hostname"
+`), 0600))
+	assert.NotNil(t, LoadConfigFiles(base, invalid))
+	assert.Equal(t, "base.example.com", Config().Hostname())
+}
@@ -45,3 +45,6 @@ var ErrUnsupportedOperation = fmt.Errorf("Unsupported operation.")
 
 // Template path was not found. Installation or configuration problem.
 var ErrTemplatePathNotFound = fmt.Errorf("Could not find templates. Check your installation and configuration.")
+
+// The keyserver is a read-only mirror and does not accept key submissions.
+var ErrReadOnly = fmt.Errorf("Keyserver is read-only.")
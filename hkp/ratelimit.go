@@ -0,0 +1,150 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+// SubmitRatePerMin returns the number of key submissions accepted per minute
+// from each client address. Zero if submissions are not rate limited.
+func (s *Settings) SubmitRatePerMin() int {
+	return s.GetIntDefault("hockeypuck.hkp.submitRatePerMin", 0)
+}
+
+// SubmitBurst returns the number of key submissions a client may make at
+// once before being limited to SubmitRatePerMin. Defaults to one minute's
+// worth of submissions.
+func (s *Settings) SubmitBurst() int {
+	return s.GetIntDefault("hockeypuck.hkp.submitBurst", s.SubmitRatePerMin())
+}
+
+// validateSubmitRate checks that the submission rate limits are positive.
+func (s *Settings) validateSubmitRate() error {
+	for _, key := range []string{"hockeypuck.hkp.submitRatePerMin", "hockeypuck.hkp.submitBurst"} {
+		if s.Get(key) != nil && s.GetIntDefault(key, 0) <= 0 {
+			return fmt.Errorf("%s: must be a positive integer, got %v", key, s.Get(key))
+		}
+	}
+	return nil
+}
+
+// maxRateSources is the number of client addresses tracked before those
+// whose buckets have refilled are forgotten.
+const maxRateSources = 10000
+
+// RateLimiter is a token bucket rate limiter, keeping a bucket for each
+// source such as a client IP address.
+type RateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	now     func() time.Time
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a rate limiter allowing each source ratePerMin
+// events per minute, in bursts of up to burst events.
+func NewRateLimiter(ratePerMin, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    float64(ratePerMin) / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// NewSubmitRateLimiter returns the rate limiter for key submissions
+// configured in the settings, or nil if submissions are not limited.
+func (s *Settings) NewSubmitRateLimiter() *RateLimiter {
+	if s.SubmitRatePerMin() <= 0 {
+		return nil
+	}
+	return NewRateLimiter(s.SubmitRatePerMin(), s.SubmitBurst())
+}
+
+// Allow takes a token from the source's bucket, returning whether one was
+// available. A nil RateLimiter allows everything.
+func (l *RateLimiter) Allow(source string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, has := l.buckets[source]
+	if !has {
+		if len(l.buckets) >= maxRateSources {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[source] = b
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets sources whose buckets would have refilled by now, since a
+// full bucket is the same as none.
+func (l *RateLimiter) prune(now time.Time) {
+	for source, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, source)
+		}
+	}
+}
+
+// clientIP returns the IP address of the client making the request.
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// rejectRateLimited responds with HTTP 429 if the client has exceeded its
+// rate limit, returning whether it did so.
+func (l *RateLimiter) rejectRateLimited(w http.ResponseWriter, req *http.Request) bool {
+	if ip := clientIP(req); !l.Allow(ip) {
+		log.Println("Rate limited key submission from", ip)
+		http.Error(w, hockeypuck.TOO_MANY_REQUESTS, 429)
+		return true
+	}
+	return false
+}
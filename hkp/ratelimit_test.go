@@ -0,0 +1,115 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	l := NewRateLimiter(6, 2)
+	l.now = func() time.Time { return now }
+
+	// Burst, then limited.
+	assert.True(t, l.Allow("10.0.0.1"))
+	assert.True(t, l.Allow("10.0.0.1"))
+	assert.False(t, l.Allow("10.0.0.1"))
+	// Each source has its own bucket.
+	assert.True(t, l.Allow("10.0.0.2"))
+
+	// Six per minute refills a token every ten seconds.
+	now = now.Add(5 * time.Second)
+	assert.False(t, l.Allow("10.0.0.1"))
+	now = now.Add(5 * time.Second)
+	assert.True(t, l.Allow("10.0.0.1"))
+	assert.False(t, l.Allow("10.0.0.1"))
+
+	// Refilling stops at the burst size.
+	now = now.Add(time.Hour)
+	assert.True(t, l.Allow("10.0.0.1"))
+	assert.True(t, l.Allow("10.0.0.1"))
+	assert.False(t, l.Allow("10.0.0.1"))
+
+	// Full buckets are forgotten when pruned.
+	l.prune(now)
+	assert.Equal(t, 1, len(l.buckets))
+
+	var unlimited *RateLimiter
+	assert.True(t, unlimited.Allow("10.0.0.1"))
+}
+
+func TestSubmitRateLimited(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	l.now = func() time.Time { return time.Unix(1400000000, 0) }
+	for i, rejected := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/pks/add", nil)
+		assert.Nil(t, err)
+		req.RemoteAddr = "192.0.2.1:54321"
+		assert.Equal(t, rejected, l.rejectRateLimited(w, req), "request %d", i)
+		if rejected {
+			assert.Equal(t, 429, w.Code)
+		}
+	}
+}
+
+func TestSubmitRateSettings(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+	assert.Nil(t, Config().NewSubmitRateLimiter())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+submitRatePerMin=30
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, 30, Config().SubmitBurst())
+	assert.NotNil(t, Config().NewSubmitRateLimiter())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+submitRatePerMin=30
+submitBurst=5
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, 5, Config().SubmitBurst())
+
+	for _, conf := range []string{`
+[hockeypuck.hkp]
+submitRatePerMin=0
+`, `
+[hockeypuck.hkp]
+submitRatePerMin=10
+submitBurst=-1
+`, `
+[hockeypuck.hkp]
+submitRatePerMin="fast"
+`} {
+		hockeypuck.SetConfig(conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
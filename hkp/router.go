@@ -18,8 +18,16 @@
 package hkp
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.google.com/p/gorilla/mux"
 
@@ -27,8 +35,116 @@ import (
 	Errors "github.com/hockeypuck/hockeypuck/errors"
 )
 
+// HttpBind returns the first address to listen on for HKP requests.
 func (s *Settings) HttpBind() string {
-	return s.GetStringDefault("hockeypuck.hkp.bind", ":11371")
+	if binds := s.HttpBinds(); len(binds) > 0 {
+		return binds[0]
+	}
+	return ""
+}
+
+// HttpBinds returns the addresses to listen on for HKP requests.
+// The bind setting may be a single address or a list of addresses.
+func (s *Settings) HttpBinds() []string {
+	switch v := s.Get("hockeypuck.hkp.bind").(type) {
+	case nil:
+		return []string{":11371"}
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	default:
+		return s.GetStrings("hockeypuck.hkp.bind")
+	}
+}
+
+// Validate checks that the HKP settings are usable.
+func (s *Settings) Validate() error {
+	binds := s.HttpBinds()
+	if s.HttpsBind() != "" {
+		binds = append(binds, s.HttpsBind())
+	} else if len(binds) == 0 {
+		return fmt.Errorf("No HKP bind address configured")
+	}
+	for _, bind := range binds {
+		if _, port, err := net.SplitHostPort(bind); err != nil {
+			return fmt.Errorf("Invalid bind address %q: %v", bind, err)
+		} else if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("Invalid bind address %q: bad port", bind)
+		}
+	}
+	if err := s.validateEnabledOps(); err != nil {
+		return err
+	}
+	if err := s.validateMaxIndexResults(); err != nil {
+		return err
+	}
+	return s.validateSubmitRate()
+}
+
+// LookupOps are the names of the lookup operations (op parameter) served.
+var LookupOps = []string{"get", "index", "vindex", "stats", "hget"}
+
+// EnabledOps returns the names of the lookup operations that are enabled.
+// All operations are enabled by default.
+func (s *Settings) EnabledOps() []string {
+	if s.Get("hockeypuck.hkp.enabledOps") == nil {
+		return LookupOps
+	}
+	return s.GetStrings("hockeypuck.hkp.enabledOps")
+}
+
+// OpEnabled returns whether the named lookup operation is enabled.
+func (s *Settings) OpEnabled(op string) bool {
+	for _, enabled := range s.EnabledOps() {
+		if strings.ToLower(enabled) == op {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEnabledOps checks that only known lookup operations are enabled.
+func (s *Settings) validateEnabledOps() error {
+	if v := s.Get("hockeypuck.hkp.enabledOps"); v != nil {
+		if _, is := v.([]interface{}); !is {
+			return fmt.Errorf("hockeypuck.hkp.enabledOps: must be a list of operations")
+		}
+	}
+	for _, op := range s.EnabledOps() {
+		if !isLookupOp(strings.ToLower(op)) {
+			return fmt.Errorf("hockeypuck.hkp.enabledOps: unknown operation %q", op)
+		}
+	}
+	return nil
+}
+
+// DefaultMaxIndexResults is the number of keys listed by op=index and
+// op=vindex when maxIndexResults is not set.
+const DefaultMaxIndexResults = 100
+
+// MaxIndexResults returns the maximum number of keys listed in response to
+// op=index and op=vindex. Searches matching more keys are truncated.
+func (s *Settings) MaxIndexResults() int {
+	return s.GetIntDefault("hockeypuck.hkp.maxIndexResults", DefaultMaxIndexResults)
+}
+
+// validateMaxIndexResults checks that the index result limit is positive.
+func (s *Settings) validateMaxIndexResults() error {
+	if v := s.Get("hockeypuck.hkp.maxIndexResults"); v != nil && s.GetIntDefault("hockeypuck.hkp.maxIndexResults", 0) <= 0 {
+		return fmt.Errorf("hockeypuck.hkp.maxIndexResults: must be a positive integer, got %v", v)
+	}
+	return nil
+}
+
+func isLookupOp(op string) bool {
+	for _, lookupOp := range LookupOps {
+		if op == lookupOp {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Settings) HttpsBind() string {
@@ -43,6 +159,72 @@ func (s *Settings) TLSKey() string {
 	return s.GetStringDefault("hockeypuck.hkps.key", "")
 }
 
+// IsInlinePEM returns whether an HKPS certificate or key setting holds PEM
+// content itself, rather than the path to a file containing it.
+func IsInlinePEM(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-----BEGIN")
+}
+
+// tlsSource describes where a certificate or key was loaded from, for error
+// messages. Inline PEM content is not shown, as the key is a secret.
+func tlsSource(s string) string {
+	if IsInlinePEM(s) {
+		return "inline PEM"
+	}
+	return strconv.Quote(s)
+}
+
+func readPEM(s string) ([]byte, error) {
+	if IsInlinePEM(s) {
+		return []byte(s), nil
+	}
+	return ioutil.ReadFile(s)
+}
+
+// LoadTLSKeyPair loads the HKPS certificate and private key, each given
+// either as the path to a PEM file or as inline PEM content.
+func LoadTLSKeyPair(cert, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid TLS certificate %s: %v", tlsSource(cert), err)
+	}
+	keyPEM, err := readPEM(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid TLS key %s: %v", tlsSource(key), err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Invalid TLS certificate %s and key %s: %v",
+			tlsSource(cert), tlsSource(key), err)
+	}
+	return pair, nil
+}
+
+// CheckTLSKeyPair verifies that the HKPS certificate and private key, given
+// as file paths or inline PEM, can be read and form a matching pair. A
+// certificate outside its validity period is logged as a warning, but not
+// rejected.
+func CheckTLSKeyPair(cert, key string) error {
+	pair, err := LoadTLSKeyPair(cert, key)
+	if err != nil {
+		return err
+	}
+	if len(pair.Certificate) == 0 {
+		return fmt.Errorf("No certificate found in %s", tlsSource(cert))
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Invalid TLS certificate %s: %v", tlsSource(cert), err)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		log.Printf("Warning: TLS certificate %s is not valid until %v", tlsSource(cert), leaf.NotBefore)
+	} else if now.After(leaf.NotAfter) {
+		log.Printf("Warning: TLS certificate %s expired at %v", tlsSource(cert), leaf.NotAfter)
+	}
+	return nil
+}
+
 type Service struct {
 	Requests RequestChan
 }
@@ -54,10 +236,11 @@ func NewService() *Service {
 type Router struct {
 	*mux.Router
 	*Service
+	submitLimiter *RateLimiter
 }
 
 func NewRouter(r *mux.Router) *Router {
-	hkpr := &Router{Router: r, Service: NewService()}
+	hkpr := &Router{Router: r, Service: NewService(), submitLimiter: Config().NewSubmitRateLimiter()}
 	hkpr.HandleAll()
 	return hkpr
 }
@@ -90,13 +273,36 @@ func (r *Router) Respond(w http.ResponseWriter, req Request) {
 func (r *Router) HandlePksLookup() {
 	r.HandleFunc("/pks/lookup",
 		func(w http.ResponseWriter, req *http.Request) {
+			if rejectDisabledOp(w, req) {
+				return
+			}
 			r.Respond(w, &Lookup{Request: req})
 		})
 }
 
+// rejectDisabledOp responds with HTTP 501 if the lookup requests an
+// operation that is not enabled, returning whether it did so. Unknown
+// operations are left for the request parser to reject.
+func rejectDisabledOp(w http.ResponseWriter, req *http.Request) bool {
+	if op := req.FormValue("op"); isLookupOp(op) && !Config().OpEnabled(op) {
+		log.Println("Rejected disabled operation:", op)
+		http.Error(w, hockeypuck.NOT_IMPLEMENTED, 501)
+		return true
+	}
+	return false
+}
+
 func (r *Router) HandlePksAdd() {
 	r.HandleFunc("/pks/add",
 		func(w http.ResponseWriter, req *http.Request) {
+			if hockeypuck.Config().ReadOnly() {
+				log.Println("Rejected key submission:", Errors.ErrReadOnly)
+				http.Error(w, hockeypuck.FORBIDDEN, 403)
+				return
+			}
+			if r.submitLimiter.rejectRateLimited(w, req) {
+				return
+			}
 			r.Respond(w, &Add{Request: req})
 		})
 }
@@ -0,0 +1,239 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hkp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+func TestHttpBinds(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+
+	hockeypuck.SetConfig("")
+	assert.Equal(t, []string{":11371"}, Config().HttpBinds())
+	assert.Equal(t, ":11371", Config().HttpBind())
+	assert.Nil(t, Config().Validate())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+bind="127.0.0.1:8080"
+`)
+	assert.Equal(t, []string{"127.0.0.1:8080"}, Config().HttpBinds())
+	assert.Nil(t, Config().Validate())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+bind=["0.0.0.0:11371","[::1]:11371"]
+`)
+	assert.Equal(t, []string{"0.0.0.0:11371", "[::1]:11371"}, Config().HttpBinds())
+	assert.Equal(t, "0.0.0.0:11371", Config().HttpBind())
+	assert.Nil(t, Config().Validate())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+bind=[":11371","localhost"]
+`)
+	assert.NotNil(t, Config().Validate())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+bind=":http"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func writeTestKeyPair(t *testing.T, dir, name string, notAfter time.Time) (certPath, keyPath string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "keyserver.example.com"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCheckTLSKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hkps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert1, key1 := writeTestKeyPair(t, dir, "server1", time.Now().Add(time.Hour))
+	cert2, key2 := writeTestKeyPair(t, dir, "server2", time.Now().Add(-time.Hour))
+
+	assert.Nil(t, CheckTLSKeyPair(cert1, key1))
+	// Expired certificates are only warned about.
+	assert.Nil(t, CheckTLSKeyPair(cert2, key2))
+	// Mismatched pair
+	assert.NotNil(t, CheckTLSKeyPair(cert1, key2))
+	// Missing files
+	assert.NotNil(t, CheckTLSKeyPair(filepath.Join(dir, "missing.pem"), key1))
+}
+
+func TestCheckTLSKeyPairInline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hkps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert1, key1 := writeTestKeyPair(t, dir, "server1", time.Now().Add(time.Hour))
+	_, key2 := writeTestKeyPair(t, dir, "server2", time.Now().Add(time.Hour))
+	readFile := func(path string) string {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	cert1PEM, key1PEM, key2PEM := readFile(cert1), readFile(key1), readFile(key2)
+
+	assert.True(t, IsInlinePEM(cert1PEM))
+	assert.True(t, IsInlinePEM("\n  "+key1PEM))
+	assert.False(t, IsInlinePEM(cert1))
+
+	assert.Nil(t, CheckTLSKeyPair(cert1PEM, key1PEM))
+	pair, err := LoadTLSKeyPair(cert1PEM, key1PEM)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pair.Certificate))
+	// Inline PEM and file paths can be mixed.
+	assert.Nil(t, CheckTLSKeyPair(cert1, key1PEM))
+	assert.Nil(t, CheckTLSKeyPair(cert1PEM, key1))
+
+	// Mismatched pair, without revealing the key.
+	err = CheckTLSKeyPair(cert1PEM, key2PEM)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "inline PEM")
+		assert.NotContains(t, err.Error(), "PRIVATE KEY")
+	}
+	assert.NotNil(t, CheckTLSKeyPair("-----BEGIN CERTIFICATE-----\ngarbage", key1PEM))
+}
+
+func TestEnabledOps(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+	for _, op := range LookupOps {
+		assert.True(t, Config().OpEnabled(op), op)
+	}
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+enabledOps=["get", "HGET", "stats"]
+`)
+	assert.Nil(t, Config().Validate())
+	assert.True(t, Config().OpEnabled("get"))
+	assert.True(t, Config().OpEnabled("hget"))
+	assert.False(t, Config().OpEnabled("index"))
+	assert.False(t, Config().OpEnabled("vindex"))
+
+	// Disabled operations are refused before reaching a worker.
+	for _, tc := range []struct {
+		url      string
+		rejected bool
+	}{
+		{"/pks/lookup?op=vindex&search=alice", true},
+		{"/pks/lookup?op=get&search=alice", false},
+		{"/pks/lookup?op=bogus&search=alice", false},
+	} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", tc.url, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.rejected, rejectDisabledOp(w, req), tc.url)
+		if tc.rejected {
+			assert.Equal(t, 501, w.Code)
+		}
+	}
+
+	for _, conf := range []string{`
+[hockeypuck.hkp]
+enabledOps=["get", "delete"]
+`, `
+[hockeypuck.hkp]
+enabledOps="get"
+`} {
+		hockeypuck.SetConfig(conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
+
+func TestMaxIndexResults(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, DefaultMaxIndexResults, Config().MaxIndexResults())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.hkp]
+maxIndexResults=25
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, 25, Config().MaxIndexResults())
+
+	for _, conf := range []string{`
+[hockeypuck.hkp]
+maxIndexResults=0
+`, `
+[hockeypuck.hkp]
+maxIndexResults=-5
+`, `
+[hockeypuck.hkp]
+maxIndexResults="lots"
+`} {
+		hockeypuck.SetConfig(conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
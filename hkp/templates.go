@@ -139,6 +139,8 @@ const statsTmplSrc = `
 <tr><th>Hostname:</th><td>{{.Hostname}}</td></tr>
 <tr><th>Port:</th><td>{{.Port}}</td></tr>
 <tr><th>Version:</th><td>{{.Version}}</td></tr>
+<tr><th>Node:</th><td>{{.NodeName}}</td></tr>
+{{if .AdminContact}}<tr><th>Contact:</th><td>{{.AdminContact}}</td></tr>{{end}}
 </table>
 {{if .PksPeers}}
 <h2>Outgoing Mailsync Peers</h2>
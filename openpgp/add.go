@@ -26,7 +26,6 @@ import (
 	"log"
 	"time"
 
-	"code.google.com/p/go.crypto/openpgp/armor"
 	"github.com/jmoiron/sqlx"
 
 	. "github.com/hockeypuck/hockeypuck/errors"
@@ -40,27 +39,43 @@ type KeyChangeChan chan *KeyChange
 
 // Add responds to /pks/add HKP requests.
 func (w *Worker) Add(a *hkp.Add) {
+	if Config().ReadOnly() {
+		a.Response() <- &ErrorResponse{ErrReadOnly}
+		return
+	}
 	// Parse armored keytext
 	var changes []*KeyChange
 	var readErrors []*ReadKeyResult
-	// Check and decode the armor
-	armorBlock, err := armor.Decode(bytes.NewBufferString(a.Keytext))
+	// Find and decode the armored key blocks
+	keyBlocks, blockErrors, err := ReadArmoredKeyBlocks(bytes.NewBufferString(a.Keytext))
 	if err != nil {
 		a.Response() <- &ErrorResponse{err}
 		return
 	}
-	for readKey := range ReadKeys(armorBlock.Body) {
-		if readKey.Error != nil {
-			readErrors = append(readErrors, readKey)
-		} else {
-			change := w.UpsertKey(readKey.Pubkey)
-			if change.Error != nil {
-				log.Printf("Error updating key [%s]: %v\n", readKey.Pubkey.Fingerprint(),
-					change.Error)
+	// Malformed blocks are reported, without holding up the others.
+	for _, err := range blockErrors {
+		readErrors = append(readErrors, &ReadKeyResult{Error: err})
+	}
+	for _, keyBlock := range keyBlocks {
+		quarantined := false
+		for readKey := range ReadKeys(bytes.NewBuffer(keyBlock)) {
+			if readKey.Error != nil {
+				// Save the block once, however many errors it has.
+				if !quarantined {
+					Quarantine(keyBlock, "", readKey.Error)
+					quarantined = true
+				}
+				readErrors = append(readErrors, readKey)
 			} else {
-				go w.notifyChange(change)
+				change := w.UpsertKey(readKey.Pubkey)
+				if change.Error != nil {
+					log.Printf("Error updating key [%s]: %v\n", readKey.Pubkey.Fingerprint(),
+						change.Error)
+				} else {
+					go w.notifyChange(change)
+				}
+				changes = append(changes, change)
 			}
-			changes = append(changes, change)
 		}
 	}
 	a.Response() <- &AddResponse{Changes: changes, Errors: readErrors}
@@ -69,6 +84,9 @@ func (w *Worker) Add(a *hkp.Add) {
 // recoverKey responds to public keys recovered from the recon
 // protocol.
 func (w *Worker) recoverKey(rk *RecoverKey) hkp.Response {
+	if !Config().ReconPull() {
+		return &ErrorResponse{ErrReadOnly}
+	}
 	resp := &RecoverKeyResponse{}
 	// Attempt to parse and upsert key
 	var pubkeys []*Pubkey
@@ -81,6 +99,7 @@ func (w *Worker) recoverKey(rk *RecoverKey) hkp.Response {
 		}
 	}
 	if err != nil {
+		Quarantine(rk.Keytext, "", err)
 		return &ErrorResponse{err}
 	}
 	if len(pubkeys) == 0 {
@@ -152,6 +171,8 @@ type KeyChange struct {
 	Error error
 	// Type indicates the type of key change that occurred, as indicated by KeyChangeType.
 	Type KeyChangeType
+	// ReconExcluded indicates that the key is kept out of the prefix tree.
+	ReconExcluded bool
 }
 
 // String represents the key change event as a string for diagnostic purposes.
@@ -189,42 +210,93 @@ func (change *KeyChange) calcType() KeyChangeType {
 }
 
 func (w *Worker) UpsertKey(key *Pubkey) (change *KeyChange) {
+	FilterTrustedSigners(key)
+	FilterNoModify(key)
 	change = &KeyChange{
 		Fingerprint:   key.Fingerprint(),
 		Type:          KeyChangeInvalid,
 		CurrentMd5:    key.Md5,
 		CurrentSha256: key.Sha256}
+	for _, check := range []func(*Pubkey) error{
+		CheckFingerprint, CheckSelfSigs, CheckUserId} {
+		if change.Error = check(key); change.Error != nil {
+			QuarantineKey(key, change.Error)
+			return
+		}
+	}
 	lastKey, err := w.LookupKey(key.Fingerprint())
 	if err == ErrKeyNotFound {
+		// Keys already stored may be updated, such as to revoke them, even
+		// if they would not be accepted now.
+		for _, check := range []func(*Pubkey) error{CheckKeyLimits, CheckCreation} {
+			if change.Error = check(key); change.Error != nil {
+				QuarantineKey(key, change.Error)
+				return
+			}
+		}
 		change.Type = KeyAdded
 	} else if err != nil {
 		change.Error = err
 		return
+	} else if lastKey.IsTombstone() {
+		// Removed personal data must not be merged back in.
+		change.ReconExcluded = lastKey.IsReconExcluded()
+		change.PreviousMd5 = lastKey.Md5
+		change.PreviousSha256 = lastKey.Sha256
+		change.CurrentMd5 = lastKey.Md5
+		change.CurrentSha256 = lastKey.Sha256
+		change.Type = KeyNotChanged
+		return
+	} else if lastKey.SameContentAs(key) {
+		// Re-uploads of the stored key material need no merge or update.
+		change.ReconExcluded = lastKey.IsReconExcluded()
+		change.PreviousMd5 = lastKey.Md5
+		change.PreviousSha256 = lastKey.Sha256
+		change.Type = KeyNotChanged
+		return
 	} else {
 		change.PreviousMd5 = lastKey.Md5
 		change.PreviousSha256 = lastKey.Sha256
+		stored := lastKey.Clone()
 		MergeKey(lastKey, key)
+		w.linkDesignatedRevocations(lastKey)
+		// Merging may accumulate more user IDs or subkeys than allowed.
+		if change.Error = CheckMergedKeyLimits(stored, lastKey); change.Error != nil {
+			QuarantineKey(key, change.Error)
+			return
+		}
 		change.CurrentMd5 = lastKey.Md5
 		change.CurrentSha256 = lastKey.Sha256
-		if change.PreviousMd5 == change.CurrentMd5 && change.PreviousSha256 == change.CurrentSha256 {
+		excluded := lastKey.IsReconExcluded()
+		ApplyReconExclusion(lastKey)
+		ApplyImageIndex(lastKey)
+		change.ReconExcluded = lastKey.IsReconExcluded()
+		if change.PreviousMd5 == change.CurrentMd5 && change.PreviousSha256 == change.CurrentSha256 &&
+			change.ReconExcluded == excluded {
 			change.Type = KeyNotChanged
 		} else {
 			change.Type = KeyModified
 		}
 	}
+	if change.Type == KeyAdded {
+		w.linkDesignatedRevocations(key)
+		ApplyReconExclusion(key)
+		ApplyImageIndex(key)
+		change.ReconExcluded = key.IsReconExcluded()
+	}
 	if change.CurrentSha256 == "" {
 		change.Type = KeyChangeInvalid
 	}
 	switch change.Type {
 	case KeyModified:
-		lastKey.Mtime = time.Now()
+		lastKey.touch()
 		if change.Error = w.UpdateKey(lastKey); change.Error == nil {
 			w.UpdateKeyRelations(lastKey)
 		} else {
 			log.Println(change.Error)
 		}
 	case KeyAdded:
-		key.Ctime = time.Now()
+		key.Ctime = time.Now().UTC()
 		key.Mtime = key.Ctime
 		if change.Error = w.InsertKey(key); change.Error == nil {
 			w.UpdateKeyRelations(key)
@@ -233,11 +305,24 @@ func (w *Worker) UpsertKey(key *Pubkey) (change *KeyChange) {
 		}
 	}
 	if change.Type != KeyNotChanged {
+		cachedKeys().Remove(key.RFingerprint)
 		log.Println(change)
 	}
 	return
 }
 
+// linkDesignatedRevocations honors revocations of the key by its designated
+// revokers, verified against the revokers' keys stored in the database.
+func (w *Worker) linkDesignatedRevocations(pubkey *Pubkey) {
+	pubkey.LinkDesignatedRevocations(func(fpr string) *Pubkey {
+		revoker, err := w.LookupKey(fpr)
+		if err != nil {
+			return nil
+		}
+		return revoker
+	})
+}
+
 // UpdateKey updates the database to the contents of the given public key.
 func (w *Worker) UpdateKey(pubkey *Pubkey) (err error) {
 	err = w.InsertKey(pubkey)
@@ -250,6 +335,15 @@ func (w *Worker) UpdateKey(pubkey *Pubkey) (err error) {
 		return err
 	}
 
+	// Self-signatures superseded by merging are no longer part of the key,
+	// and would otherwise be read back with it.
+	for _, sig := range pubkey.supersededSigs {
+		if _, err = Execv(tx, `DELETE FROM openpgp_sig WHERE uuid = $1`, sig.ScopedDigest); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	var signable PacketRecord
 	err = pubkey.Visit(func(rec PacketRecord) (err error) {
 		switch r := rec.(type) {
@@ -260,7 +354,7 @@ UPDATE openpgp_pubkey SET
 	ctime = $6, mtime = $7,	md5 = $8, sha256 = $9,
 	algorithm = $10, bit_len = $11, unsupp = $12
 WHERE uuid = $1`, r.RFingerprint,
-				r.Creation, r.Expiration, r.State, r.Packet,
+				r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 				r.Ctime, r.Mtime, r.Md5, r.Sha256,
 				r.Algorithm, r.BitLen, r.Unsupported)
 			if err != nil {
@@ -274,7 +368,7 @@ UPDATE openpgp_subkey SET
 	algorithm = $6, bit_len = $7
 WHERE uuid = $1`,
 				r.RFingerprint,
-				r.Creation, r.Expiration, r.State, r.Packet,
+				r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 				r.Algorithm, r.BitLen)
 			if err != nil {
 				return err
@@ -287,7 +381,7 @@ UPDATE openpgp_uid SET
 	keywords = $6
 WHERE uuid = $1`,
 				r.ScopedDigest,
-				r.Creation, r.Expiration, r.State, r.Packet,
+				r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 				r.Keywords)
 			if err != nil {
 				return err
@@ -299,7 +393,7 @@ UPDATE openpgp_uat SET
 	creation = $2, expiration = $3, state = $4, packet = $5
 WHERE uuid = $1`,
 				r.ScopedDigest,
-				r.Creation, r.Expiration, r.State, r.Packet,
+				r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 			)
 			if err != nil {
 				return err
@@ -312,7 +406,7 @@ UPDATE openpgp_sig SET
 	sig_type = $6, signer = $7
 WHERE uuid = $1`,
 				r.ScopedDigest,
-				r.Creation, r.Expiration, r.State, r.Packet,
+				r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 				r.SigType, r.RIssuerKeyId)
 			if err != nil {
 				return err
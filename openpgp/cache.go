@@ -0,0 +1,141 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheSize returns the number of parsed public keys kept in memory to serve
+// repeated lookups without reading and parsing them from the database again.
+// A size of 0 disables the cache.
+func (s *Settings) CacheSize() int {
+	return s.GetIntDefault("hockeypuck.openpgp.cacheSize", 0)
+}
+
+// keyCache is a least-recently-used cache of parsed public keys, keyed by
+// reversed fingerprint. Keys are copied going in and coming out, so that
+// callers may merge into or otherwise modify the keys they are given
+// without affecting the cached entries. Cached entries are never modified,
+// only replaced, so they are copied outside of the lock and may be read by
+// many goroutines at once.
+//
+// The cache only serves HKP lookups. Keys are always read from the database
+// when they are to be updated.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	gen     uint64
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		size:    size,
+		entries: list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached key, or nil if it is not cached.
+func (c *keyCache) Get(rfp string) *Pubkey {
+	if c.size <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	el, ok := c.index[rfp]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.entries.MoveToFront(el)
+	cached := el.Value.(*Pubkey)
+	c.mu.Unlock()
+	return cached.Clone()
+}
+
+// Generation returns the current generation of the cache, which changes
+// whenever a key is removed. It must be taken before reading a key from the
+// database to be cached.
+func (c *keyCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Put stores a copy of the key read at the given generation, evicting the
+// least recently used key if the cache is full. The key is not stored if any
+// key has been removed since, as it may have been read before an update to
+// it was written.
+func (c *keyCache) Put(pubkey *Pubkey, gen uint64) {
+	if c.size <= 0 {
+		return
+	}
+	clone := pubkey.Clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.index[pubkey.RFingerprint]; ok {
+		el.Value = clone
+		c.entries.MoveToFront(el)
+		return
+	}
+	c.index[pubkey.RFingerprint] = c.entries.PushFront(clone)
+	for c.entries.Len() > c.size {
+		el := c.entries.Back()
+		c.entries.Remove(el)
+		delete(c.index, el.Value.(*Pubkey).RFingerprint)
+	}
+}
+
+// Remove drops the key from the cache, if present. Keys must be removed when
+// their stored key material changes.
+func (c *keyCache) Remove(rfp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.index[rfp]; ok {
+		c.entries.Remove(el)
+		delete(c.index, rfp)
+	}
+}
+
+// Len returns the number of cached keys.
+func (c *keyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len()
+}
+
+var (
+	parsedKeysOnce sync.Once
+	parsedKeys     *keyCache
+)
+
+// cachedKeys returns the parsed key cache shared by all workers, sized
+// according to the configuration when first used.
+func cachedKeys() *keyCache {
+	parsedKeysOnce.Do(func() {
+		parsedKeys = newKeyCache(Config().CacheSize())
+	})
+	return parsedKeys
+}
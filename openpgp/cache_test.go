@@ -0,0 +1,154 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyCache(t *testing.T) {
+	c := newKeyCache(2)
+	alice := MustInputAscKey(t, "alice_signed.asc")
+	weasel := MustInputAscKey(t, "weasel.asc")
+	uat := MustInputAscKey(t, "uat.asc")
+
+	assert.Nil(t, c.Get(alice.RFingerprint))
+	c.Put(alice, c.Generation())
+	c.Put(weasel, c.Generation())
+	assert.Equal(t, 2, c.Len())
+	cached := c.Get(alice.RFingerprint)
+	if assert.NotNil(t, cached) {
+		assert.Equal(t, alice.Md5, cached.Md5)
+		assert.Equal(t, countSigs(alice), countSigs(cached))
+	}
+
+	// weasel is now the least recently used and is evicted.
+	c.Put(uat, c.Generation())
+	assert.Equal(t, 2, c.Len())
+	assert.Nil(t, c.Get(weasel.RFingerprint))
+	assert.NotNil(t, c.Get(alice.RFingerprint))
+	assert.NotNil(t, c.Get(uat.RFingerprint))
+
+	c.Remove(uat.RFingerprint)
+	assert.Nil(t, c.Get(uat.RFingerprint))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestKeyCacheGeneration(t *testing.T) {
+	c := newKeyCache(2)
+	key := MustInputAscKey(t, "alice_signed.asc")
+
+	// A key read before it was updated and removed is not cached.
+	gen := c.Generation()
+	c.Remove(key.RFingerprint)
+	c.Put(key, gen)
+	assert.Nil(t, c.Get(key.RFingerprint))
+
+	c.Put(key, c.Generation())
+	assert.NotNil(t, c.Get(key.RFingerprint))
+}
+
+func TestKeyCacheCopies(t *testing.T) {
+	c := newKeyCache(1)
+	key := MustInputAscKey(t, "alice_signed.asc")
+	nsigs := countSigs(key)
+	c.Put(key, c.Generation())
+
+	// Changes to the stored key or to a returned copy do not reach the cache.
+	key.FilterSigners(nil)
+	got := c.Get(key.RFingerprint)
+	assert.Equal(t, nsigs, countSigs(got))
+	MergeKey(got, MustInputAscKey(t, "alice_unsigned.asc"))
+	got.userIds[0].signatures = nil
+	assert.Equal(t, nsigs, countSigs(c.Get(key.RFingerprint)))
+}
+
+func TestKeyCacheDisabled(t *testing.T) {
+	c := newKeyCache(0)
+	key := MustInputAscKey(t, "alice_signed.asc")
+	c.Put(key, c.Generation())
+	assert.Nil(t, c.Get(key.RFingerprint))
+	assert.Equal(t, 0, c.Len())
+}
+
+// Uncached lookups parse every packet of the key and resolve it again.
+func BenchmarkFetchUncached(b *testing.B) {
+	key := benchmarkKey(b, "weasel.asc")
+	var buf bytes.Buffer
+	if err := WritePackets(&buf, key); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for keyRead := range ReadKeys(bytes.NewBuffer(buf.Bytes())) {
+			if keyRead.Error != nil {
+				b.Fatal(keyRead.Error)
+			}
+		}
+	}
+}
+
+func BenchmarkFetchCached(b *testing.B) {
+	key := benchmarkKey(b, "weasel.asc")
+	c := newKeyCache(1)
+	c.Put(key, c.Generation())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if c.Get(key.RFingerprint) == nil {
+			b.Fatal("key not cached")
+		}
+	}
+}
+
+// Lookups served concurrently from one cached key must not race, when run
+// with the race detector.
+func TestKeyCacheConcurrent(t *testing.T) {
+	c := newKeyCache(1)
+	key := MustInputAscKey(t, "uat.asc")
+	var expect bytes.Buffer
+	assert.Nil(t, WriteArmoredPackets(&expect, key))
+	c.Put(key, c.Generation())
+
+	var wg sync.WaitGroup
+	results := make(chan string, 8)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := c.Get(key.RFingerprint)
+			Sort(got)
+			got.SortUserIds()
+			var buf bytes.Buffer
+			assert.Nil(t, WriteArmoredPackets(&buf, got))
+			assert.Nil(t, got.WriteMRIndex(ioutil.Discard, true))
+			assert.Equal(t, key.Md5, SksDigest(got, md5.New()))
+			results <- buf.String()
+		}()
+	}
+	wg.Wait()
+	close(results)
+	for result := range results {
+		assert.Equal(t, expect.String(), result)
+	}
+}
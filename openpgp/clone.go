@@ -0,0 +1,106 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+// cloner deep-copies the records of a public key, keeping track of the
+// copied signatures so that cross-references point into the copy.
+type cloner struct {
+	sigs map[*Signature]*Signature
+}
+
+func cloneBytes(buf []byte) []byte {
+	if buf == nil {
+		return nil
+	}
+	return append([]byte(nil), buf...)
+}
+
+func (c *cloner) sig(sig *Signature) *Signature {
+	if sig == nil {
+		return nil
+	}
+	if clone, ok := c.sigs[sig]; ok {
+		return clone
+	}
+	clone := *sig
+	c.sigs[sig] = &clone
+	clone.Packet = cloneBytes(sig.Packet)
+	clone.revSig = c.sig(sig.revSig)
+	return &clone
+}
+
+func (c *cloner) sigList(sigs []*Signature) (result []*Signature) {
+	for _, sig := range sigs {
+		result = append(result, c.sig(sig))
+	}
+	return
+}
+
+// Clone returns a deep copy of the public key and all of its user IDs,
+// user attributes, subkeys and signatures, including their packet data.
+// Changes to the copy do not affect the original. The parsed packet
+// structures are shared, as they are not modified once read.
+func (pubkey *Pubkey) Clone() *Pubkey {
+	c := &cloner{sigs: make(map[*Signature]*Signature)}
+	clone := *pubkey
+	clone.Packet = cloneBytes(pubkey.Packet)
+	clone.Unsupported = cloneBytes(pubkey.Unsupported)
+	clone.signatures = c.sigList(pubkey.signatures)
+	clone.revSig = c.sig(pubkey.revSig)
+	clone.primaryUidSig = c.sig(pubkey.primaryUidSig)
+	clone.primaryUatSig = c.sig(pubkey.primaryUatSig)
+
+	clone.userIds = nil
+	clone.primaryUid = nil
+	for _, uid := range pubkey.userIds {
+		uidClone := *uid
+		uidClone.Packet = cloneBytes(uid.Packet)
+		uidClone.signatures = c.sigList(uid.signatures)
+		uidClone.revSig = c.sig(uid.revSig)
+		uidClone.selfSignature = c.sig(uid.selfSignature)
+		clone.userIds = append(clone.userIds, &uidClone)
+		if uid == pubkey.primaryUid {
+			clone.primaryUid = &uidClone
+		}
+	}
+
+	clone.userAttributes = nil
+	clone.primaryUat = nil
+	for _, uat := range pubkey.userAttributes {
+		uatClone := *uat
+		uatClone.Packet = cloneBytes(uat.Packet)
+		uatClone.signatures = c.sigList(uat.signatures)
+		uatClone.revSig = c.sig(uat.revSig)
+		uatClone.selfSignature = c.sig(uat.selfSignature)
+		clone.userAttributes = append(clone.userAttributes, &uatClone)
+		if uat == pubkey.primaryUat {
+			clone.primaryUat = &uatClone
+		}
+	}
+
+	clone.subkeys = nil
+	for _, subkey := range pubkey.subkeys {
+		subkeyClone := *subkey
+		subkeyClone.Packet = cloneBytes(subkey.Packet)
+		subkeyClone.signatures = c.sigList(subkey.signatures)
+		subkeyClone.revSig = c.sig(subkey.revSig)
+		subkeyClone.bindingSig = c.sig(subkey.bindingSig)
+		clone.subkeys = append(clone.subkeys, &subkeyClone)
+	}
+	return &clone
+}
@@ -0,0 +1,58 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"crypto/md5"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClone(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	digest := key.Md5
+	nsigs := countSigs(key)
+	packet := append([]byte(nil), key.Packet...)
+	uidPacket := append([]byte(nil), key.userIds[0].Packet...)
+	sigPacket := append([]byte(nil), key.userIds[0].signatures[0].Packet...)
+
+	clone := key.Clone()
+	assert.Equal(t, digest, clone.Md5)
+	assert.Equal(t, nsigs, countSigs(clone))
+	assert.Equal(t, SksDigest(key, md5.New()), SksDigest(clone, md5.New()))
+	// Cross-references point into the copy.
+	assert.True(t, clone.primaryUid == clone.userIds[0])
+	assert.True(t, clone.userIds[0].selfSignature != key.userIds[0].selfSignature)
+
+	// Mutate the clone's records and packet data.
+	clone.Packet[0] ^= 0xff
+	clone.userIds[0].Packet[0] ^= 0xff
+	clone.userIds[0].signatures[0].Packet[0] ^= 0xff
+	clone.userIds[0].signatures = nil
+	clone.userIds = append(clone.userIds[:1], clone.userIds[2:]...)
+	clone.subkeys = nil
+	clone.Md5 = ""
+
+	assert.Equal(t, packet, key.Packet)
+	assert.Equal(t, uidPacket, key.userIds[0].Packet)
+	assert.Equal(t, sigPacket, key.userIds[0].signatures[0].Packet)
+	assert.Equal(t, nsigs, countSigs(key))
+	assert.Equal(t, digest, key.Md5)
+	assert.Equal(t, digest, SksDigest(key, md5.New()))
+}
@@ -0,0 +1,102 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+)
+
+// CompressPackets returns whether packet data should be stored
+// zlib-compressed in the database.
+func (s *Settings) CompressPackets() bool {
+	return s.GetBool("hockeypuck.openpgp.compressPackets")
+}
+
+var ErrNoPackedKey = fmt.Errorf("No public key found in packed data")
+
+// packBytes zlib-compresses OpenPGP packet data.
+func packBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unpackBytes returns OpenPGP packet data, decompressing it if it was
+// packed. Packet data is stored as is unless compression is enabled, so both
+// forms are accepted. The two cannot be confused: every OpenPGP packet header
+// has its high bit set, which a zlib header never has.
+func unpackBytes(b []byte) ([]byte, error) {
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		return b, nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// storedPacket returns packet data in the form it should be written to the
+// database, according to the configuration.
+func storedPacket(b []byte) []byte {
+	if !Config().CompressPackets() {
+		return b
+	}
+	if packed, err := packBytes(b); err == nil {
+		return packed
+	}
+	return b
+}
+
+// PackedBytes returns the serialized key material, zlib-compressed.
+func (pubkey *Pubkey) PackedBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := WritePackets(&buf, pubkey); err != nil {
+		return nil, err
+	}
+	return packBytes(buf.Bytes())
+}
+
+// UnpackBytes reads a public key from key material returned by PackedBytes.
+// Digests are calculated on the uncompressed key material, as for any
+// other key read.
+func UnpackBytes(b []byte) (pubkey *Pubkey, err error) {
+	if b, err = unpackBytes(b); err != nil {
+		return nil, err
+	}
+	for keyRead := range ReadKeys(bytes.NewBuffer(b)) {
+		// Keep reading to the end, so that the reader is not left blocked.
+		if pubkey == nil && err == nil {
+			pubkey, err = keyRead.Pubkey, keyRead.Error
+		}
+	}
+	if pubkey == nil && err == nil {
+		err = ErrNoPackedKey
+	}
+	return
+}
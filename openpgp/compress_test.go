@@ -0,0 +1,71 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+func TestPackedBytesRoundTrip(t *testing.T) {
+	key := MustInputAscKey(t, "lp1195901.asc")
+	var buf bytes.Buffer
+	assert.Nil(t, WritePackets(&buf, key))
+	packed, err := key.PackedBytes()
+	assert.Nil(t, err)
+	assert.True(t, len(packed) < buf.Len(), "packed %d >= serialized %d", len(packed), buf.Len())
+
+	unpacked, err := UnpackBytes(packed)
+	assert.Nil(t, err)
+	assert.Equal(t, key.Fingerprint(), unpacked.Fingerprint())
+	assert.Equal(t, key.Md5, unpacked.Md5)
+	assert.Equal(t, key.Sha256, unpacked.Sha256)
+
+	// Uncompressed key material is accepted as well.
+	unpacked, err = UnpackBytes(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, key.Md5, unpacked.Md5)
+
+	_, err = UnpackBytes(nil)
+	assert.Equal(t, ErrNoPackedKey, err)
+}
+
+func TestStoredPacket(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "sksdigest.asc")
+	uid := key.userIds[0]
+	orig := uid.Packet
+
+	hockeypuck.SetConfig("")
+	assert.Equal(t, orig, storedPacket(orig))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+compressPackets=true
+`)
+	stored := storedPacket(orig)
+	assert.NotEqual(t, orig, stored)
+	uid.Packet = stored
+	assert.Nil(t, uid.Read())
+	assert.Equal(t, orig, uid.Packet)
+	assert.Equal(t, "Jenny Ondioline <jennyo@transient.net>", uid.UserId.Id)
+}
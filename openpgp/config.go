@@ -18,6 +18,8 @@
 package openpgp
 
 import (
+	"fmt"
+
 	"github.com/hockeypuck/hockeypuck"
 )
 
@@ -28,3 +30,77 @@ type Settings struct {
 func Config() *Settings {
 	return &Settings{hockeypuck.Config()}
 }
+
+// Validate checks the OpenPGP settings for conflicting options.
+func (s *Settings) Validate() error {
+	if err := s.Settings.Validate(); err != nil {
+		return err
+	}
+	if s.RequireValidSelfSig() && s.Get("hockeypuck.openpgp.verifySigs") != nil &&
+		!s.GetBool("hockeypuck.openpgp.verifySigs") {
+		return fmt.Errorf("hockeypuck.openpgp.requireValidSelfSig cannot be used with verifySigs=false")
+	}
+	for _, key := range []string{"hockeypuck.openpgp.requireUserId", "hockeypuck.openpgp.compressPackets",
+		"hockeypuck.openpgp.preservePackets", "hockeypuck.openpgp.honorNoModify",
+		"hockeypuck.openpgp.strictParsing", "hockeypuck.openpgp.indexImages",
+		"hockeypuck.openpgp.replaceSelfSigs", reconReadOnlyPullKey} {
+		if err := s.validateBool(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"hockeypuck.openpgp.maxUserIds", "hockeypuck.openpgp.maxSubkeys"} {
+		if err := s.validatePositiveInt(key); err != nil {
+			return err
+		}
+	}
+	if s.CacheSize() < 0 {
+		return fmt.Errorf("hockeypuck.openpgp.cacheSize must not be negative")
+	}
+	if err := s.validateIndexMode(); err != nil {
+		return err
+	}
+	if err := s.validateFingerprintStyle(); err != nil {
+		return err
+	}
+	if err := s.validateCreationBounds(); err != nil {
+		return err
+	}
+	if err := s.validateExpiredGracePeriod(); err != nil {
+		return err
+	}
+	if err := s.validateFingerprintLists(); err != nil {
+		return err
+	}
+	if err := s.validateTrustedSigners(); err != nil {
+		return err
+	}
+	if err := s.validateRecon(); err != nil {
+		return err
+	}
+	if err := s.validateQuarantine(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateBool returns an error if the key is set to a non-boolean value.
+func (s *Settings) validateBool(key string) error {
+	switch v := s.Get(key).(type) {
+	case nil, bool:
+		return nil
+	default:
+		return fmt.Errorf("%s: invalid boolean value %v", key, v)
+	}
+}
+
+// validatePositiveInt returns an error if the key is set to a value that is
+// not a positive integer.
+func (s *Settings) validatePositiveInt(key string) error {
+	if s.Get(key) == nil {
+		return nil
+	}
+	if v := s.GetIntDefault(key, 0); v <= 0 {
+		return fmt.Errorf("%s: must be a positive integer, got %v", key, s.Get(key))
+	}
+	return nil
+}
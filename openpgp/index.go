@@ -18,13 +18,14 @@
 package openpgp
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	ht "html/template"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
-	tt "text/template"
 	"time"
 
 	"code.google.com/p/go.crypto/openpgp/packet"
@@ -44,10 +45,11 @@ const indexPageTmplSrc = `{{/*
 /*<![CDATA[*/
  .uid { color: green; text-decoration: underline; }
  .warn { color: red; font-weight: bold; }
+ .dead { color: gray; }
 /*]]>*/
 </style></head><body><h1>Search results for '{{ .Lookup.Search }}'</h1>{{ end }}{{/*
 
-*/}}{{ define "PageFooter" }}</body></html>{{ end }}{{/*
+*/}}{{ define "PageFooter" }}{{ if .Truncated }}<p>Only the first {{ len .Keys }} matching keys are shown. Refine the search to find others.</p>{{ end }}</body></html>{{ end }}{{/*
 
 */}}{{ define "IndexColHeader" }}<pre>Type bits/keyID     Date       User ID
 </pre>{{ end }}{{/*
@@ -56,11 +58,14 @@ const indexPageTmplSrc = `{{/*
 pub  {{ .BitLen }}{{ .Algorithm | algocode }}/<a href="/pks/lookup?op=get&amp;search=0x{{ .Fingerprint }}">{{ .ShortId | upper }}</a> {{ .Creation | date }} {{/*
 */}}{{ range $i, $uid := .UserIds }}{{/*
 */}}{{ if $i }}                               {{ $uid.Keywords }}{{/*
-*/}}{{ else }}<a href="/pks/lookup?op=vindex&amp;fingerprint=on&amp;search=0x{{ $fp }}">{{ $uid.Keywords }}</a>{{ end }}
+*/}}{{ else }}<a href="/pks/lookup?op=vindex&amp;fingerprint=on&amp;search=0x{{ $fp }}">{{ $uid.Keywords }}</a>{{ end }}{{/*
+*/}}{{ if $uid.IsRevoked }} [revoked]{{ end }}
 {{ end }}{{/*
-*/}}{{ range $i, $uat := .UserAttributes }}{{ range $imgnum, $imgdat := $uat.UserAttribute.ImageData }}{{/*
+*/}}{{ range $i, $uat := .UserAttributes }}{{ range $imgnum, $imgdat := $uat.Images }}{{/*
 */}}                               <img src="data:image/jpeg;base64,{{ $imgdat | imgsrcdata }}"></img>{{/*
 */}}{{ end }}{{ end }}{{/*
+*/}}{{ if .|keyExpired }}                               <span class="warn">[expired]</span>
+{{ end }}{{/*
 */}}{{ end }}{{/*
 
 */}}{{ define "IndexPage" }}{{ template "PageHeader" . }}{{ $lookup := .Lookup }}{{/*
@@ -74,14 +79,14 @@ pub  {{ .BitLen }}{{ .Algorithm | algocode }}/<a href="/pks/lookup?op=get&amp;se
 	 SHA256={{ $key.Sha256 | upper }}
 {{ end }}{{/*
 */}}</pre>{{ end }}{{/*
-*/}}{{ template "PageFooter" }}{{ end }}{{/*
+*/}}{{ template "PageFooter" . }}{{ end }}{{/*
 
 */}}{{ define "VindexColHeader" }}<pre>Type bits/keyID     cr. time   exp time   key expir
 </pre>{{ end }}{{/*
 
 */}}{{ define "VindexPage" }}{{ template "PageHeader" . }}{{ $lookup := .Lookup }}{{/*
 */}}{{ template "VindexColHeader" . }}{{/*
-*/}}{{ range $i, $key := .Keys }}<hr /><pre><strong>pub</strong>  {{ .BitLen }}{{ .Algorithm | algocode }}/<a href="/pks/lookup?op=get&amp;search=0x{{ .Fingerprint }}">{{ .ShortId | upper }}</a> {{ .Creation | date }}
+*/}}{{ range $i, $key := .Keys }}<hr /><pre><strong>pub</strong>  {{ .BitLen }}{{ .Algorithm | algocode }}/<a href="/pks/lookup?op=get&amp;search=0x{{ .Fingerprint }}">{{ .ShortId | upper }}</a> {{ .Creation | date }}{{ if $key|keyExpired }} <span class="warn">[expired]</span>{{ end }}
 {{ if $lookup.Fingerprint }}{{/*
 */}}	 Fingerprint={{ $key.Fingerprint | fpformat | upper }}
 {{ end }}{{/*
@@ -89,48 +94,75 @@ pub  {{ .BitLen }}{{ .Algorithm | algocode }}/<a href="/pks/lookup?op=get&amp;se
 */}}	 MD5={{ $key.Md5 | upper }}
 	 SHA256={{ $key.Sha256 | upper }}
 {{ end }}{{ range $i, $uid := $key.UserIds }}
-<strong>uid</strong> <span class="uid">{{ $uid.Keywords }}</span>{{/*
+<strong>uid</strong> <span class="{{ if $uid.IsRevoked }}dead{{ else }}uid{{ end }}">{{ $uid.Keywords }}</span>{{ if $uid.IsRevoked }} [revoked]{{ end }}{{/*
 */}}{{ range $i, $sig := $uid.Signatures }}
 sig <span {{ if $sig|sigWarn }}class='warn'{{ end }}>{{ $sig|sigLabel }}</span>  <a href="/pks/lookup?op=get&amp;search=0x{{ $sig.IssuerKeyId|upper }}">{{ $sig.IssuerShortId|upper }}</a> {{ $sig.Creation|date }} {{ if equal ($key.KeyId) ($sig.IssuerKeyId) }}__________ {{ $sig.Expiration|date|blank }} [selfsig]{{ else }}{{ $sig.Expiration|date|blank }} __________ <a href="/pks/lookup?op=vindex&amp;search=0x{{ $sig.IssuerKeyId|upper }}">{{ $sig.IssuerKeyId|upper }}</a>{{ end }}{{ end }}{{/*
 */}}
 {{ end }}{{/* range $key.UserIds
 */}}{{ range $i, $uat := $key.UserAttributes }}
-<strong>uat</strong> <span class="uid">{{ range $imgnum, $imgdat := $uat.UserAttribute.ImageData }}{{/*
+<strong>uat</strong> <span class="uid">{{ range $imgnum, $imgdat := $uat.Images }}{{/*
 */}}<img src="data:image/jpeg;base64,{{ $imgdat | imgsrcdata }}"></img>{{ end }}</span>{{/*
 */}}{{ range $i, $sig := $uat.Signatures }}
 sig <span {{ if $sig|sigWarn }}class='warn'{{ end }}>{{ $sig|sigLabel }}</span>  <a href="/pks/lookup?op=get&amp;search=0x{{ $sig.IssuerKeyId|upper }}">{{ $sig.IssuerShortId|upper }}</a> {{ $sig.Creation|date }} {{ if equal ($key.KeyId) ($sig.IssuerKeyId) }}__________ {{ $sig.Expiration|date|blank }} [selfsig]{{ else }}{{ $sig.Expiration|date|blank }} __________ <a href="/pks/lookup?op=vindex&amp;search=0x{{ $sig.IssuerKeyId|upper }}">{{ $sig.IssuerKeyId|upper }}</a>{{ end }}{{ end }}
 {{ end }}{{/* range $key.UserAttributes
 */}}{{ range $i, $subkey := $key.Subkeys }}
-<strong>sub</strong>  {{ .BitLen }}{{ .Algorithm | algocode }}/{{ .ShortId | upper }} {{ .Creation | date }}{{ range $i, $sig := $subkey.Signatures }}
+<strong>sub</strong>  {{ if $subkey|subkeyDead }}<span class="dead">{{ end }}{{ .BitLen }}{{ .Algorithm | algocode }}/{{ .ShortId | upper }} {{ .Creation | date }}{{ if $subkey|subkeyDead }}</span>{{ end }}{{ range $i, $sig := $subkey.Signatures }}
 sig <span {{ if $sig|sigWarn }}class='warn'{{ end }}>{{ $sig|sigLabel }}</span>  <a href="/pks/lookup?op=get&amp;search=0x{{ $sig.IssuerKeyId|upper }}">{{ $sig.IssuerShortId|upper }}</a> {{ $sig.Creation|date }} {{ if equal ($key.KeyId) ($sig.IssuerKeyId) }}__________ {{ $sig.Expiration|date|blank }} []{{ else }}{{ $sig.Expiration|date|blank }} __________ {{ $sig.IssuerShortId|upper }}{{ end }}{{ end }}{{/*
 */}}
 {{ end }}{{/* range .$key.Subkeys
 */}}{{ end }}{{/* range .Keys
-*/}}{{ template "PageFooter" }}{{ end }}{{/*
+*/}}{{ template "PageFooter" . }}{{ end }}{{/*
 */}}{{ if .Verbose }}{{ template "VindexPage" . }}{{ else }}{{ template "IndexPage" . }}{{ end }}`
 
 var indexPageTmpl *ht.Template
 
-const indexMrTmplSrc = `{{ define "IndexMr" }}{{/*
-*/}}info:1:1{{/*
-*/}}{{ $lookup := .Lookup }}{{ range $keyi, $key := .Keys }}
-pub:{{ if $lookup.Fingerprint }}{{ $key.Fingerprint|upper }}{{ else }}{{ $key.ShortId|upper }}{{ end }}:{{ $key.Algorithm }}:{{ $key.BitLen }}:{{ $key.Creation.Unix }}:{{ $key.Expiration|expunix }}:{{ range $uidi, $uid := $key.UserIds }}
-uid:{{ $uid.Keywords|escapeColons }}:{{ (maxSelfSig $key $uid.Signatures).Creation.Unix }}:{{ (maxSelfSig $key $uid.Signatures).Expiration|expunix }}:{{ end }}{{ end }}{{/*
-*/}}{{ end }}{{/*
+// Fingerprint display styles.
+const (
+	// FingerprintPlain displays the fingerprint as it is.
+	FingerprintPlain = "plain"
+	// FingerprintSpaced displays the fingerprint in groups of four digits,
+	// as GnuPG does.
+	FingerprintSpaced = "spaced"
+	// FingerprintColons displays the fingerprint as colon-separated octets.
+	FingerprintColons = "colons"
+)
 
-*/}}{{ template "IndexMr" . }}`
+// FingerprintStyle returns how fingerprints are displayed in index output:
+// FingerprintPlain, FingerprintSpaced or FingerprintColons.
+func (s *Settings) FingerprintStyle() string {
+	return strings.ToLower(s.GetStringDefault("hockeypuck.openpgp.fingerprintStyle", FingerprintSpaced))
+}
 
-var indexMrTmpl *tt.Template
+// validateFingerprintStyle returns an error if the fingerprint style is not
+// known.
+func (s *Settings) validateFingerprintStyle() error {
+	switch style := s.FingerprintStyle(); style {
+	case FingerprintPlain, FingerprintSpaced, FingerprintColons:
+		return nil
+	default:
+		return fmt.Errorf("hockeypuck.openpgp.fingerprintStyle: unknown style %q", style)
+	}
+}
 
-func fingerprintFormat(fp string) string {
+// FormatFingerprint formats a hex fingerprint for display in the given style.
+// In the spaced style, a 40-digit fingerprint is split in half by an extra
+// space. The fingerprint is returned as it is for an unknown style.
+func FormatFingerprint(fp string, style string) string {
 	var result []rune
 	for i, r := range fp {
 		if i > 0 {
-			if i%4 == 0 {
-				result = append(result, ' ')
-			}
-			if i%20 == 0 && len(fp) == 40 {
-				result = append(result, ' ')
+			switch style {
+			case FingerprintSpaced:
+				if i%4 == 0 {
+					result = append(result, ' ')
+				}
+				if i%20 == 0 && len(fp) == 40 {
+					result = append(result, ' ')
+				}
+			case FingerprintColons:
+				if i%2 == 0 {
+					result = append(result, ':')
+				}
 			}
 		}
 		result = append(result, r)
@@ -138,6 +170,10 @@ func fingerprintFormat(fp string) string {
 	return string(result)
 }
 
+func fingerprintFormat(fp string) string {
+	return FormatFingerprint(fp, Config().FingerprintStyle())
+}
+
 func escapeColons(s string) string {
 	var result []rune
 	for _, r := range s {
@@ -209,6 +245,16 @@ func init() {
 		"equal":        func(s, r string) bool { return s == r },
 		"sigLabel":     sigLabel,
 		"sigWarn":      sigWarn,
+		"keyExpired": func(key *Pubkey) bool {
+			switch key.EffectiveStatus(time.Now()) {
+			case StatusExpired, StatusGrace:
+				return true
+			}
+			return false
+		},
+		"subkeyDead": func(subkey *Subkey) bool {
+			return subkey.IsRevoked() || subkey.IsExpired(time.Now())
+		},
 		"expunix": func(t time.Time) string {
 			if t.Unix() == NeverExpires.Unix() {
 				return ""
@@ -232,7 +278,106 @@ func init() {
 		},
 	}
 	indexPageTmpl = ht.Must(ht.New("indexPage").Funcs(funcs).Parse(indexPageTmplSrc))
-	indexMrTmpl = tt.Must(tt.New("indexPage").Funcs(funcs).Parse(indexMrTmplSrc))
+}
+
+// mrEscape percent-encodes colons, percent signs and any bytes that are not
+// printable 7-bit characters in a machine-readable index field.
+func mrEscape(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if b == ':' || b == '%' || b < 0x20 || b >= 0x7f {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// mrTime formats a timestamp for the machine-readable index, which is
+// left empty for "never expires".
+func mrTime(t time.Time) string {
+	if t.IsZero() || t.Unix() == NeverExpires.Unix() {
+		return ""
+	}
+	return fmt.Sprintf("%d", t.Unix())
+}
+
+func mrFlags(revoked, expired bool) string {
+	var flags string
+	if revoked {
+		flags += "r"
+	}
+	if expired {
+		flags += "e"
+	}
+	return flags
+}
+
+// expiration returns when the primary public key expires, taking the
+// key lifetime from the primary user ID self-signature on V4 keys.
+func (pubkey *Pubkey) expiration() time.Time {
+	if pubkey.primaryUidSig != nil && pubkey.primaryUidSig.Expiration.Unix() != NeverExpires.Unix() {
+		return pubkey.primaryUidSig.Expiration
+	}
+	return pubkey.Expiration
+}
+
+// expiration returns when the subkey expires, according to its binding
+// signature.
+func (subkey *Subkey) expiration() time.Time {
+	if subkey.bindingSig != nil && subkey.bindingSig.Expiration.Unix() != NeverExpires.Unix() {
+		return subkey.bindingSig.Expiration
+	}
+	return subkey.Expiration
+}
+
+// WriteMRIndex writes the public key in the HKP machine-readable index
+// format: a pub line, followed by its uid and sub lines. The pub line
+// identifies the key by its fingerprint if requested, otherwise by its
+// short key ID.
+func (pubkey *Pubkey) WriteMRIndex(w io.Writer, fingerprint bool) error {
+	now := time.Now()
+	keyId := pubkey.ShortId()
+	if fingerprint && pubkey.PublicKeyV3 == nil {
+		keyId = pubkey.Fingerprint()
+	}
+	expiration := pubkey.expiration()
+	_, err := fmt.Fprintf(w, "pub:%s:%d:%d:%s:%s:%s\n",
+		strings.ToUpper(keyId), pubkey.Algorithm, pubkey.BitLen,
+		mrTime(pubkey.Creation), mrTime(expiration),
+		mrFlags(pubkey.IsRevoked(),
+			expiration.Unix() != NeverExpires.Unix() && now.After(expiration)))
+	if err != nil {
+		return err
+	}
+	for _, uid := range pubkey.userIds {
+		var creation, expiration time.Time
+		if sig := maxSelfSig(pubkey, uid.signatures); sig != nil {
+			creation, expiration = sig.Creation, sig.Expiration
+		}
+		_, err = fmt.Fprintf(w, "uid:%s:%s:%s:%s\n",
+			mrEscape(uid.Keywords), mrTime(creation), mrTime(expiration),
+			mrFlags(uid.IsRevoked(),
+				!expiration.IsZero() && expiration.Unix() != NeverExpires.Unix() && now.After(expiration)))
+		if err != nil {
+			return err
+		}
+	}
+	for _, subkey := range pubkey.subkeys {
+		keyId := subkey.Fingerprint()
+		if subkey.PublicKeyV3 != nil {
+			keyId = subkey.KeyId()
+		}
+		_, err = fmt.Fprintf(w, "sub:%s:%d:%d:%s:%s:%s\n",
+			strings.ToUpper(keyId), subkey.Algorithm, subkey.BitLen,
+			mrTime(subkey.Creation), mrTime(subkey.expiration()),
+			mrFlags(subkey.IsRevoked(), subkey.IsExpired(now)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type IndexResponse struct {
@@ -240,19 +385,34 @@ type IndexResponse struct {
 	Keys    []*Pubkey
 	Verbose bool
 	Err     error
+	// Truncated indicates that more keys matched than are listed.
+	Truncated bool
 }
 
 func (r *IndexResponse) Error() error {
 	return r.Err
 }
 
+func (r *IndexResponse) writeMr(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "info:1:%d\n", len(r.Keys)); err != nil {
+		return err
+	}
+	for _, key := range r.Keys {
+		if err := key.WriteMRIndex(w, r.Lookup.Fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r *IndexResponse) WriteTo(w http.ResponseWriter) error {
 	for _, key := range r.Keys {
 		Sort(key)
+		key.SortUserIds()
 	}
 	if r.Lookup.MachineReadable() {
 		w.Header().Add("Content-Type", "text/plain")
-		r.Err = indexMrTmpl.Execute(w, r)
+		r.Err = r.writeMr(w)
 	} else {
 		w.Header().Add("Content-Type", "text/html")
 		r.Err = indexPageTmpl.Execute(w, r)
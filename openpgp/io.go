@@ -18,18 +18,24 @@
 package openpgp
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
-	"code.google.com/p/go.crypto/openpgp"
 	"code.google.com/p/go.crypto/openpgp/armor"
 	"code.google.com/p/go.crypto/openpgp/packet"
 )
@@ -44,7 +50,7 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	NeverExpires = t
+	NeverExpires = t.UTC()
 }
 
 // Get the public key fingerprint as a hex string.
@@ -59,11 +65,7 @@ func FingerprintV3(pubkey *packet.PublicKeyV3) string {
 
 func WritePackets(w io.Writer, root PacketRecord) error {
 	err := root.Visit(func(rec PacketRecord) error {
-		op, err := rec.GetOpaquePacket()
-		if err != nil {
-			return err
-		}
-		return op.Serialize(w)
+		return rec.Serialize(w)
 	})
 	if err != nil {
 		return err
@@ -79,17 +81,350 @@ func WritePackets(w io.Writer, root PacketRecord) error {
 	return nil
 }
 
+// ArmorOptions control how exported key material is armored.
+type ArmorOptions struct {
+	// Headers are written into the armor header block, for example
+	// "Comment" or "Version". When empty, no headers are written.
+	Headers map[string]string
+	// V6 writes the armor as RFC 9580 recommends for V6 keys, without the
+	// "Version" header or the CRC-24 checksum line.
+	V6 bool
+}
+
+// forVersion returns the armor options to use for keys of the given
+// version. V4 keys are armored as before.
+func (opts *ArmorOptions) forVersion(version int) *ArmorOptions {
+	if version != 6 {
+		return opts
+	}
+	v6 := &ArmorOptions{Headers: make(map[string]string), V6: true}
+	if opts != nil {
+		for k, v := range opts.Headers {
+			if k != "Version" {
+				v6.Headers[k] = v
+			}
+		}
+	}
+	return v6
+}
+
+// Armor options configured for key export.
+func (s *Settings) ArmorOptions() *ArmorOptions {
+	opts := &ArmorOptions{Headers: make(map[string]string)}
+	if comment := s.GetString("hockeypuck.openpgp.armor.comment"); comment != "" {
+		opts.Headers["Comment"] = comment
+	}
+	if version := s.GetString("hockeypuck.openpgp.armor.version"); version != "" {
+		opts.Headers["Version"] = version
+	}
+	return opts
+}
+
+// WriteArmoredPackets writes the key material in ASCII-armored form,
+// without any armor headers.
 func WriteArmoredPackets(w io.Writer, root PacketRecord) error {
-	armw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
-	defer armw.Close()
-	if err != nil {
+	return WriteArmoredPacketsOpts(w, root, nil)
+}
+
+// WriteArmoredPacketsOpts writes the key material in ASCII-armored form,
+// using the armor headers given in opts, if any. Output uses LF line endings,
+// with headers in sorted order so that it is the same for the same key,
+// and ends with a newline after the armor tail. V6 keys are armored
+// without a "Version" header or checksum.
+func WriteArmoredPacketsOpts(w io.Writer, root PacketRecord, opts *ArmorOptions) error {
+	var buf bytes.Buffer
+	if err := WritePackets(&buf, root); err != nil {
+		return err
+	}
+	if pubkey, ok := root.(*Pubkey); ok {
+		opts = opts.forVersion(pubkey.Version())
+	}
+	return writeArmoredBlock(w, buf.Bytes(), opts)
+}
+
+// writeArmoredBlock writes the packet data as an ASCII-armored public key
+// block, as described for WriteArmoredPacketsOpts.
+func writeArmoredBlock(w io.Writer, packets []byte, opts *ArmorOptions) error {
+	var buf bytes.Buffer
+	aw := newArmorWriter(&buf, opts)
+	if _, err := aw.Write(packets); err != nil {
 		return err
 	}
-	return WritePackets(armw, root)
+	if err := aw.Close(); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// armorWriter writes packet data into an ASCII-armored public key block as
+// it is given, in the form described for WriteArmoredPacketsOpts. The armor
+// header is written on the first write, and the checksum and armor tail
+// on Close.
+type armorWriter struct {
+	w       io.Writer
+	opts    *ArmorOptions
+	lines   *armorLineWriter
+	enc     io.WriteCloser
+	crc     uint32
+	started bool
+}
+
+func newArmorWriter(w io.Writer, opts *ArmorOptions) *armorWriter {
+	return &armorWriter{w: w, opts: opts, crc: crc24Init}
+}
+
+func (aw *armorWriter) start() error {
+	aw.started = true
+	var headers []string
+	if aw.opts != nil {
+		for k, v := range aw.opts.Headers {
+			headers = append(headers, k+": "+v+"\n")
+		}
+	}
+	sort.Strings(headers)
+	out := bytes.NewBufferString(armorPubkeyBegin + "\n")
+	for _, header := range headers {
+		out.WriteString(header)
+	}
+	out.WriteString("\n")
+	aw.lines = &armorLineWriter{w: aw.w}
+	aw.enc = base64.NewEncoder(base64.StdEncoding, aw.lines)
+	_, err := out.WriteTo(aw.w)
+	return err
+}
+
+func (aw *armorWriter) Write(p []byte) (int, error) {
+	if !aw.started {
+		if err := aw.start(); err != nil {
+			return 0, err
+		}
+	}
+	aw.crc = crc24Update(aw.crc, p)
+	return aw.enc.Write(p)
+}
+
+func (aw *armorWriter) Close() error {
+	if !aw.started {
+		if err := aw.start(); err != nil {
+			return err
+		}
+	}
+	if err := aw.enc.Close(); err != nil {
+		return err
+	}
+	if err := aw.lines.Close(); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if aw.opts == nil || !aw.opts.V6 {
+		crc := aw.crc & 0xffffff
+		out.WriteString("=" + base64.StdEncoding.EncodeToString(
+			[]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\n")
+	}
+	out.WriteString(armorPubkeyEnd + "\n")
+	_, err := out.WriteTo(aw.w)
+	return err
+}
+
+// armorLineWriter breaks base64 armor data into lines of armorLineLength.
+type armorLineWriter struct {
+	w    io.Writer
+	used int
+}
+
+func (l *armorLineWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		k := armorLineLength - l.used
+		if k > len(p) {
+			k = len(p)
+		}
+		var m int
+		m, err = l.w.Write(p[:k])
+		n += m
+		if err != nil {
+			return
+		}
+		l.used += k
+		p = p[k:]
+		if l.used == armorLineLength {
+			if _, err = l.w.Write([]byte{'\n'}); err != nil {
+				return
+			}
+			l.used = 0
+		}
+	}
+	return
+}
+
+// Close ends the last line, if it is not already complete.
+func (l *armorLineWriter) Close() error {
+	if l.used == 0 {
+		return nil
+	}
+	l.used = 0
+	_, err := l.w.Write([]byte{'\n'})
+	return err
+}
+
+var ErrKeyringClosed = fmt.Errorf("Keyring writer is closed")
+
+// KeyringWriter writes public keys into a single ASCII-armored block as
+// they are added, so that a large export need not be held in memory. The
+// armor header is written with the first key, and the checksum and armor
+// tail when the writer is closed.
+type KeyringWriter struct {
+	aw     *armorWriter
+	closed bool
+}
+
+// NewKeyringWriter returns a KeyringWriter writing to w, with the armor
+// headers given in opts, if any.
+func NewKeyringWriter(w io.Writer, opts *ArmorOptions) *KeyringWriter {
+	return &KeyringWriter{aw: newArmorWriter(w, opts)}
+}
+
+// Add writes the packets of the key to the armored block.
+func (kw *KeyringWriter) Add(pubkey *Pubkey) error {
+	if kw.closed {
+		return ErrKeyringClosed
+	}
+	return WritePackets(kw.aw, pubkey)
+}
+
+// Close completes the armored block. The underlying writer is not closed.
+func (kw *KeyringWriter) Close() error {
+	if kw.closed {
+		return ErrKeyringClosed
+	}
+	kw.closed = true
+	return kw.aw.Close()
+}
+
+// WritePartitions writes each partition of keys, as returned by
+// PartitionByAlgorithm, to its own file in the directory. Files are named
+// by algorithm ID, such as "algorithm-1.asc", or "algorithm-unknown.asc"
+// for keys of unknown algorithm. Keys are written in a single ASCII-armored
+// block per file if armored is set, otherwise as binary packets in files
+// with a ".pgp" extension. Files holding only V6 keys are armored as
+// WriteArmoredPacketsOpts armors a V6 key.
+func WritePartitions(dir string, partitions map[int][]*Pubkey, armored bool) error {
+	for algorithm, keys := range partitions {
+		name := fmt.Sprintf("algorithm-%d", algorithm)
+		if algorithm == AlgorithmUnknown {
+			name = "algorithm-unknown"
+		}
+		var buf bytes.Buffer
+		version := 6
+		for _, key := range keys {
+			if err := WritePackets(&buf, key); err != nil {
+				return err
+			}
+			if key.Version() != 6 {
+				version = key.Version()
+			}
+		}
+		if armored {
+			name += ".asc"
+			var out bytes.Buffer
+			opts := Config().ArmorOptions().forVersion(version)
+			if err := writeArmoredBlock(&out, buf.Bytes(), opts); err != nil {
+				return err
+			}
+			buf = out
+		} else {
+			name += ".pgp"
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	crc24Init = 0xb704ce
+	crc24Poly = 0x1864cfb
+)
+
+// Crc24 returns the CRC-24 checksum of data, as used in the checksum line
+// of ASCII-armored blocks (RFC 4880, section 6.1).
+func Crc24(data []byte) uint32 {
+	return crc24Update(crc24Init, data) & 0xffffff
+}
+
+// crc24Update adds data to a running CRC-24 checksum.
+func crc24Update(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc
+}
+
+const (
+	armorPubkeyBegin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	armorPubkeyEnd   = "-----END PGP PUBLIC KEY BLOCK-----"
+
+	// Length of the base64 lines in armored output.
+	armorLineLength = 64
+)
+
+var ErrNoArmoredKeys = fmt.Errorf("No armored public key block found")
+
+// ReadArmoredKeyBlocks finds each ASCII-armored public key block in the input
+// and returns its decoded contents. Surrounding text, other kinds of armored
+// blocks and leading or trailing whitespace on each line are ignored, so that
+// keys pasted along with other content can still be read. Blocks which cannot
+// be decoded are skipped, and the error for each is returned in blockErrors.
+func ReadArmoredKeyBlocks(r io.Reader) (result [][]byte, blockErrors []error, err error) {
+	br := bufio.NewReader(r)
+	var block *bytes.Buffer
+	for {
+		line, readErr := br.ReadString('\n')
+		line = strings.TrimSpace(line)
+		switch {
+		case line == armorPubkeyBegin:
+			block = bytes.NewBufferString(line + "\n")
+		case block != nil:
+			block.WriteString(line + "\n")
+			if line == armorPubkeyEnd {
+				if buf, err := decodeArmoredKeyBlock(block); err != nil {
+					blockErrors = append(blockErrors, err)
+				} else {
+					result = append(result, buf)
+				}
+				block = nil
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return nil, nil, readErr
+		}
+	}
+	if len(result) == 0 && len(blockErrors) == 0 {
+		return nil, nil, ErrNoArmoredKeys
+	}
+	return result, blockErrors, nil
+}
+
+func decodeArmoredKeyBlock(r io.Reader) ([]byte, error) {
+	armorBlock, err := armor.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(armorBlock.Body)
 }
 
 type OpaqueKeyring struct {
 	Packets      []*packet.OpaquePacket
+	RawPackets   [][]byte // original encoding of each packet, nil where unknown
 	RFingerprint string
 	Md5          string
 	Sha256       string
@@ -109,19 +444,32 @@ func (ok *OpaqueKeyring) setPosition(r io.Reader) {
 	}
 }
 
+var ErrMultiplePubkeys = fmt.Errorf("Multiple public keys in keyring")
+
+var ErrBadPubkey = fmt.Errorf("Failed to parse primary public key")
+
+var ErrNoPubkey = fmt.Errorf("No primary public key found")
+
 func (ok *OpaqueKeyring) Parse() (*Pubkey, error) {
 	var err error
 	var pubkey *Pubkey
 	var signable Signable
+	if ok.Error != nil {
+		return nil, ok.Error
+	}
 	pubkey = nil
-	for _, opkt := range ok.Packets {
+	for i, opkt := range ok.Packets {
 		var badPacket *packet.OpaquePacket
+		raw := ok.rawPacket(i)
 		if opkt.Tag == 6 { //packet.PacketTypePublicKey:
 			if pubkey != nil {
-				return nil, fmt.Errorf("Multiple public keys in keyring")
+				return nil, ErrMultiplePubkeys
 			}
 			if pubkey, err = NewPubkey(opkt); err != nil {
-				return nil, fmt.Errorf("Failed to parse primary public key")
+				return nil, ErrBadPubkey
+			}
+			if raw != nil {
+				pubkey.Packet = raw
 			}
 			signable = pubkey
 		} else if pubkey != nil {
@@ -129,9 +477,15 @@ func (ok *OpaqueKeyring) Parse() (*Pubkey, error) {
 			case 14: //packet.PacketTypePublicSubkey:
 				signable = nil
 				var subkey *Subkey
-				if subkey, err = NewSubkey(opkt); err != nil {
+				if subkey, err = NewSubkey(opkt); err != nil && pubkey.Version() == 6 {
+					subkey, err = NewV6Subkey(opkt)
+				}
+				if err != nil {
 					badPacket = opkt
 				} else {
+					if raw != nil {
+						subkey.Packet = raw
+					}
 					pubkey.subkeys = append(pubkey.subkeys, subkey)
 					signable = subkey
 				}
@@ -141,6 +495,9 @@ func (ok *OpaqueKeyring) Parse() (*Pubkey, error) {
 				if userId, err = NewUserId(opkt); err != nil {
 					badPacket = opkt
 				} else {
+					if raw != nil {
+						userId.Packet = raw
+					}
 					pubkey.userIds = append(pubkey.userIds, userId)
 					signable = userId
 				}
@@ -150,16 +507,27 @@ func (ok *OpaqueKeyring) Parse() (*Pubkey, error) {
 				if userAttr, err = NewUserAttribute(opkt); err != nil {
 					badPacket = opkt
 				} else {
+					if raw != nil {
+						userAttr.Packet = raw
+					}
 					pubkey.userAttributes = append(pubkey.userAttributes, userAttr)
 					signable = userAttr
 				}
 			case 2: //packet.PacketTypeSignature:
 				var sig *Signature
-				if sig, err = NewSignature(opkt); err != nil {
+				if sig, err = NewSignature(opkt); err != nil && pubkey.Version() == 6 {
+					// Kept in place on V6 keys, so that the key is
+					// written back out in the order RFC 9580 requires.
+					sig, err = NewV6Signature(opkt)
+				}
+				if err != nil {
 					badPacket = opkt
 				} else if signable == nil {
 					badPacket = opkt
 				} else {
+					if raw != nil {
+						sig.Packet = raw
+					}
 					signable.AddSignature(sig)
 				}
 			default:
@@ -172,7 +540,7 @@ func (ok *OpaqueKeyring) Parse() (*Pubkey, error) {
 		}
 	}
 	if pubkey == nil {
-		return nil, fmt.Errorf("No primary public key found")
+		return nil, ErrNoPubkey
 	}
 	// Update the overall public key material digest.
 	pubkey.updateDigests()
@@ -182,23 +550,210 @@ func (ok *OpaqueKeyring) Parse() (*Pubkey, error) {
 	return pubkey, nil
 }
 
+// PreservePackets returns whether packets are stored in the encoding they
+// were received in, rather than re-encoded. Keeping the original bytes serves
+// keys back to recon peers and clients exactly as they were given.
+func (s *Settings) PreservePackets() bool {
+	return s.Get(preservePacketsKey) == nil || s.GetBool(preservePacketsKey)
+}
+
+var ErrPubkeyNotFirst = fmt.Errorf("Primary public key must be the first packet")
+
+// PubkeyFromOpaque builds a public key from its opaque packets, such as
+// those fetched for a key found missing during recon. The primary public
+// key packet must come first, followed by the packets it contains in the
+// order returned by OpaquePackets.
+func PubkeyFromOpaque(packets []*packet.OpaquePacket) (*Pubkey, error) {
+	if len(packets) == 0 {
+		return nil, ErrNoPubkey
+	}
+	if packets[0].Tag != 6 { //packet.PacketTypePublicKey
+		return nil, ErrPubkeyNotFirst
+	}
+	ok := &OpaqueKeyring{Packets: packets}
+	return ok.Parse()
+}
+
+// OpaquePackets returns the packets of the key in the order they are
+// written, followed by any unsupported packets. This is the inverse of
+// PubkeyFromOpaque.
+func (pubkey *Pubkey) OpaquePackets() (result []*packet.OpaquePacket, err error) {
+	err = pubkey.Visit(func(rec PacketRecord) error {
+		op, err := rec.GetOpaquePacket()
+		if err != nil {
+			return err
+		}
+		result = append(result, op)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(result, pubkey.UnsupportedPackets()...), nil
+}
+
+const preservePacketsKey = "hockeypuck.openpgp.preservePackets"
+
+// rawPacket returns the original encoding of the i'th packet, if known and
+// configured to be kept.
+func (ok *OpaqueKeyring) rawPacket(i int) []byte {
+	if i >= len(ok.RawPackets) || !Config().PreservePackets() {
+		return nil
+	}
+	return ok.RawPackets[i]
+}
+
+// rawPacketBytes returns a copy of buf if it holds exactly the encoding of
+// the packet op, otherwise nil.
+func rawPacketBytes(buf []byte, op *packet.OpaquePacket) []byte {
+	r := packet.NewOpaqueReader(bytes.NewReader(buf))
+	rop, err := r.Next()
+	if err != nil || rop.Tag != op.Tag || !bytes.Equal(rop.Contents, op.Contents) {
+		return nil
+	}
+	if _, err = r.Next(); err != io.EOF {
+		return nil
+	}
+	return append([]byte(nil), buf...)
+}
+
 type OpaqueKeyringChan chan *OpaqueKeyring
 
+// StrictParsing returns whether packets of types that are not modeled, such
+// as reserved or experimental tags, are dropped when reading keys. By default
+// they are kept with the key as unsupported packets, and included when the
+// key is written and in its digests, so that keys reconcile exactly with
+// peers.
+func (s *Settings) StrictParsing() bool {
+	return s.GetBool("hockeypuck.openpgp.strictParsing")
+}
+
+// Maximum number of packets that will be read for a single primary public key.
+// Zero or less disables the limit.
+func (s *Settings) MaxKeyPackets() int {
+	return s.GetIntDefault("hockeypuck.openpgp.maxKeyPackets", 16384)
+}
+
+var ErrTooManyPackets = fmt.Errorf("Too many packets in public key")
+
+// LimitedOpaqueReader reads opaque packets, limiting the number of packets
+// that may be read for each primary public key. Packets belonging to a
+// public key that exceeds the limit are discarded up to the next primary
+// public key packet.
+type LimitedOpaqueReader struct {
+	*packet.OpaqueReader
+	MaxPackets int
+
+	npackets int
+	exceeded bool
+}
+
+func NewLimitedOpaqueReader(r io.Reader, maxPackets int) *LimitedOpaqueReader {
+	return &LimitedOpaqueReader{OpaqueReader: packet.NewOpaqueReader(r), MaxPackets: maxPackets}
+}
+
+// Next returns the next opaque packet, or ErrTooManyPackets the first time
+// the current primary public key exceeds the packet limit.
+func (r *LimitedOpaqueReader) Next() (op *packet.OpaquePacket, err error) {
+	for {
+		if op, err = r.OpaqueReader.Next(); err != nil {
+			return
+		}
+		if op.Tag == 6 { //packet.PacketTypePublicKey:
+			r.npackets = 0
+			r.exceeded = false
+		}
+		if r.exceeded {
+			continue
+		}
+		r.npackets++
+		if r.MaxPackets > 0 && r.npackets > r.MaxPackets {
+			r.exceeded = true
+			return nil, ErrTooManyPackets
+		}
+		return
+	}
+}
+
+// ReadOpaqueKeyrings reads opaque packets from the input, grouped into
+// keyrings by primary public key. A keyring that cannot be read is sent with
+// an error, after which reading resumes at the next primary public key
+// packet found in the input, so that one corrupt key does not abort the rest.
 func ReadOpaqueKeyrings(r io.Reader) OpaqueKeyringChan {
 	c := make(OpaqueKeyringChan)
-	or := packet.NewOpaqueReader(r)
 	go func() {
 		defer close(c)
+		var raw bytes.Buffer
+		// src is the input still to be read, which after a resync includes
+		// whatever the resync has buffered.
+		src := r
+		or := NewLimitedOpaqueReader(io.TeeReader(src, &raw), Config().MaxKeyPackets())
 		var op *packet.OpaquePacket
 		var err error
 		var current *OpaqueKeyring
-		for op, err = or.Next(); err == nil; op, err = or.Next() {
+		strict := Config().StrictParsing()
+		for {
+			offset := raw.Len()
+			op, err = or.Next()
+			if err == ErrTooManyPackets {
+				// Reject the flooded key, but keep reading the ones after it.
+				if current != nil {
+					current.Packets = nil
+					current.RawPackets = nil
+					current.Error = err
+					c <- current
+					current = nil
+				}
+				continue
+			} else if err == io.EOF {
+				break
+			} else if err != nil {
+				if current == nil {
+					current = &OpaqueKeyring{}
+				}
+				current.Error = err
+				c <- current
+				current = nil
+				// Packets of the corrupt key may have overrun into the keys
+				// after it, so resume scanning just past its start.
+				var rest []byte
+				if raw.Len() > 0 {
+					rest = append(rest, raw.Bytes()[1:]...)
+				}
+				resync := bufio.NewReader(io.MultiReader(bytes.NewReader(rest), src))
+				if err = skipToPubkeyPacket(resync); err != nil {
+					break
+				}
+				raw.Reset()
+				src = resync
+				or = NewLimitedOpaqueReader(io.TeeReader(src, &raw), Config().MaxKeyPackets())
+				continue
+			}
 			switch op.Tag {
+			case 5: //packet.PacketTypePrivateKey:
+				if current != nil {
+					c <- current
+				}
+				// Secret key material is never kept, only reported.
+				log.Println("Warning: rejected secret key in input")
+				raw.Next(offset)
+				current = &OpaqueKeyring{Error: ErrSecretKeyRejected}
+				current.setPosition(r)
+			case 7: //packet.PacketTypePrivateSubkey:
+				if current != nil && current.Error == nil {
+					log.Println("Warning: rejected secret subkey in input")
+					current.Packets = nil
+					current.RawPackets = nil
+					current.Error = ErrSecretKeyRejected
+				}
 			case 6: //packet.PacketTypePublicKey:
 				if current != nil {
 					c <- current
 					current = nil
 				}
+				// Only keep the raw input of the current key for resyncing.
+				raw.Next(offset)
+				offset = 0
 				current = new(OpaqueKeyring)
 				current.setPosition(r)
 				fallthrough
@@ -209,12 +764,26 @@ func ReadOpaqueKeyrings(r io.Reader) OpaqueKeyringChan {
 			case 14: //packet.PacketTypePublicSubkey:
 				fallthrough
 			case 2: //packet.PacketTypeSignature:
-				current.Packets = append(current.Packets, op)
+				if current != nil && current.Error == nil {
+					current.Packets = append(current.Packets, op)
+					current.RawPackets = append(current.RawPackets,
+						rawPacketBytes(raw.Bytes()[offset:], op))
+				}
+			case 12: //packet.PacketTypeTrust:
+				// Trust packets are local to a keyring and never kept.
+			default:
+				// Packets of other types, including reserved and experimental
+				// tags, are kept opaque with the key unless parsing strictly.
+				if !strict && current != nil && current.Error == nil {
+					current.Packets = append(current.Packets, op)
+					current.RawPackets = append(current.RawPackets,
+						rawPacketBytes(raw.Bytes()[offset:], op))
+				}
 			}
 		}
 		if err == io.EOF && current != nil {
 			c <- current
-		} else if err != nil {
+		} else if err != nil && err != io.EOF {
 			if current == nil {
 				current = &OpaqueKeyring{}
 			}
@@ -225,12 +794,63 @@ func ReadOpaqueKeyrings(r io.Reader) OpaqueKeyringChan {
 	return c
 }
 
+// skipToPubkeyPacket discards input up to the next byte sequence that looks
+// like the header of a V3 or V4 public key packet. Returns io.EOF if none
+// is found.
+func skipToPubkeyPacket(r *bufio.Reader) error {
+	for {
+		hdr, err := r.Peek(7)
+		if len(hdr) < 3 {
+			if err == nil {
+				err = io.EOF
+			}
+			return err
+		}
+		if isPubkeyPacketHeader(hdr) {
+			return nil
+		}
+		if _, err = r.ReadByte(); err != nil {
+			return err
+		}
+	}
+}
+
+func isPubkeyPacketHeader(hdr []byte) bool {
+	// Offset of the version octet following the packet header.
+	var n int
+	switch {
+	case hdr[0] == 0x98: // old format, tag 6, one-octet length
+		n = 2
+	case hdr[0] == 0x99: // old format, tag 6, two-octet length
+		n = 3
+	case hdr[0] == 0xc6: // new format, tag 6
+		switch {
+		case hdr[1] < 192:
+			n = 2
+		case hdr[1] < 224:
+			n = 3
+		case hdr[1] == 255:
+			n = 6
+		default:
+			// Partial body lengths are not allowed for keys.
+			return false
+		}
+	default:
+		return false
+	}
+	return n < len(hdr) && (hdr[n] == 3 || hdr[n] == 4)
+}
+
 // SksDigest calculates a cumulative message digest on all
 // OpenPGP packets for a given primary public key,
 // using the same ordering as SKS, the Synchronizing Key Server.
 // Use MD5 for matching digest values with SKS.
 func SksDigest(key *Pubkey, h hash.Hash) string {
-	var packets packetSlice
+	return sksDigestOpaque(sksPackets(key), h)
+}
+
+// sksPackets collects all the packets that make up the key material digest.
+func sksPackets(key *Pubkey) (packets packetSlice) {
 	key.Visit(func(rec PacketRecord) error {
 		if opkt, err := rec.GetOpaquePacket(); err != nil {
 			panic(fmt.Sprintf(
@@ -241,17 +861,22 @@ func SksDigest(key *Pubkey, h hash.Hash) string {
 		return nil
 	})
 	packets = append(packets, key.UnsupportedPackets()...)
-	return sksDigestOpaque(packets, h)
+	return
 }
 
 func sksDigestOpaque(packets []*packet.OpaquePacket, h hash.Hash) string {
 	sort.Sort(sksPacketSorter{packets})
+	writeSksDigest(packets, h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeSksDigest writes packets, already in SKS order, into a digest.
+func writeSksDigest(packets []*packet.OpaquePacket, w io.Writer) {
 	for _, opkt := range packets {
-		binary.Write(h, binary.BigEndian, int32(opkt.Tag))
-		binary.Write(h, binary.BigEndian, int32(len(opkt.Contents)))
-		h.Write(opkt.Contents)
+		binary.Write(w, binary.BigEndian, int32(opkt.Tag))
+		binary.Write(w, binary.BigEndian, int32(len(opkt.Contents)))
+		w.Write(opkt.Contents)
 	}
-	return hex.EncodeToString(h.Sum(nil))
 }
 
 type ReadKeyResult struct {
@@ -276,9 +901,67 @@ func ErrReadKeys(msg string) *ReadKeyResult {
 	return &ReadKeyResult{Error: fmt.Errorf(msg)}
 }
 
+// updateDigests recalculates the key material digests. Packets are collected
+// and sorted once, then written to both digests in a single pass, since
+// this is done for every key read or merged.
 func (pubkey *Pubkey) updateDigests() {
-	pubkey.Md5 = SksDigest(pubkey, md5.New())
-	pubkey.Sha256 = SksDigest(pubkey, sha256.New())
+	prevSha256 := pubkey.Sha256
+	packets := sksPackets(pubkey)
+	sort.Sort(sksPacketSorter{packets})
+	md5h, sha256h := md5.New(), sha256.New()
+	writeSksDigest(packets, io.MultiWriter(md5h, sha256h))
+	pubkey.Md5 = hex.EncodeToString(md5h.Sum(nil))
+	pubkey.Sha256 = hex.EncodeToString(sha256h.Sum(nil))
+	if prevSha256 != "" && prevSha256 != pubkey.Sha256 {
+		pubkey.touch()
+	}
+}
+
+// RecomputeAll resolves each key and recalculates its digests, returning
+// the number of keys whose digests changed. This brings stored keys up to
+// date after a change in how key material is normalized. Running it again
+// on the same keys changes nothing. Tombstoned keys are left as they are.
+// Stops at the first key with packets that cannot be parsed.
+func RecomputeAll(keys []*Pubkey) (changed int, err error) {
+	for _, key := range keys {
+		err = key.Visit(func(rec PacketRecord) error {
+			_, err := rec.GetOpaquePacket()
+			return err
+		})
+		if err != nil {
+			return changed, fmt.Errorf("Key %s: %v", key.Fingerprint(), err)
+		}
+		if key.IsTombstone() {
+			// Tombstones keep the digests of the key they replaced.
+			continue
+		}
+		prevMd5, prevSha256 := key.Md5, key.Sha256
+		Resolve(key)
+		key.updateDigests()
+		if key.Md5 != prevMd5 || key.Sha256 != prevSha256 {
+			changed++
+		}
+	}
+	return
+}
+
+// DigestReport returns a listing of the packets that make up the key digest,
+// one line per packet in digest order with its tag, length and MD5 checksum,
+// followed by the resulting digests. Comparing the reports for a key from two
+// keyservers shows which packets differ when their digests do not match.
+func (pubkey *Pubkey) DigestReport() string {
+	packets := sksPackets(pubkey)
+	sort.Sort(sksPacketSorter{packets})
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "key %s\n", pubkey.Fingerprint())
+	for _, opkt := range packets {
+		fmt.Fprintf(&buf, "packet %d %d %x\n", opkt.Tag, len(opkt.Contents), md5.Sum(opkt.Contents))
+	}
+	md5h, sha256h := md5.New(), sha256.New()
+	writeSksDigest(packets, io.MultiWriter(md5h, sha256h))
+	fmt.Fprintf(&buf, "md5 %x\n", md5h.Sum(nil))
+	fmt.Fprintf(&buf, "sha256 %x\n", sha256h.Sum(nil))
+	return buf.String()
 }
 
 func ReadKeys(r io.Reader) PubkeyChan {
@@ -19,11 +19,25 @@ package openpgp
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"code.google.com/p/go.crypto/openpgp/armor"
 	"code.google.com/p/go.crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
 )
 
 func TestVerifyUserAttributeSig(t *testing.T) {
@@ -37,6 +51,83 @@ func TestVerifyUserAttributeSig(t *testing.T) {
 	// TODO: check contents
 }
 
+func TestUserAttributeImageDigests(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	uat := key.userAttributes[0]
+	digests := uat.ImageDigests()
+	assert.Equal(t, 1, len(digests))
+	h := sha256.Sum256(uat.UserAttribute.ImageData()[0])
+	assert.Equal(t, hex.EncodeToString(h[:]), digests[0])
+	// Image digests do not depend on the packet or the key it is bound to.
+	other := &UserAttribute{UserAttribute: uat.UserAttribute}
+	assert.Equal(t, digests, other.ImageDigests())
+	assert.NotEqual(t, uat.ScopedDigest, digests[0])
+}
+
+func TestHasImage(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	photo := MustInputAscKey(t, "uat.asc")
+	assert.True(t, photo.HasImage())
+	noPhoto := MustInputAscKey(t, "alice_signed.asc")
+	assert.Empty(t, noPhoto.userAttributes)
+	assert.False(t, noPhoto.HasImage())
+
+	// Keys are only flagged when configured to index images.
+	hockeypuck.SetConfig("")
+	ApplyImageIndex(photo)
+	assert.Equal(t, 0, photo.State&PacketStateHasImage)
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+indexImages=true
+`)
+	assert.Nil(t, Config().Validate())
+	ApplyImageIndex(photo)
+	assert.Equal(t, PacketStateHasImage, photo.State&PacketStateHasImage)
+	ApplyImageIndex(noPhoto)
+	assert.Equal(t, 0, noPhoto.State&PacketStateHasImage)
+
+	// The flag is cleared once the photo is gone.
+	photo.userAttributes = nil
+	ApplyImageIndex(photo)
+	assert.Equal(t, 0, photo.State&PacketStateHasImage)
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+indexImages="yes"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestUserAttributeSubpackets(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	image := key.userAttributes[0].UserAttribute.Contents[0]
+	other := &packet.OpaqueSubpacket{SubType: 100, Contents: []byte("identity")}
+	var buf bytes.Buffer
+	err := packet.NewUserAttribute(image, other).Serialize(&buf)
+	assert.Nil(t, err)
+	op, err := packet.NewOpaqueReader(bytes.NewBuffer(buf.Bytes())).Next()
+	assert.Nil(t, err)
+	uat, err := NewUserAttribute(op)
+	assert.Nil(t, err)
+
+	subpackets, err := uat.Subpackets()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(subpackets))
+	assert.Equal(t, uint8(packet.UserAttrImageSubpacket), subpackets[0].Type)
+	assert.Equal(t, uint8(100), subpackets[1].Type)
+	assert.Equal(t, []byte("identity"), subpackets[1].Contents)
+	assert.Equal(t, key.userAttributes[0].Images(), uat.Images())
+
+	// Unknown subpackets are kept when the packet is written back out.
+	var out bytes.Buffer
+	assert.Nil(t, uat.Serialize(&out))
+	assert.Equal(t, buf.Bytes(), out.Bytes())
+
+	_, err = (&UserAttribute{}).Subpackets()
+	assert.Equal(t, ErrPacketRecordState, err)
+}
+
 const SKS_DIGEST__SHORTID = "ce353cf4"
 const SKS_DIGEST__REFERENCE = "da84f40d830a7be2a3c0b7f2e146bfaa"
 
@@ -98,3 +189,660 @@ func TestReadKey0ff16c87(t *testing.T) {
 		return nil
 	})
 }
+
+func TestWriteArmoredNoHeaders(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	var buf bytes.Buffer
+	err := WriteArmoredPackets(&buf, key)
+	assert.Nil(t, err)
+	assert.NotContains(t, buf.String(), "Version:")
+	block, err := armor.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(block.Header))
+}
+
+// Armored output must match the RFC 4880 form exactly: LF line endings,
+// 64 character base64 lines and the CRC24 checksum line before the tail.
+func TestWriteArmoredFixture(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	var buf bytes.Buffer
+	err := WriteArmoredPacketsOpts(&buf, key, &ArmorOptions{
+		Headers: map[string]string{"Comment": "Hockeypuck"}})
+	assert.Nil(t, err)
+	f := MustInput(t, "sksdigest.armored")
+	defer f.Close()
+	expect, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(expect), buf.String())
+	assert.NotContains(t, buf.String(), "\r")
+}
+
+func TestWriteArmoredHeaderOrder(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	opts := &ArmorOptions{Headers: map[string]string{
+		"Version": "Hockeypuck 1.0", "Comment": "Hockeypuck"}}
+	var first bytes.Buffer
+	assert.Nil(t, WriteArmoredPacketsOpts(&first, key, opts))
+	assert.True(t, strings.HasPrefix(first.String(), armorPubkeyBegin+
+		"\nComment: Hockeypuck\nVersion: Hockeypuck 1.0\n\n"))
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		assert.Nil(t, WriteArmoredPacketsOpts(&buf, key, opts))
+		assert.Equal(t, first.String(), buf.String())
+	}
+}
+
+func TestWriteArmoredCustomHeaders(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	var buf bytes.Buffer
+	err := WriteArmoredPacketsOpts(&buf, key, &ArmorOptions{
+		Headers: map[string]string{"Comment": "Hockeypuck"}})
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "Comment: Hockeypuck")
+	block, err := armor.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Hockeypuck", block.Header["Comment"])
+	var n int
+	for keyRead := range ReadKeys(block.Body) {
+		assert.Nil(t, keyRead.Error)
+		assert.Equal(t, key.Md5, keyRead.Pubkey.Md5)
+		n++
+	}
+	assert.Equal(t, 1, n)
+}
+
+// V6 keys round-trip with their packets in RFC 9580 order, and are armored
+// without a "Version" header or checksum.
+func TestWriteArmoredV6(t *testing.T) {
+	key := MustInputAscKey(t, "v6.asc")
+	assert.Equal(t, 6, key.Version())
+	assert.Equal(t, "3e85cc64b1f860c9f15268c29502aca656fa28f04400dad7d4d0735d1edc956c", key.Fingerprint())
+	assert.Equal(t, "Ed25519", key.AlgorithmDescription())
+	assert.Equal(t, 0, len(key.UnsupportedPackets()))
+	var tags []uint8
+	var packets bytes.Buffer
+	err := key.Visit(func(rec PacketRecord) error {
+		op, err := rec.GetOpaquePacket()
+		if err != nil {
+			return err
+		}
+		tags = append(tags, op.Tag)
+		return rec.Serialize(&packets)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{6, 2, 13, 2, 14, 2}, tags)
+
+	opts := &ArmorOptions{Headers: map[string]string{
+		"Version": "Hockeypuck 1.0", "Comment": "Hockeypuck"}}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteArmoredPacketsOpts(&buf, key, opts))
+	assert.NotContains(t, buf.String(), "Version:")
+	assert.Contains(t, buf.String(), "Comment: Hockeypuck\n")
+	assert.NotContains(t, buf.String(), "\n=")
+
+	block, err := armor.Decode(bytes.NewBuffer(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(block.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, packets.Bytes(), data)
+
+	var keys []*Pubkey
+	for readKey := range ReadKeys(bytes.NewBuffer(data)) {
+		assert.Nil(t, readKey.Error)
+		keys = append(keys, readKey.Pubkey)
+	}
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, key.Fingerprint(), keys[0].Fingerprint())
+	assert.Equal(t, key.Md5, keys[0].Md5)
+
+	// V4 keys keep the "Version" header and checksum.
+	buf.Reset()
+	assert.Nil(t, WriteArmoredPacketsOpts(&buf, MustInputAscKey(t, "sksdigest.asc"), opts))
+	assert.Contains(t, buf.String(), "Version: Hockeypuck 1.0\n")
+	assert.Contains(t, buf.String(), "\n=")
+}
+
+func TestKeyringWriter(t *testing.T) {
+	var keys []*Pubkey
+	var packets bytes.Buffer
+	for _, name := range []string{"sksdigest.asc", "uat.asc", "crosscert.asc"} {
+		key := MustInputAscKey(t, name)
+		keys = append(keys, key)
+		assert.Nil(t, WritePackets(&packets, key))
+	}
+	opts := &ArmorOptions{Headers: map[string]string{"Comment": "Hockeypuck"}}
+	var buf bytes.Buffer
+	kw := NewKeyringWriter(&buf, opts)
+	for _, key := range keys {
+		assert.Nil(t, kw.Add(key))
+	}
+	assert.Nil(t, kw.Close())
+	assert.Equal(t, ErrKeyringClosed, kw.Add(keys[0]))
+	assert.Equal(t, 1, strings.Count(buf.String(), armorPubkeyBegin))
+
+	// Same as armoring all of the keys at once.
+	var expect bytes.Buffer
+	assert.Nil(t, writeArmoredBlock(&expect, packets.Bytes(), opts))
+	assert.Equal(t, expect.String(), buf.String())
+
+	block, err := armor.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readKeys []*Pubkey
+	for keyRead := range ReadKeys(block.Body) {
+		assert.Nil(t, keyRead.Error)
+		readKeys = append(readKeys, keyRead.Pubkey)
+	}
+	if assert.Equal(t, len(keys), len(readKeys)) {
+		for i := range keys {
+			assert.Equal(t, keys[i].Md5, readKeys[i].Md5)
+		}
+	}
+
+	// An empty keyring is still a complete armored block.
+	buf.Reset()
+	assert.Nil(t, NewKeyringWriter(&buf, nil).Close())
+	assert.Equal(t, armorPubkeyBegin+"\n\n="+
+		base64.StdEncoding.EncodeToString([]byte{0xb7, 0x04, 0xce})+"\n"+armorPubkeyEnd+"\n", buf.String())
+}
+
+func TestPubkeyFromOpaque(t *testing.T) {
+	for _, name := range []string{"sksdigest.asc", "uat.asc", "v6.asc"} {
+		key := MustInputAscKey(t, name)
+		packets, err := key.OpaquePackets()
+		assert.Nil(t, err)
+		rebuilt, err := PubkeyFromOpaque(packets)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		assert.Equal(t, key.Fingerprint(), rebuilt.Fingerprint(), name)
+		assert.Equal(t, key.Md5, rebuilt.Md5, name)
+		assert.Equal(t, key.Sha256, rebuilt.Sha256, name)
+		assert.Equal(t, len(key.Subkeys()), len(rebuilt.Subkeys()), name)
+		assert.Equal(t, len(key.UserIds()), len(rebuilt.UserIds()), name)
+		assert.Equal(t, len(key.UserAttributes()), len(rebuilt.UserAttributes()), name)
+	}
+
+	key := MustInputAscKey(t, "sksdigest.asc")
+	packets, err := key.OpaquePackets()
+	assert.Nil(t, err)
+	_, err = PubkeyFromOpaque(append(packets[1:], packets[0]))
+	assert.Equal(t, ErrPubkeyNotFirst, err)
+	_, err = PubkeyFromOpaque(nil)
+	assert.Equal(t, ErrNoPubkey, err)
+}
+
+func TestLimitedOpaqueReader(t *testing.T) {
+	readTwice := func(maxPackets int) (npackets int, nerrors int) {
+		var bodies []io.Reader
+		for i := 0; i < 2; i++ {
+			f := MustInput(t, "sksdigest.asc")
+			defer f.Close()
+			block, err := armor.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies = append(bodies, block.Body)
+		}
+		r := NewLimitedOpaqueReader(io.MultiReader(bodies...), maxPackets)
+		for {
+			_, err := r.Next()
+			if err == ErrTooManyPackets {
+				nerrors++
+			} else if err != nil {
+				break
+			} else {
+				npackets++
+			}
+		}
+		return
+	}
+	// sksdigest.asc contains 5 packets, the limit is applied per key.
+	npackets, nerrors := readTwice(5)
+	assert.Equal(t, 10, npackets)
+	assert.Equal(t, 0, nerrors)
+	npackets, nerrors = readTwice(4)
+	assert.Equal(t, 8, npackets)
+	assert.Equal(t, 2, nerrors)
+	npackets, nerrors = readTwice(0)
+	assert.Equal(t, 10, npackets)
+	assert.Equal(t, 0, nerrors)
+}
+
+func TestReadArmoredKeyBlocks(t *testing.T) {
+	var keytext []string
+	for _, name := range []string{"alice_unsigned.asc", "sksdigest.asc"} {
+		f := MustInput(t, name)
+		defer f.Close()
+		buf, err := ioutil.ReadAll(f)
+		assert.Nil(t, err)
+		keytext = append(keytext, string(buf))
+	}
+	// Keys pasted among other text, with stray whitespace and an unrelated block.
+	input := "Here are my keys:\n\n  " + strings.Replace(keytext[0], "\n", "  \r\n", -1) +
+		"\n-----BEGIN PGP SIGNATURE-----\n\nnot a key\n-----END PGP SIGNATURE-----\n" +
+		keytext[1] + "\nThanks!\n"
+	blocks, blockErrors, err := ReadArmoredKeyBlocks(bytes.NewBufferString(input))
+	assert.Nil(t, err)
+	assert.Empty(t, blockErrors)
+	assert.Equal(t, 2, len(blocks))
+	for i, block := range blocks {
+		var keys []*Pubkey
+		for keyRead := range ReadKeys(bytes.NewBuffer(block)) {
+			assert.Nil(t, keyRead.Error)
+			keys = append(keys, keyRead.Pubkey)
+		}
+		assert.Equal(t, 1, len(keys), "block %d", i)
+		if i == 1 && len(keys) == 1 {
+			assert.Equal(t, SKS_DIGEST__SHORTID, keys[0].ShortId())
+		}
+	}
+
+	_, _, err = ReadArmoredKeyBlocks(bytes.NewBufferString("no keys here\n"))
+	assert.Equal(t, ErrNoArmoredKeys, err)
+
+	// A malformed block is skipped, and the blocks around it are still read.
+	bad := armorPubkeyBegin + "\n\n!!! not base64 !!!\n" + armorPubkeyEnd + "\n"
+	blocks, blockErrors, err = ReadArmoredKeyBlocks(bytes.NewBufferString(keytext[0] + bad + keytext[1]))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(blocks))
+	assert.Equal(t, 1, len(blockErrors))
+
+	blocks, blockErrors, err = ReadArmoredKeyBlocks(bytes.NewBufferString(bad))
+	assert.Nil(t, err)
+	assert.Empty(t, blocks)
+	assert.Equal(t, 1, len(blockErrors))
+}
+
+func TestUpdateDigests(t *testing.T) {
+	key := MustInputAscKey(t, "weasel.asc")
+	key.Md5, key.Sha256 = "", ""
+	key.updateDigests()
+	assert.Equal(t, SksDigest(key, md5.New()), key.Md5)
+	assert.Equal(t, SksDigest(key, sha256.New()), key.Sha256)
+}
+
+// Digests are recalculated on every key read and merge, so keys with many
+// certifications should not pay for collecting and sorting packets twice.
+func BenchmarkUpdateDigests(b *testing.B) {
+	key := benchmarkKey(b, "weasel.asc")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key.updateDigests()
+	}
+}
+
+func BenchmarkSksDigestMd5Sha256(b *testing.B) {
+	key := benchmarkKey(b, "weasel.asc")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key.Md5 = SksDigest(key, md5.New())
+		key.Sha256 = SksDigest(key, sha256.New())
+	}
+}
+
+func benchmarkKey(b *testing.B, name string) (key *Pubkey) {
+	f := MustInput(b, name)
+	defer f.Close()
+	block, err := armor.Decode(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for keyRead := range ReadKeys(block.Body) {
+		if keyRead.Error != nil {
+			b.Fatal(keyRead.Error)
+		}
+		key = keyRead.Pubkey
+	}
+	return
+}
+
+func mustKeyPackets(t *testing.T, name string) (result []*packet.OpaquePacket) {
+	key := MustInputAscKey(t, name)
+	err := key.Visit(func(rec PacketRecord) error {
+		op, err := rec.GetOpaquePacket()
+		if err == nil {
+			result = append(result, op)
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	return
+}
+
+func readKeysWithBadKey(t *testing.T, corrupt func(*bytes.Buffer)) {
+	readKeysWithBadKeys(t, corrupt, []string{"alice_unsigned.asc", "uat.asc", "alice_signed.asc"},
+		"sksdigest.asc")
+}
+
+// readKeysWithBadKeys reads the good keys with a corrupted copy of each bad
+// key following the first good one, and checks that every good key is read.
+func readKeysWithBadKeys(t *testing.T, corrupt func(*bytes.Buffer), good []string, bad ...string) {
+	var names []string
+	for i, name := range good {
+		names = append(names, name)
+		if i < len(bad) {
+			names = append(names, bad[i])
+		}
+	}
+	var buf bytes.Buffer
+	for i, name := range names {
+		var keyBuf bytes.Buffer
+		for _, op := range mustKeyPackets(t, name) {
+			assert.Nil(t, op.Serialize(&keyBuf))
+		}
+		if i%2 == 1 && i/2 < len(bad) {
+			corrupt(&keyBuf)
+		}
+		buf.Write(keyBuf.Bytes())
+	}
+	var keys []*Pubkey
+	var errs []error
+	for keyRead := range ReadKeys(&buf) {
+		if keyRead.Error != nil {
+			errs = append(errs, keyRead.Error)
+		} else {
+			keys = append(keys, keyRead.Pubkey)
+		}
+	}
+	if assert.Equal(t, len(good), len(keys)) {
+		for i, name := range good {
+			assert.Equal(t, MustInputAscKey(t, name).Fingerprint(), keys[i].Fingerprint())
+		}
+	}
+	assert.Equal(t, len(bad), len(errs))
+}
+
+func TestReadKeysSkipsBadKey(t *testing.T) {
+	// Truncate the key within its primary public key packet, so that
+	// the packet overruns into the next key.
+	readKeysWithBadKey(t, func(buf *bytes.Buffer) { buf.Truncate(100) })
+	// Truncate the key and follow it with data that is not a packet.
+	readKeysWithBadKey(t, func(buf *bytes.Buffer) {
+		buf.Truncate(300)
+		buf.WriteString("trailing garbage")
+	})
+}
+
+func TestReadKeysSkipsBadKeys(t *testing.T) {
+	// Each resync must continue from the input already read by the last.
+	good := []string{"alice_unsigned.asc", "uat.asc", "alice_signed.asc", "revoked_subkey.asc"}
+	readKeysWithBadKeys(t, func(buf *bytes.Buffer) { buf.Truncate(100) },
+		good, "sksdigest.asc", "crosscert.asc")
+	readKeysWithBadKeys(t, func(buf *bytes.Buffer) {
+		buf.Truncate(300)
+		buf.WriteString("trailing garbage")
+	}, good, "sksdigest.asc", "lp1195901.asc")
+}
+
+func TestIsPubkeyPacketHeader(t *testing.T) {
+	assert.True(t, isPubkeyPacketHeader([]byte{0x99, 0x01, 0x0d, 0x04, 0, 0, 0}))
+	assert.True(t, isPubkeyPacketHeader([]byte{0x98, 0x8d, 0x03, 0, 0, 0, 0}))
+	assert.True(t, isPubkeyPacketHeader([]byte{0xc6, 0xc1, 0x0d, 0x04, 0, 0, 0}))
+	assert.False(t, isPubkeyPacketHeader([]byte{0x99, 0x01, 0x0d, 0x05, 0, 0, 0}))
+	assert.False(t, isPubkeyPacketHeader([]byte{0xb4, 0x01, 0x0d, 0x04, 0, 0, 0}))
+}
+
+func TestReadKeysRejectsSecretKey(t *testing.T) {
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	for _, op := range mustKeyPackets(t, "alice_unsigned.asc") {
+		assert.Nil(t, op.Serialize(&buf))
+	}
+	assert.Nil(t, packet.NewRSAPrivateKey(time.Now(), rsaPriv).Serialize(&buf))
+	for _, op := range mustKeyPackets(t, "uat.asc") {
+		assert.Nil(t, op.Serialize(&buf))
+	}
+	var keys []*Pubkey
+	var errs []error
+	for keyRead := range ReadKeys(&buf) {
+		if keyRead.Error != nil {
+			errs = append(errs, keyRead.Error)
+		} else {
+			keys = append(keys, keyRead.Pubkey)
+		}
+	}
+	if assert.Equal(t, 2, len(keys)) {
+		assert.Equal(t, MustInputAscKey(t, "alice_unsigned.asc").Fingerprint(), keys[0].Fingerprint())
+		assert.Equal(t, MustInputAscKey(t, "uat.asc").Fingerprint(), keys[1].Fingerprint())
+	}
+	if assert.Equal(t, 1, len(errs)) {
+		assert.Equal(t, ErrSecretKeyRejected, errs[0])
+	}
+}
+
+func TestSetPacketRejectsSecretKey(t *testing.T) {
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	pubkey := &Pubkey{}
+	assert.Equal(t, ErrSecretKeyRejected, pubkey.setPacket(packet.NewRSAPrivateKey(time.Now(), rsaPriv)))
+}
+
+func TestDigestReport(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	expect, err := ioutil.ReadAll(MustInput(t, "sksdigest.report"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(expect), key.DigestReport())
+	assert.Contains(t, key.DigestReport(), "md5 "+key.Md5+"\n")
+}
+
+func TestRecomputeAll(t *testing.T) {
+	var keys []*Pubkey
+	for _, name := range []string{"sksdigest.asc", "uat.asc", "252B8B37.dupsig.asc"} {
+		keys = append(keys, MustInputAscKey(t, name))
+	}
+	changed, err := RecomputeAll(keys)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, changed)
+
+	keys[0].Md5, keys[0].Sha256 = "", ""
+	keys[1].Md5 = "stale"
+	changed, err = RecomputeAll(keys)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, changed)
+	assert.Equal(t, "da84f40d830a7be2a3c0b7f2e146bfaa", keys[0].Md5)
+
+	// Recomputing again is idempotent.
+	changed, err = RecomputeAll(keys)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, changed)
+
+	keys[2].userIds[0].Packet = []byte{0xff}
+	_, err = RecomputeAll(keys)
+	assert.NotNil(t, err)
+}
+
+func TestParseErrors(t *testing.T) {
+	packets := mustKeyPackets(t, "sksdigest.asc")
+	ok := &OpaqueKeyring{Packets: append(append([]*packet.OpaquePacket(nil), packets...), packets[0])}
+	_, err := ok.Parse()
+	assert.Equal(t, ErrMultiplePubkeys, err)
+
+	ok = &OpaqueKeyring{Packets: packets[1:]}
+	_, err = ok.Parse()
+	assert.Equal(t, ErrNoPubkey, err)
+
+	ok = &OpaqueKeyring{Packets: []*packet.OpaquePacket{{Tag: 6, Contents: []byte{4, 0}}}}
+	_, err = ok.Parse()
+	assert.Equal(t, ErrBadPubkey, err)
+
+	ok = &OpaqueKeyring{Error: ErrSecretKeyRejected}
+	_, err = ok.Parse()
+	assert.Equal(t, ErrSecretKeyRejected, err)
+
+	assert.Equal(t, ErrAddFailed, (&AddResponse{Errors: []*ReadKeyResult{{Error: err}}}).Error())
+}
+
+func TestCrc24(t *testing.T) {
+	// CRC-24 as specified in RFC 4880, section 6.1: the initial value is
+	// returned for empty input, and "123456789" is the standard check input.
+	assert.Equal(t, uint32(0xb704ce), Crc24(nil))
+	assert.Equal(t, uint32(0x21cf02), Crc24([]byte("123456789")))
+
+	// Checksum line of the armored fixture.
+	f := MustInput(t, "sksdigest.armored")
+	defer f.Close()
+	block, err := armor.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint32(0xa1993f), Crc24(data))
+}
+
+func TestPreservePackets(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	// directkey.asc was exported by GnuPG with old-format packet headers.
+	f := MustInput(t, "directkey.asc")
+	defer f.Close()
+	block, err := armor.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readKey := func() *Pubkey {
+		var key *Pubkey
+		for keyRead := range ReadKeys(bytes.NewBuffer(original)) {
+			assert.Nil(t, keyRead.Error)
+			key = keyRead.Pubkey
+		}
+		return key
+	}
+
+	hockeypuck.SetConfig("")
+	assert.True(t, Config().PreservePackets())
+	preserved := readKey()
+	var buf bytes.Buffer
+	assert.Nil(t, WritePackets(&buf, preserved))
+	assert.Equal(t, original, buf.Bytes())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+preservePackets=false
+`)
+	assert.Nil(t, Config().Validate())
+	reencoded := readKey()
+	buf.Reset()
+	assert.Nil(t, WritePackets(&buf, reencoded))
+	assert.NotEqual(t, original, buf.Bytes())
+
+	// Digests do not depend on the packet encoding.
+	assert.Equal(t, preserved.Md5, reencoded.Md5)
+	assert.Equal(t, preserved.Sha256, reencoded.Sha256)
+	assert.Equal(t, preserved.userIds[0].ScopedDigest, reencoded.userIds[0].ScopedDigest)
+	assert.Equal(t, preserved.signatures[0].ScopedDigest, reencoded.signatures[0].ScopedDigest)
+}
+
+func TestUnknownPacketTag(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	f := MustInput(t, "sksdigest.asc")
+	defer f.Close()
+	block, err := armor.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An experimental packet (tag 60) after the key material.
+	experimental := []byte{0xc0 | 60, 4, 'a', 'b', 'c', 'd'}
+	input := append(append([]byte(nil), original...), experimental...)
+	readKey := func(buf []byte) *Pubkey {
+		var key *Pubkey
+		for keyRead := range ReadKeys(bytes.NewBuffer(buf)) {
+			assert.Nil(t, keyRead.Error)
+			key = keyRead.Pubkey
+		}
+		return key
+	}
+	plain := readKey(original)
+
+	hockeypuck.SetConfig("")
+	assert.False(t, Config().StrictParsing())
+	key := readKey(input)
+	if assert.Equal(t, 1, len(key.UnsupportedPackets())) {
+		assert.Equal(t, uint8(60), key.UnsupportedPackets()[0].Tag)
+	}
+	assert.NotEqual(t, plain.Md5, key.Md5)
+	// The packet survives a round trip.
+	var buf bytes.Buffer
+	assert.Nil(t, WritePackets(&buf, key))
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), experimental))
+	roundTrip := readKey(buf.Bytes())
+	assert.Equal(t, key.Md5, roundTrip.Md5)
+	assert.Equal(t, key.Sha256, roundTrip.Sha256)
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+strictParsing=true
+`)
+	assert.Nil(t, Config().Validate())
+	key = readKey(input)
+	assert.Empty(t, key.UnsupportedPackets())
+	assert.Equal(t, plain.Md5, key.Md5)
+}
+
+func TestPartitionByAlgorithm(t *testing.T) {
+	rsaKey := MustInputAscKey(t, "sksdigest.asc")
+	dsaKey := MustInputAscKey(t, "dsa1024.asc")
+	ecdsaKey := MustInputAscKey(t, "nistp256.asc")
+	eddsaKey := MustInputAscKey(t, "ed25519.asc")
+	tailsKey := MustInputAscKey(t, "tails.asc")
+	unknownKey := &Pubkey{Packet: []byte{0xc6, 1, 9}}
+	partitions := PartitionByAlgorithm([]*Pubkey{rsaKey, dsaKey, ecdsaKey, eddsaKey, unknownKey, tailsKey})
+	assert.Equal(t, map[int][]*Pubkey{
+		1:                {rsaKey, tailsKey},
+		17:               {dsaKey},
+		19:               {ecdsaKey},
+		22:               {eddsaKey},
+		AlgorithmUnknown: {unknownKey},
+	}, partitions)
+
+	dir, err := ioutil.TempDir("", "partitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	delete(partitions, AlgorithmUnknown)
+	assert.Nil(t, WritePartitions(dir, partitions, true))
+	assert.Nil(t, WritePartitions(dir, partitions, false))
+	f, err := os.Open(filepath.Join(dir, "algorithm-1.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	block, err := armor.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fps []string
+	for keyRead := range ReadKeys(block.Body) {
+		assert.Nil(t, keyRead.Error)
+		fps = append(fps, keyRead.Pubkey.Fingerprint())
+	}
+	assert.Equal(t, []string{rsaKey.Fingerprint(), tailsKey.Fingerprint()}, fps)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "algorithm-17.pgp"))
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	assert.Nil(t, WritePackets(&buf, dsaKey))
+	assert.Equal(t, buf.Bytes(), data)
+	_, err = os.Stat(filepath.Join(dir, "algorithm-22.asc"))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,102 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"encoding/hex"
+	"strings"
+
+	. "github.com/hockeypuck/hockeypuck/errors"
+	"github.com/hockeypuck/hockeypuck/util"
+)
+
+// KeyId identifies a public key by its short key ID, long key ID or
+// fingerprint, in lower-case hex and in the usual order. Keys are stored
+// and looked up by their reversed fingerprints, which Reversed provides, so
+// that the two forms cannot be confused.
+type KeyId string
+
+// ParseKeyId returns the key ID or fingerprint given in hex, with or without
+// a "0x" prefix and spaces, in any case. It must be an 8-digit short key ID,
+// a 16-digit long key ID, or a V3, V4 or V5 fingerprint. Returns
+// ErrInvalidKeyId otherwise.
+func ParseKeyId(s string) (KeyId, error) {
+	s = strings.ToLower(strings.Replace(s, " ", "", -1))
+	s = strings.TrimPrefix(s, "0x")
+	if _, err := hex.DecodeString(s); err != nil {
+		return "", ErrInvalidKeyId
+	}
+	switch len(s) {
+	case 8, 16, 32, 40, v5FingerprintLen:
+		return KeyId(s), nil
+	}
+	return "", ErrInvalidKeyId
+}
+
+// KeyIdFromReversed returns the key ID or fingerprint stored in reversed
+// form, such as Pubkey.RFingerprint or Signature.RIssuerKeyId.
+func KeyIdFromReversed(r string) KeyId {
+	return KeyId(util.Reverse(strings.ToLower(r)))
+}
+
+func (id KeyId) String() string { return string(id) }
+
+// Reversed returns the reversed form in which keys are stored.
+func (id KeyId) Reversed() string {
+	return util.Reverse(string(id))
+}
+
+// IsFingerprint returns whether the key is identified by its fingerprint,
+// rather than by a key ID.
+func (id KeyId) IsFingerprint() bool {
+	return len(id) > 16
+}
+
+// Fingerprint returns the fingerprint, or the empty string if the key is
+// only identified by a key ID.
+func (id KeyId) Fingerprint() string {
+	if !id.IsFingerprint() {
+		return ""
+	}
+	return string(id)
+}
+
+// Long returns the 16-digit long key ID. This is taken from the end of a V4
+// fingerprint, or from the start of a V5 fingerprint. Returns the empty
+// string if the key is only identified by a short key ID.
+func (id KeyId) Long() string {
+	switch {
+	case len(id) == 16:
+		return string(id)
+	case id.IsFingerprint():
+		return keyIdOf(id.Reversed(), 16)
+	}
+	return ""
+}
+
+// Short returns the 8-digit short key ID. This is taken from the end of a
+// long key ID or V4 fingerprint, or from the start of a V5 fingerprint.
+func (id KeyId) Short() string {
+	switch {
+	case len(id) <= 8:
+		return string(id)
+	case len(id) == 16:
+		return string(id[8:])
+	}
+	return keyIdOf(id.Reversed(), 8)
+}
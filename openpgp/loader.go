@@ -65,6 +65,9 @@ func (l *Loader) InsertKey(pubkey *Pubkey) error {
 }
 
 func (l *Loader) InsertKeyTx(tx *sqlx.Tx, pubkey *Pubkey) error {
+	// The stored expiration is used to leave expired keys out of searches,
+	// so it takes the key lifetime from the self-signatures.
+	pubkey.ResolveExpiration()
 	var signable PacketRecord
 	err := pubkey.Visit(func(rec PacketRecord) error {
 		switch r := rec.(type) {
@@ -120,7 +123,7 @@ SELECT $1, $2, $3, $4, $5,
     $6, $7, $8, $9, $10,
 	$11, $12, $13`,
 		"openpgp_pubkey", "uuid = $1"),
-		r.RFingerprint, r.Creation, r.Expiration, r.State, r.Packet,
+		r.RFingerprint, r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 		// TODO: use mtime and ctime from record, or use RETURNING to set it
 		r.Md5, r.Sha256, r.RevSigDigest, r.PrimaryUid, r.PrimaryUat,
 		r.Algorithm, r.BitLen, r.Unsupported)
@@ -135,21 +138,22 @@ INSERT INTO openpgp_subkey (
 SELECT $1, $2, $3, $4, $5,
 	$6, $7, $8, $9`,
 		"openpgp_subkey", "uuid = $1"),
-		r.RFingerprint, r.Creation, r.Expiration, r.State, r.Packet,
+		r.RFingerprint, r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 		pubkey.RFingerprint, r.RevSigDigest, r.Algorithm, r.BitLen)
 	return err
 }
 
 func (l *Loader) insertUid(tx *sqlx.Tx, pubkey *Pubkey, r *UserId) error {
+	vector, terms := r.indexVector(Config().IndexMode(), "$9")
 	_, err := Execv(tx, l.insertSelectFrom(`
 INSERT INTO openpgp_uid (
 	uuid, creation, expiration, state, packet,
 	pubkey_uuid, revsig_uuid, keywords, keywords_fulltext)
 SELECT $1, $2, $3, $4, $5,
-	$6, $7, $8, to_tsvector($8)`,
+	$6, $7, $8, `+vector,
 		"openpgp_uid", "uuid = $1"),
-		r.ScopedDigest, r.Creation, r.Expiration, r.State, r.Packet,
-		pubkey.RFingerprint, r.RevSigDigest, util.CleanUtf8(r.Keywords))
+		r.ScopedDigest, r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
+		pubkey.RFingerprint, r.RevSigDigest, util.CleanUtf8(r.Keywords), util.CleanUtf8(terms))
 	return err
 }
 
@@ -161,7 +165,7 @@ INSERT INTO openpgp_uat (
 SELECT $1, $2, $3, $4, $5,
 	$6, $7`,
 		"openpgp_uat", "uuid = $1"),
-		r.ScopedDigest, r.Creation, r.Expiration, r.State, r.Packet,
+		r.ScopedDigest, r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
 		pubkey.RFingerprint, r.RevSigDigest)
 	return err
 }
@@ -170,45 +174,45 @@ func (l *Loader) insertSig(tx *sqlx.Tx, pubkey *Pubkey, signable PacketRecord, r
 	baseSql := `
 INSERT INTO openpgp_sig (
 	uuid, creation, expiration, state, packet,
-	sig_type, signer, signer_uuid%s)
-SELECT $1, $2, $3, $4, $5, $6, $7, $8%s`
+	sig_type, signer, signer_uuid, hash_algo%s)
+SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9%s`
 	matchSql := "uuid = $1"
 	args := []interface{}{
-		r.ScopedDigest, r.Creation, r.Expiration, r.State, r.Packet,
-		r.SigType, r.RIssuerKeyId, r.RIssuerFingerprint,
+		r.ScopedDigest, r.Creation, r.Expiration, r.State, storedPacket(r.Packet),
+		r.SigType, r.RIssuerKeyId, r.RIssuerFingerprint, r.HashAlgo,
 	}
 	var sql string
 	switch signed := signable.(type) {
 	case *Pubkey:
 		sql = fmt.Sprintf(baseSql,
 			", pubkey_uuid",
-			", $9")
+			", $10")
 		args = append(args, signed.RFingerprint)
-		matchSql += " AND pubkey_uuid = $9"
+		matchSql += " AND pubkey_uuid = $10"
 	case *Subkey:
 		sql = fmt.Sprintf(baseSql,
 			", pubkey_uuid, subkey_uuid",
-			", $9, $10")
+			", $10, $11")
 		args = append(args, pubkey.RFingerprint, signed.RFingerprint)
-		matchSql += " AND pubkey_uuid = $9 AND subkey_uuid = $10"
+		matchSql += " AND pubkey_uuid = $10 AND subkey_uuid = $11"
 	case *UserId:
 		sql = fmt.Sprintf(baseSql,
 			", pubkey_uuid, uid_uuid",
-			", $9, $10")
+			", $10, $11")
 		args = append(args, pubkey.RFingerprint, signed.ScopedDigest)
-		matchSql += " AND pubkey_uuid = $9 AND uid_uuid = $10"
+		matchSql += " AND pubkey_uuid = $10 AND uid_uuid = $11"
 	case *UserAttribute:
 		sql = fmt.Sprintf(baseSql,
 			", pubkey_uuid, uat_uuid",
-			", $9, $10")
+			", $10, $11")
 		args = append(args, pubkey.RFingerprint, signed.ScopedDigest)
-		matchSql += " AND pubkey_uuid = $9 AND uat_uuid = $10"
+		matchSql += " AND pubkey_uuid = $10 AND uat_uuid = $11"
 	case *Signature:
 		sql = fmt.Sprintf(baseSql,
 			", pubkey_uuid, sig_uuid",
-			", $9, $10")
+			", $10, $11")
 		args = append(args, pubkey.RFingerprint, signed.ScopedDigest)
-		matchSql += " AND pubkey_uuid = $9 AND sig_uuid = $10"
+		matchSql += " AND pubkey_uuid = $10 AND sig_uuid = $11"
 	default:
 		return fmt.Errorf("Unsupported packet record type: %v", signed)
 	}
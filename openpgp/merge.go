@@ -19,6 +19,7 @@ package openpgp
 
 import (
 	"errors"
+	"strings"
 )
 
 type PacketRecordMap map[string]PacketRecord
@@ -58,6 +59,14 @@ func MapKey(pubkey *Pubkey) PacketRecordMap {
 	return m
 }
 
+// SameContentAs returns whether the two keys have identical key material,
+// by comparing their digests. The digests are calculated over the sorted
+// packets, so the order in which the packets were read does not matter.
+func (pubkey *Pubkey) SameContentAs(other *Pubkey) bool {
+	return pubkey.RFingerprint == other.RFingerprint &&
+		pubkey.Sha256 != "" && pubkey.Sha256 == other.Sha256 && pubkey.Md5 == other.Md5
+}
+
 // Merge the contents of srcKey into dstKey, modifying in-place.
 // Packets in src not found in dst are appended to the matching parent.
 // Conflicting packets and unmatched parents are ignored.
@@ -74,17 +83,17 @@ func MergeKey(dstKey *Pubkey, srcKey *Pubkey) {
 		case *Subkey:
 			srcSignable = so
 			if !dstHas {
-				dstKey.subkeys = append(dstKey.subkeys, so)
+				dstKey.AddSubkey(so)
 			}
 		case *UserId:
 			srcSignable = so
 			if !dstHas {
-				dstKey.userIds = append(dstKey.userIds, so)
+				dstKey.AddUserId(so)
 			}
 		case *UserAttribute:
 			srcSignable = so
 			if !dstHas {
-				dstKey.userAttributes = append(dstKey.userAttributes, so)
+				dstKey.AddUserAttribute(so)
 			}
 		case *Signature:
 			dstParent, dstHasParent := dstObjects[GetUuid(srcSignable)]
@@ -97,4 +106,92 @@ func MergeKey(dstKey *Pubkey, srcKey *Pubkey) {
 	})
 	dstKey.updateDigests()
 	Resolve(dstKey)
+	if Config().ReplaceSelfSigs() && supersedeSelfSigs(dstKey) {
+		dstKey.updateDigests()
+	}
+	// Merged self-signatures may extend or shorten the key lifetime. A key
+	// without any usable self-certification keeps its current expiration.
+	dstKey.ResolveExpiration()
+}
+
+// ReplaceSelfSigs returns whether merging an update to a key keeps only the
+// most recent self-signature of each kind on each packet, rather than
+// accumulating them. Signatures made by other keys are always merged.
+func (s *Settings) ReplaceSelfSigs() bool {
+	return s.GetBool("hockeypuck.openpgp.replaceSelfSigs")
+}
+
+// selfSigKind groups the signature types which supersede each other when
+// replacing self-signatures. Returns 0 for types which are never replaced,
+// such as revocations.
+func selfSigKind(sigType int) int {
+	switch {
+	case sigType >= 0x10 && sigType <= 0x13: // User ID or attribute certification
+		return 0x10
+	case sigType == 0x18, sigType == SigTypeDirectKey: // Subkey binding, direct-key
+		return sigType
+	}
+	return 0
+}
+
+// supersedeSelfSigs removes self-signatures from the key which have been
+// superseded by a more recent verified self-signature of the same kind on
+// the same packet, returning whether any were removed. The removed
+// signatures are kept with the key, so that UpdateKey deletes them from the
+// database along with updating the key's digests.
+func supersedeSelfSigs(pubkey *Pubkey) (removed bool) {
+	latest := func(sigs []*Signature) []*Signature {
+		result := latestSelfSigs(pubkey, sigs)
+		kept := make(map[*Signature]bool)
+		for _, sig := range result {
+			kept[sig] = true
+		}
+		for _, sig := range sigs {
+			if !kept[sig] {
+				pubkey.supersededSigs = append(pubkey.supersededSigs, sig)
+				removed = true
+			}
+		}
+		return result
+	}
+	pubkey.signatures = latest(pubkey.signatures)
+	for _, uid := range pubkey.userIds {
+		uid.signatures = latest(uid.signatures)
+	}
+	for _, uat := range pubkey.userAttributes {
+		uat.signatures = latest(uat.signatures)
+	}
+	for _, subkey := range pubkey.subkeys {
+		subkey.signatures = latest(subkey.signatures)
+	}
+	return
+}
+
+// latestSelfSigs returns the signatures without the self-signatures older
+// than the most recent verified self-signature of the same kind. Unverified
+// self-signatures never supersede others, so that a forged signature cannot
+// displace a valid one.
+func latestSelfSigs(pubkey *Pubkey, sigs []*Signature) (result []*Signature) {
+	isSelfSig := func(sig *Signature) bool {
+		return selfSigKind(sig.SigType) != 0 && strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId)
+	}
+	newest := make(map[int]*Signature)
+	for _, sig := range sigs {
+		if !isSelfSig(sig) || sig.State&PacketStateSigOk == 0 {
+			continue
+		}
+		kind := selfSigKind(sig.SigType)
+		if prev, has := newest[kind]; !has || sig.Creation.After(prev.Creation) {
+			newest[kind] = sig
+		}
+	}
+	for _, sig := range sigs {
+		if isSelfSig(sig) {
+			if newer, has := newest[selfSigKind(sig.SigType)]; has && sig.Creation.Before(newer.Creation) {
+				continue
+			}
+		}
+		result = append(result, sig)
+	}
+	return
 }
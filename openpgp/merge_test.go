@@ -18,9 +18,14 @@
 package openpgp
 
 import (
+	"strings"
 	"testing"
+	"time"
 
+	"code.google.com/p/go.crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
 )
 
 func TestMergeAddSig(t *testing.T) {
@@ -45,3 +50,166 @@ func TestMergeAddSig(t *testing.T) {
 	MergeKey(unsignedKeys[0], signedKeys[0])
 	assert.Equal(t, 1, expectedSigCount(unsignedKeys[0]))
 }
+
+func TestResolveExpirationExtendThenRevoke(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	uid := key.userIds[0]
+	orig := uid.selfSignature
+	assert.Nil(t, key.ResolveExpiration())
+	assert.Equal(t, NeverExpires.Unix(), key.Expiration.Unix())
+
+	// A newer self-certification extending the key lifetime.
+	lifetime := uint32(365 * 24 * 60 * 60)
+	extension := &Signature{
+		RIssuerKeyId: orig.RIssuerKeyId,
+		SigType:      0x13,
+		Creation:     orig.Creation.Add(time.Hour),
+		Signature:    &packet.Signature{KeyLifetimeSecs: &lifetime},
+	}
+	uid.signatures = append(uid.signatures, extension)
+	assert.Nil(t, key.ResolveExpiration())
+	assert.Equal(t, key.Creation.Add(time.Duration(lifetime)*time.Second).Unix(), key.Expiration.Unix())
+
+	// Revoking the extension rolls the expiration back.
+	uid.signatures = append(uid.signatures, &Signature{
+		RIssuerKeyId: orig.RIssuerKeyId,
+		SigType:      0x30,
+		Creation:     extension.Creation.Add(time.Hour),
+		Signature:    &packet.Signature{},
+	})
+	assert.Nil(t, key.ResolveExpiration())
+	assert.Equal(t, NeverExpires.Unix(), key.Expiration.Unix())
+
+	// Certifications made by other keys are ignored.
+	key.userIds = []*UserId{{signatures: []*Signature{{
+		RIssuerKeyId: "0000000000000000", SigType: 0x10, Signature: &packet.Signature{}}}}}
+	key.userAttributes = nil
+	assert.Equal(t, ErrMissingSignature, key.ResolveExpiration())
+}
+
+func TestSameContentAs(t *testing.T) {
+	key1 := MustInputAscKey(t, "uat.asc")
+	key2 := MustInputAscKey(t, "uat.asc")
+	assert.True(t, key1.SameContentAs(key2))
+
+	// Packet order does not affect the comparison.
+	uids := key2.userIds
+	uids[0], uids[1] = uids[1], uids[0]
+	subkeys := key2.subkeys
+	subkeys[0], subkeys[2] = subkeys[2], subkeys[0]
+	key2.updateDigests()
+	assert.True(t, key1.SameContentAs(key2))
+
+	key2.subkeys = subkeys[1:]
+	key2.updateDigests()
+	assert.False(t, key1.SameContentAs(key2))
+	assert.False(t, key1.SameContentAs(MustInputAscKey(t, "sksdigest.asc")))
+	assert.False(t, (&Pubkey{}).SameContentAs(&Pubkey{}))
+}
+
+func TestAddSubkeyUserId(t *testing.T) {
+	key := MustInputAscKey(t, "crosscert.asc")
+	other := MustInputAscKey(t, "aead.asc")
+	assert.Equal(t, 1, len(key.subkeys))
+	assert.Equal(t, 1, len(key.userIds))
+
+	// Re-adding the same subkey or user ID is a no-op.
+	key.AddSubkey(key.subkeys[0])
+	assert.Equal(t, 1, len(key.subkeys))
+	uid := *key.userIds[0]
+	uid.ScopedDigest = "unchanged"
+	key.AddUserId(&uid)
+	assert.Equal(t, 1, len(key.userIds))
+	// A rejected user ID is left as it was.
+	assert.Equal(t, "unchanged", uid.ScopedDigest)
+
+	subkey := &Subkey{RFingerprint: other.RFingerprint}
+	key.AddSubkey(subkey)
+	assert.Equal(t, 2, len(key.subkeys))
+	assert.Equal(t, key.RFingerprint, subkey.PubkeyRFP)
+	key.AddSubkey(&Subkey{RFingerprint: other.RFingerprint})
+	assert.Equal(t, 2, len(key.subkeys))
+
+	// User IDs are scoped to the key they are added to.
+	otherUid := other.userIds[0]
+	key.AddUserId(otherUid)
+	assert.Equal(t, 2, len(key.userIds))
+	assert.Equal(t, key.RFingerprint, otherUid.PubkeyRFP)
+	assert.Equal(t, otherUid.calcScopedDigest(key), otherUid.ScopedDigest)
+	assert.NotEqual(t, other.userIds[0].calcScopedDigest(other), otherUid.ScopedDigest)
+
+	uat := MustInputAscKey(t, "uat.asc").userAttributes[0]
+	key.AddUserAttribute(uat)
+	dup := *uat
+	dup.ScopedDigest, dup.PubkeyRFP = "unchanged", ""
+	key.AddUserAttribute(&dup)
+	assert.Equal(t, 1, len(key.userAttributes))
+	assert.Equal(t, key.RFingerprint, uat.PubkeyRFP)
+	assert.Equal(t, "unchanged", dup.ScopedDigest)
+	assert.Equal(t, "", dup.PubkeyRFP)
+}
+
+func TestMergeReplaceSelfSigs(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	countSelfSigs := func(key *Pubkey) (self, other int) {
+		for _, sig := range key.userIds[0].signatures {
+			if strings.HasPrefix(key.RFingerprint, sig.RIssuerKeyId) {
+				self++
+			} else {
+				other++
+			}
+		}
+		return
+	}
+
+	// The update extends the expiration and adds a third-party certification.
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+verifySigs=true
+`)
+	key := MustInputAscKey(t, "expire_old.asc")
+	update := MustInputAscKey(t, "expire_new.asc")
+	assert.Nil(t, key.ResolveExpiration())
+	assert.Nil(t, update.ResolveExpiration())
+	oldExpiration := key.Expiration
+	MergeKey(key, update)
+	self, other := countSelfSigs(key)
+	assert.Equal(t, 2, self)
+	assert.Equal(t, 1, other)
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+verifySigs=true
+replaceSelfSigs=true
+`)
+	assert.Nil(t, Config().Validate())
+	key = MustInputAscKey(t, "expire_old.asc")
+	oldSelfSig := key.userIds[0].selfSignature
+	MergeKey(key, update)
+	self, other = countSelfSigs(key)
+	assert.Equal(t, 1, self)
+	assert.Equal(t, 1, other)
+	// The superseded self-signature is kept for deleting from the database.
+	if assert.Len(t, key.supersededSigs, 1) {
+		assert.Equal(t, oldSelfSig.ScopedDigest, key.supersededSigs[0].ScopedDigest)
+	}
+	assert.Equal(t, update.userIds[0].selfSignature.ScopedDigest, key.userIds[0].selfSignature.ScopedDigest)
+	assert.True(t, key.Expiration.After(oldExpiration))
+	assert.Equal(t, update.Expiration.Unix(), key.Expiration.Unix())
+
+	// Merging the old copy back does not restore the superseded self-signature.
+	MergeKey(key, MustInputAscKey(t, "expire_old.asc"))
+	self, _ = countSelfSigs(key)
+	assert.Equal(t, 1, self)
+	assert.Equal(t, update.Expiration.Unix(), key.Expiration.Unix())
+
+	// Self-signatures are not replaced unless they can be verified.
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+replaceSelfSigs=true
+`)
+	key = MustInputAscKey(t, "expire_old.asc")
+	MergeKey(key, MustInputAscKey(t, "expire_new.asc"))
+	self, _ = countSelfSigs(key)
+	assert.Equal(t, 2, self)
+}
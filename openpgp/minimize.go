@@ -0,0 +1,220 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Minimize returns a copy of the key with only its self-signatures,
+// dropping third-party certifications and unsupported packets.
+// The records of the original key are not modified.
+func (pubkey *Pubkey) Minimize() *Pubkey {
+	return pubkey.MinimizeSince(time.Time{})
+}
+
+// MinimizeSince returns a minimized copy of the key containing only
+// the self-signatures created after the given time, along with the
+// user IDs, user attributes and subkeys they sign. Subkeys created after
+// the given time are always included. The primary key is always included.
+func (pubkey *Pubkey) MinimizeSince(since time.Time) *Pubkey {
+	isNew := func(sig *Signature) bool {
+		return strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) && sig.Creation.After(since)
+	}
+	minKey := pubkey.Clone()
+	minKey.Unsupported = nil
+	minKey.signatures = filterSignatures(minKey.signatures, isNew)
+	var userIds []*UserId
+	for _, uid := range minKey.userIds {
+		if uid.signatures = filterSignatures(uid.signatures, isNew); len(uid.signatures) > 0 {
+			userIds = append(userIds, uid)
+		}
+	}
+	minKey.userIds = userIds
+	var userAttributes []*UserAttribute
+	for _, uat := range minKey.userAttributes {
+		if uat.signatures = filterSignatures(uat.signatures, isNew); len(uat.signatures) > 0 {
+			userAttributes = append(userAttributes, uat)
+		}
+	}
+	minKey.userAttributes = userAttributes
+	var subkeys []*Subkey
+	for _, subkey := range minKey.subkeys {
+		if subkey.signatures = filterSignatures(subkey.signatures, isNew); len(subkey.signatures) > 0 || subkey.Creation.After(since) {
+			subkeys = append(subkeys, subkey)
+		}
+	}
+	minKey.subkeys = subkeys
+	return minKey
+}
+
+// Teaser returns a copy of the key for display, with only the primary user ID
+// and its self-signature. Other user IDs, user attributes, subkeys and
+// third-party certifications are dropped. Revocations of the key and of the
+// primary user ID are kept, so that a revoked key does not appear valid.
+// The records of the original key are not modified.
+func (pubkey *Pubkey) Teaser() *Pubkey {
+	teaser := pubkey.Clone()
+	teaser.Unsupported = nil
+	teaser.signatures = filterSignatures(teaser.signatures, func(sig *Signature) bool {
+		return sig == teaser.revSig
+	})
+	if uid := teaser.PrimaryUserId(); uid != nil {
+		uid.signatures = filterSignatures(uid.signatures, func(sig *Signature) bool {
+			return sig == uid.selfSignature || sig == uid.revSig
+		})
+		teaser.userIds = []*UserId{uid}
+		teaser.primaryUid, teaser.primaryUidSig = uid, uid.selfSignature
+		teaser.PrimaryUid = sql.NullString{uid.ScopedDigest, true}
+	} else {
+		teaser.userIds = nil
+		teaser.primaryUid, teaser.primaryUidSig = nil, nil
+		teaser.PrimaryUid = sql.NullString{"", false}
+	}
+	teaser.userAttributes = nil
+	teaser.primaryUat, teaser.primaryUatSig = nil, nil
+	teaser.PrimaryUat = sql.NullString{"", false}
+	teaser.subkeys = nil
+	return teaser
+}
+
+// FilterModifiedSince returns the keys modified after the given time, in
+// their original order, for incremental mirroring. Keys never modified since
+// their modification time was first recorded, which have a zero Mtime, are
+// not included; see FilterModifiedSinceOpts.
+func FilterModifiedSince(keys []*Pubkey, since time.Time) []*Pubkey {
+	return FilterModifiedSinceOpts(keys, since, false)
+}
+
+// FilterModifiedSinceOpts returns the keys modified after the given time,
+// also including keys with a zero Mtime if includeUntouched is set. A mirror
+// making its first sync from a server with such keys needs to include them.
+func FilterModifiedSinceOpts(keys []*Pubkey, since time.Time, includeUntouched bool) (result []*Pubkey) {
+	for _, key := range keys {
+		if key.Mtime.IsZero() {
+			if includeUntouched {
+				result = append(result, key)
+			}
+		} else if key.Mtime.After(since) {
+			result = append(result, key)
+		}
+	}
+	return
+}
+
+// FilterExpired returns the keys that have not expired at the given time, or
+// that expired within the configured grace period, in their original order.
+func FilterExpired(keys []*Pubkey, now time.Time) (result []*Pubkey) {
+	for _, key := range keys {
+		if !key.IsExpired(now) {
+			result = append(result, key)
+		}
+	}
+	return
+}
+
+// TrustedSigners returns the key IDs of third-party signers whose
+// certifications are kept. When empty, all certifications are kept.
+func (s *Settings) TrustedSigners() []string {
+	return s.GetStrings("hockeypuck.openpgp.trustedSigners")
+}
+
+var keyIdRegex = regexp.MustCompile(`^[0-9a-fA-F]{16}$`)
+
+// validateTrustedSigners checks that trusted signers are given as 16-digit
+// hexadecimal key IDs.
+func (s *Settings) validateTrustedSigners() error {
+	for _, keyId := range s.TrustedSigners() {
+		if !keyIdRegex.MatchString(keyId) {
+			return fmt.Errorf("hockeypuck.openpgp.trustedSigners: invalid key ID %q", keyId)
+		}
+	}
+	return nil
+}
+
+// FilterSigners removes third-party certifications from the key which were
+// not issued by one of the trusted signer key IDs. Self-signatures and
+// revocations are always kept. The key digests are recalculated if any
+// signatures were removed.
+func (pubkey *Pubkey) FilterSigners(trusted []string) {
+	trustedIds := make(map[string]bool)
+	for _, keyId := range trusted {
+		trustedIds[strings.ToLower(keyId)] = true
+	}
+	keep := func(sig *Signature) bool {
+		switch sig.SigType {
+		case 0x20, 0x28, 0x30: // TODO: add packet.SigTypeKeyRevocation, etc.
+			return true
+		}
+		return strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) || trustedIds[sig.IssuerKeyId()]
+	}
+	var removed bool
+	filter := func(sigs []*Signature) []*Signature {
+		result := filterSignatures(sigs, keep)
+		removed = removed || len(result) != len(sigs)
+		return result
+	}
+	pubkey.signatures = filter(pubkey.signatures)
+	for _, uid := range pubkey.userIds {
+		uid.signatures = filter(uid.signatures)
+	}
+	for _, uat := range pubkey.userAttributes {
+		uat.signatures = filter(uat.signatures)
+	}
+	for _, subkey := range pubkey.subkeys {
+		subkey.signatures = filter(subkey.signatures)
+	}
+	if removed {
+		pubkey.updateDigests()
+	}
+}
+
+// FilterTrustedSigners removes third-party certifications not issued by the
+// configured trusted signers, if any are configured.
+func FilterTrustedSigners(pubkey *Pubkey) {
+	if trusted := Config().TrustedSigners(); len(trusted) > 0 {
+		pubkey.FilterSigners(trusted)
+	}
+}
+
+// HonorNoModify returns whether third-party certifications are dropped from
+// keys whose owners have set the "no-modify" keyserver preference.
+func (s *Settings) HonorNoModify() bool {
+	return s.GetBool("hockeypuck.openpgp.honorNoModify")
+}
+
+// FilterNoModify removes all third-party certifications from a key with the
+// "no-modify" keyserver preference, if configured to honor it.
+func FilterNoModify(pubkey *Pubkey) {
+	if Config().HonorNoModify() && pubkey.NoModify() {
+		pubkey.FilterSigners(nil)
+	}
+}
+
+func filterSignatures(sigs []*Signature, match func(*Signature) bool) (result []*Signature) {
+	for _, sig := range sigs {
+		if match(sig) {
+			result = append(result, sig)
+		}
+	}
+	return
+}
@@ -0,0 +1,208 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+func countSigs(key *Pubkey) (n int) {
+	key.Visit(func(rec PacketRecord) error {
+		if _, is := rec.(*Signature); is {
+			n++
+		}
+		return nil
+	})
+	return
+}
+
+func TestMinimize(t *testing.T) {
+	signed := MustInputAscKey(t, "alice_signed.asc")
+	unsigned := MustInputAscKey(t, "alice_unsigned.asc")
+	nsigs := countSigs(signed)
+	minKey := signed.Minimize()
+	assert.Empty(t, minKey.IssuerKeyIds())
+	assert.Equal(t, countSigs(unsigned), countSigs(minKey))
+	assert.Equal(t, len(signed.userIds), len(minKey.userIds))
+	assert.Equal(t, len(signed.subkeys), len(minKey.subkeys))
+	// The original key is left intact.
+	assert.Equal(t, nsigs, countSigs(signed))
+	assert.Equal(t, []string{"62aea01d67640fb5"}, signed.IssuerKeyIds())
+}
+
+func TestMinimizeSince(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	assert.Equal(t, 2, countSigs(key.MinimizeSince(time.Time{})))
+
+	// Nothing newer than the latest signature, only the primary key remains.
+	delta := key.MinimizeSince(time.Now())
+	assert.Equal(t, 0, countSigs(delta))
+	assert.Empty(t, delta.userIds)
+	assert.Empty(t, delta.subkeys)
+	assert.Equal(t, key.Fingerprint(), delta.Fingerprint())
+
+	// A key not yet sent to the peer is sent in full.
+	key.Ctime = time.Now()
+	assert.Equal(t, 2, countSigs(pksUpdate(key, time.Now().Add(-time.Hour))))
+	key.Ctime = key.Creation
+	assert.Equal(t, 0, countSigs(pksUpdate(key, time.Now().Add(-time.Hour))))
+}
+
+func TestTeaser(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	nsigs := countSigs(key)
+	primary := key.PrimaryUserId()
+	teaser := key.Teaser()
+	assert.Equal(t, nsigs, countSigs(key))
+	assert.Equal(t, 1, len(teaser.userIds))
+	assert.Empty(t, teaser.userAttributes)
+	assert.Empty(t, teaser.subkeys)
+	assert.Empty(t, teaser.signatures)
+	assert.Equal(t, 1, countSigs(teaser))
+
+	// The teaser is a valid key on its own.
+	var buf bytes.Buffer
+	assert.Nil(t, WritePackets(&buf, teaser))
+	var keys []*Pubkey
+	for keyRead := range ReadKeys(&buf) {
+		assert.Nil(t, keyRead.Error)
+		keys = append(keys, keyRead.Pubkey)
+	}
+	if !assert.Equal(t, 1, len(keys)) {
+		return
+	}
+	assert.Equal(t, key.Fingerprint(), keys[0].Fingerprint())
+	assert.Equal(t, primary.Keywords, keys[0].PrimaryUserId().Keywords)
+	assert.Empty(t, keys[0].subkeys)
+	valid, errs := keys[0].Validate(time.Now())
+	assert.True(t, valid)
+	assert.Empty(t, errs)
+
+	// Revocations are kept.
+	key = MustInputAscKey(t, "revoked_uid.asc")
+	teaser = key.Teaser()
+	assert.True(t, teaser.IsRevoked())
+	assert.Equal(t, []*Signature{teaser.revSig}, teaser.signatures)
+	assert.Equal(t, key.PrimaryUserId().Keywords, teaser.PrimaryUserId().Keywords)
+	assert.Equal(t, key.PrimaryUserId().IsRevoked(), teaser.PrimaryUserId().IsRevoked())
+	assert.Equal(t, len(key.PrimaryUserId().signatures), len(teaser.PrimaryUserId().signatures))
+}
+
+func TestFilterSigners(t *testing.T) {
+	key := MustInputAscKey(t, "alice_signed.asc")
+	nsigs := countSigs(key)
+	md5 := key.Md5
+	key.FilterSigners([]string{"62AEA01D67640FB5"})
+	assert.Equal(t, nsigs, countSigs(key))
+	assert.Equal(t, md5, key.Md5)
+
+	key.FilterSigners([]string{"0123456789abcdef"})
+	assert.Empty(t, key.IssuerKeyIds())
+	assert.Equal(t, countSigs(MustInputAscKey(t, "alice_unsigned.asc")), countSigs(key))
+	assert.NotEqual(t, md5, key.Md5)
+}
+
+func TestTrustedSignersConfig(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+trustedSigners=["62aea01d67640fb5"]
+`)
+	assert.Nil(t, Config().Validate())
+	key := MustInputAscKey(t, "alice_signed.asc")
+	FilterTrustedSigners(key)
+	assert.Equal(t, []string{"62aea01d67640fb5"}, key.IssuerKeyIds())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+trustedSigners=["62aea01d"]
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestNoModify(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "nomodify.asc")
+	assert.True(t, key.NoModify())
+	assert.False(t, MustInputAscKey(t, "d7346e26.asc").NoModify())
+
+	// Third-party certifications are kept unless configured otherwise.
+	hockeypuck.SetConfig("")
+	FilterNoModify(key)
+	assert.Equal(t, []string{"68f58868e58cb56a"}, key.IssuerKeyIds())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+honorNoModify=true
+`)
+	assert.Nil(t, Config().Validate())
+	md5 := key.Md5
+	FilterNoModify(key)
+	assert.Empty(t, key.IssuerKeyIds())
+	assert.NotEqual(t, md5, key.Md5)
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+honorNoModify="please"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestFilterModifiedSince(t *testing.T) {
+	now := time.Now().UTC()
+	old := &Pubkey{RFingerprint: "old", Mtime: now.Add(-2 * time.Hour)}
+	recent := &Pubkey{RFingerprint: "recent", Mtime: now}
+	untouched := &Pubkey{RFingerprint: "untouched"}
+	keys := []*Pubkey{recent, untouched, old}
+	assert.Equal(t, []*Pubkey{recent}, FilterModifiedSince(keys, now.Add(-time.Hour)))
+	assert.Equal(t, []*Pubkey{recent, old}, FilterModifiedSince(keys, now.Add(-3*time.Hour)))
+	assert.Empty(t, FilterModifiedSince(keys, now))
+	assert.Equal(t, []*Pubkey{recent, untouched},
+		FilterModifiedSinceOpts(keys, now.Add(-time.Hour), true))
+}
+
+func TestMtimeBumped(t *testing.T) {
+	// Parsing a key does not modify it.
+	key := MustInputAscKey(t, "alice_unsigned.asc")
+	assert.True(t, key.Mtime.IsZero())
+
+	// Merging in nothing new leaves the key untouched.
+	MergeKey(key, MustInputAscKey(t, "alice_unsigned.asc"))
+	assert.True(t, key.Mtime.IsZero())
+
+	MergeKey(key, MustInputAscKey(t, "alice_signed.asc"))
+	assert.False(t, key.Mtime.IsZero())
+
+	key = MustInputAscKey(t, "alice_signed.asc")
+	key.FilterSigners(nil)
+	assert.False(t, key.Mtime.IsZero())
+
+	key = MustInputAscKey(t, "alice_signed.asc")
+	key.ExcludeFromRecon()
+	assert.False(t, key.Mtime.IsZero())
+
+	key = MustInputAscKey(t, "alice_signed.asc")
+	key.Tombstone()
+	assert.False(t, key.Mtime.IsZero())
+}
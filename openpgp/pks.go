@@ -126,10 +126,21 @@ WHERE creation < now() AND expiration > now() AND state = 0`)
 	return
 }
 
+// Reduce a key to the packets a PKS server last synced at the given time
+// is likely missing. Keys it has not been sent before are sent in full,
+// minimized to their self-signatures.
+func pksUpdate(key *Pubkey, lastSync time.Time) *Pubkey {
+	if key.Ctime.After(lastSync) {
+		return key.Minimize()
+	}
+	return key.MinimizeSince(lastSync)
+}
+
 func (ps *PksSync) SendKeys(status *PksStatus) (err error) {
+	lastSync := status.LastSync
 	var uuids []string
 	err = ps.db.Select(&uuids, "SELECT uuid FROM openpgp_pubkey WHERE mtime > $1",
-		status.LastSync)
+		lastSync)
 	if err != nil {
 		return
 	}
@@ -141,7 +152,7 @@ func (ps *PksSync) SendKeys(status *PksStatus) (err error) {
 	for _, key := range keys {
 		// Send key email
 		log.Println("Sending key", key.Fingerprint(), "to PKS", status.Addr)
-		err = ps.SendKey(status.Addr, key)
+		err = ps.SendKey(status.Addr, pksUpdate(key, lastSync))
 		if err != nil {
 			log.Println("Error sending key to PKS", status.Addr, ":", err)
 			return
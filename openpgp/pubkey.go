@@ -21,12 +21,14 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/sha1"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"hash"
 	"io"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
@@ -44,6 +46,11 @@ const (
 // Pubkey represents an OpenPGP public key packet.
 // Searchable fields are extracted from the packet key material
 // stored in Packet, for database indexing.
+//
+// A Pubkey may be read from several goroutines at once: serializing,
+// digesting and indexing the key, and its other accessors, do not modify it.
+// Resolving, sorting, merging, filtering and validating the key change it in
+// place, so a key shared between goroutines must be cloned first.
 type Pubkey struct {
 
 	/* Database fields */
@@ -71,6 +78,10 @@ type Pubkey struct {
 	userIds        []*UserId        `db:"-"`
 	userAttributes []*UserAttribute `db:"-"`
 
+	// supersededSigs are self-signatures removed by merging, which must
+	// also be deleted from the database when the key is updated.
+	supersededSigs []*Signature `db:"-"`
+
 	/* Cross-references */
 
 	revSig        *Signature     `db:"-"`
@@ -89,22 +100,154 @@ func (pubkey *Pubkey) Fingerprint() string {
 	return util.Reverse(pubkey.RFingerprint)
 }
 
+// Length of a V5 fingerprint as a hex string.
+const v5FingerprintLen = 64
+
+// keyIdOf returns an n-digit hex key ID for the given reversed fingerprint.
+// V4 key IDs are the last digits of the fingerprint, while V5 key IDs are
+// the first digits of the longer SHA-256 fingerprint.
+func keyIdOf(rfingerprint string, n int) string {
+	if n > len(rfingerprint) {
+		n = len(rfingerprint)
+	}
+	if len(rfingerprint) == v5FingerprintLen {
+		return util.Reverse(rfingerprint[len(rfingerprint)-n:])
+	}
+	return util.Reverse(rfingerprint[:n])
+}
+
+// NormalizeFingerprint returns the lower-case hex fingerprint given with or
+// without a "0x" prefix and spaces, such as "0xABCD 1234 ...". Returns the
+// empty string if it is not a V3, V4 or V5 fingerprint in hex.
+func NormalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.Replace(fp, " ", "", -1))
+	fp = strings.TrimPrefix(fp, "0x")
+	if _, err := hex.DecodeString(fp); err != nil {
+		return ""
+	}
+	switch len(fp) {
+	case 32, 40, v5FingerprintLen:
+		return fp
+	}
+	return ""
+}
+
+// Version returns the version of the public key packet, or 0 if it cannot
+// be read.
+func (pubkey *Pubkey) Version() int {
+	op, err := toOpaquePacket(pubkey.Packet)
+	if err != nil || len(op.Contents) == 0 {
+		return 0
+	}
+	return int(op.Contents[0])
+}
+
 func (pubkey *Pubkey) KeyId() string {
 	if pubkey.PublicKeyV3 != nil {
 		return fmt.Sprintf("%016x", pubkey.PublicKeyV3.KeyId)
 	}
-	return util.Reverse(pubkey.RFingerprint[:16])
+	return keyIdOf(pubkey.RFingerprint, 16)
 }
 
 func (pubkey *Pubkey) ShortId() string {
 	if pubkey.PublicKeyV3 != nil {
 		return fmt.Sprintf("%08x", uint32(pubkey.PublicKeyV3.KeyId))
 	}
-	return util.Reverse(pubkey.RFingerprint[:8])
+	return keyIdOf(pubkey.RFingerprint, 8)
+}
+
+// touch records the key as modified now. Changes to the key material, its
+// state or its digests must touch the key, so that mirrors syncing by
+// modification time see them.
+func (pubkey *Pubkey) touch() {
+	pubkey.Mtime = time.Now().UTC()
+}
+
+// CollidingKeyIds finds long key IDs shared by more than one distinct public
+// key. Such keys can only be told apart by fingerprint, so lookups by key ID
+// may return the wrong key. The result maps each colliding key ID to the
+// fingerprints of the keys sharing it.
+func CollidingKeyIds(keys []*Pubkey) map[string][]string {
+	fingerprints := make(map[string][]string)
+	for _, key := range keys {
+		keyId := key.KeyId()
+		if !containsString(fingerprints[keyId], key.Fingerprint()) {
+			fingerprints[keyId] = append(fingerprints[keyId], key.Fingerprint())
+		}
+	}
+	result := make(map[string][]string)
+	for keyId, fps := range fingerprints {
+		if len(fps) > 1 {
+			result[keyId] = fps
+		}
+	}
+	return result
+}
+
+// SortKey returns a key for ordering public keys by creation time, with the
+// fingerprint as a tiebreaker. The format is the UTC creation time as
+// "20060102150405", a slash, then the lowercase hex fingerprint, so that
+// sort keys compare lexically in the same order as (creation, fingerprint).
+func (pubkey *Pubkey) SortKey() string {
+	return pubkey.Creation.UTC().Format("20060102150405") + "/" + pubkey.Fingerprint()
+}
+
+// CreationSkew returns how long after its creation time the key was first
+// seen by this server. A large skew suggests a key backdated well before it
+// appeared. Zero if the key has not been stored yet.
+func (pubkey *Pubkey) CreationSkew() time.Duration {
+	if pubkey.Ctime.IsZero() {
+		return 0
+	}
+	return pubkey.Ctime.Sub(pubkey.Creation)
 }
 
 func (pubkey *Pubkey) UserIds() []*UserId { return pubkey.userIds }
 
+// UserIdByKeyword returns the user ID on the key matching the given user ID
+// string, after the same UTF-8 cleanup applied when the key is read.
+// Returns nil if there is no match.
+func (pubkey *Pubkey) UserIdByKeyword(kw string) *UserId {
+	kw = util.CleanUtf8(kw)
+	for _, uid := range pubkey.userIds {
+		if uid.Keywords == kw {
+			return uid
+		}
+	}
+	return nil
+}
+
+// Emails returns the unique email addresses found in the user IDs of the key,
+// lowercased, in the order of the user IDs claiming them.
+func (pubkey *Pubkey) Emails() []string {
+	var emails []string
+	seen := make(map[string]bool)
+	for _, uid := range pubkey.userIds {
+		_, _, email := uid.Parse()
+		email = strings.ToLower(email)
+		if email != "" && !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// PrimaryUserId returns the primary user ID of the key, or the first user ID
+// with a self-signature if the primary one has none. Returns nil if no
+// user ID has a self-signature.
+func (pubkey *Pubkey) PrimaryUserId() *UserId {
+	if pubkey.primaryUid != nil && pubkey.primaryUid.selfSignature != nil {
+		return pubkey.primaryUid
+	}
+	for _, uid := range pubkey.userIds {
+		if uid.selfSignature != nil {
+			return uid
+		}
+	}
+	return nil
+}
+
 func (pubkey *Pubkey) UserAttributes() []*UserAttribute { return pubkey.userAttributes }
 
 func (pubkey *Pubkey) Subkeys() []*Subkey { return pubkey.subkeys }
@@ -143,6 +286,9 @@ func (pubkey *Pubkey) setPacket(p packet.Packet) (err error) {
 			return ErrInvalidPacketType
 		}
 		pubkey.PublicKeyV3 = pk
+	case *packet.PrivateKey:
+		log.Println("Warning: rejected secret key material")
+		err = ErrSecretKeyRejected
 	default:
 		err = ErrInvalidPacketType
 	}
@@ -150,6 +296,9 @@ func (pubkey *Pubkey) setPacket(p packet.Packet) (err error) {
 }
 
 func (pubkey *Pubkey) Read() (err error) {
+	if pubkey.Packet, err = unpackBytes(pubkey.Packet); err != nil {
+		return
+	}
 	buf := bytes.NewBuffer(pubkey.Packet)
 	var p packet.Packet
 	if p, err = packet.Read(buf); err != nil {
@@ -178,6 +327,10 @@ func NewPubkey(op *packet.OpaquePacket) (pubkey *Pubkey, err error) {
 	pubkey = &Pubkey{Packet: buf.Bytes()}
 	var p packet.Packet
 	if p, err = op.Parse(); err != nil {
+		if _, is := err.(errors.UnsupportedError); !is {
+			// Malformed or truncated key material
+			return nil, err
+		}
 		return pubkey, pubkey.initUnsupported(op)
 	}
 	if err = pubkey.setPacket(p); err != nil {
@@ -201,14 +354,31 @@ func NewPubkey(op *packet.OpaquePacket) (pubkey *Pubkey, err error) {
 func (pubkey *Pubkey) initUnsupported(op *packet.OpaquePacket) (err error) {
 	pubkey.State = PacketStateUnsuppPubkey
 	// Calculate opaque fingerprint on unsupported public key packet
-	h := sha1.New()
-	h.Write([]byte{0x99, byte(len(op.Contents) >> 8), byte(len(op.Contents))})
-	h.Write(op.Contents)
-	fpr := hex.EncodeToString(h.Sum(nil))
-	pubkey.RFingerprint = util.Reverse(fpr)
+	pubkey.RFingerprint = util.Reverse(opaqueFingerprint(op))
 	return
 }
 
+// opaqueFingerprint calculates the fingerprint of a public key or subkey
+// packet without parsing the key material.
+func opaqueFingerprint(op *packet.OpaquePacket) string {
+	var h hash.Hash
+	if len(op.Contents) > 0 && (op.Contents[0] == 5 || op.Contents[0] == 6) {
+		// V5 and V6 fingerprints are SHA-256, with a four-octet length.
+		prefix := byte(0x9a)
+		if op.Contents[0] == 6 {
+			prefix = 0x9b
+		}
+		h = sha256.New()
+		h.Write([]byte{prefix, byte(len(op.Contents) >> 24), byte(len(op.Contents) >> 16),
+			byte(len(op.Contents) >> 8), byte(len(op.Contents))})
+	} else {
+		h = sha1.New()
+		h.Write([]byte{0x99, byte(len(op.Contents) >> 8), byte(len(op.Contents))})
+	}
+	h.Write(op.Contents)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (pubkey *Pubkey) initV4() error {
 	buf := bytes.NewBuffer(nil)
 	err := pubkey.PublicKey.Serialize(buf)
@@ -225,7 +395,7 @@ func (pubkey *Pubkey) initV4() error {
 		return ErrInvalidPacketType
 	}
 	pubkey.RFingerprint = util.Reverse(fingerprint)
-	pubkey.Creation = pubkey.PublicKey.CreationTime
+	pubkey.Creation = pubkey.PublicKey.CreationTime.UTC()
 	pubkey.Expiration = NeverExpires
 	pubkey.Algorithm = int(pubkey.PublicKey.PubKeyAlgo)
 	pubkey.BitLen = int(bitLen)
@@ -248,7 +418,7 @@ func (pubkey *Pubkey) initV3() error {
 		return ErrInvalidPacketType
 	}
 	pubkey.RFingerprint = util.Reverse(fingerprint)
-	pubkey.Creation = pubkey.PublicKeyV3.CreationTime
+	pubkey.Creation = pubkey.PublicKeyV3.CreationTime.UTC()
 	pubkey.Expiration = NeverExpires
 	if pubkey.PublicKeyV3.DaysToExpire > 0 {
 		pubkey.Expiration = pubkey.Creation.Add(time.Duration(pubkey.PublicKeyV3.DaysToExpire) * time.Hour * 24)
@@ -298,6 +468,113 @@ func (pubkey *Pubkey) RemoveSignature(sig *Signature) {
 	pubkey.signatures = removeSignature(pubkey.signatures, sig)
 }
 
+// AddSubkey adds the subkey to the key and links it to the key. Adding a
+// subkey with the same fingerprint as one the key already has does nothing.
+func (pubkey *Pubkey) AddSubkey(subkey *Subkey) {
+	for _, other := range pubkey.subkeys {
+		if other.RFingerprint == subkey.RFingerprint {
+			return
+		}
+	}
+	subkey.PubkeyRFP = pubkey.RFingerprint
+	pubkey.subkeys = append(pubkey.subkeys, subkey)
+}
+
+// AddUserId adds the user ID to the key and links it to the key. Adding a
+// user ID with the same scoped digest as one the key already has does
+// nothing, and leaves the user ID unchanged.
+func (pubkey *Pubkey) AddUserId(uid *UserId) {
+	digest := uid.calcScopedDigest(pubkey)
+	for _, other := range pubkey.userIds {
+		if other.calcScopedDigest(pubkey) == digest {
+			return
+		}
+	}
+	uid.ScopedDigest = digest
+	uid.PubkeyRFP = pubkey.RFingerprint
+	pubkey.userIds = append(pubkey.userIds, uid)
+}
+
+// AddUserAttribute adds the user attribute to the key and links it to the
+// key. Adding a user attribute with the same scoped digest as one the key
+// already has does nothing, and leaves the user attribute unchanged.
+func (pubkey *Pubkey) AddUserAttribute(uat *UserAttribute) {
+	digest := uat.calcScopedDigest(pubkey)
+	for _, other := range pubkey.userAttributes {
+		if other.calcScopedDigest(pubkey) == digest {
+			return
+		}
+	}
+	uat.ScopedDigest = digest
+	uat.PubkeyRFP = pubkey.RFingerprint
+	pubkey.userAttributes = append(pubkey.userAttributes, uat)
+}
+
+// ResolveExpiration sets the expiration of a V4 key from the key lifetime in
+// its most recent self-certification on a user ID or user attribute, so that
+// a merged self-signature extending the key lifetime takes effect. A
+// certification revocation made by the key cancels the latest
+// self-certification preceding it on the same user ID, rolling the expiration
+// back to the one before. Returns ErrMissingSignature, leaving the expiration
+// unchanged, if no self-certification applies.
+func (pubkey *Pubkey) ResolveExpiration() error {
+	if pubkey.PublicKey == nil {
+		// V3 keys declare their expiration in the key packet.
+		return nil
+	}
+	now := time.Now()
+	var latest *Signature
+	consider := func(sigs []*Signature) {
+		if sig := pubkey.selfCertification(sigs, now); sig != nil &&
+			(latest == nil || sig.Creation.After(latest.Creation)) {
+			latest = sig
+		}
+	}
+	for _, uid := range pubkey.userIds {
+		consider(uid.signatures)
+	}
+	for _, uat := range pubkey.userAttributes {
+		consider(uat.signatures)
+	}
+	if latest == nil {
+		return ErrMissingSignature
+	}
+	pubkey.Expiration = NeverExpires
+	if lifetime := latest.Signature.KeyLifetimeSecs; lifetime != nil && *lifetime > 0 {
+		pubkey.Expiration = pubkey.Creation.Add(time.Duration(*lifetime) * time.Second)
+	}
+	return nil
+}
+
+// selfCertification returns the most recent V4 self-certification among the
+// signatures that has not been cancelled by a later certification revocation,
+// ignoring signatures that have expired at the given time.
+func (pubkey *Pubkey) selfCertification(sigs []*Signature, now time.Time) *Signature {
+	var events []*Signature
+	for _, sig := range sigs {
+		if sig.Signature == nil || sig.State&PacketStateSigBad != 0 || sig.IsExpired(now) ||
+			!strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) {
+			continue
+		}
+		if (sig.SigType >= 0x10 && sig.SigType <= 0x13) || sig.SigType == 0x30 {
+			events = append(events, sig)
+		}
+	}
+	sort.Stable(&sigSorter{events})
+	var certs []*Signature
+	for _, sig := range events {
+		if sig.SigType != 0x30 {
+			certs = append(certs, sig)
+		} else if len(certs) > 0 {
+			certs = certs[:len(certs)-1]
+		}
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[len(certs)-1]
+}
+
 func (pubkey *Pubkey) linkSelfSigs() {
 	for _, sig := range pubkey.signatures {
 		if !strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) {
@@ -314,19 +591,106 @@ func (pubkey *Pubkey) linkSelfSigs() {
 	}
 }
 
+// designatedRevoker returns the fingerprint of the designated revoker which
+// issued the signature, or the empty string if its issuer is not one of
+// DesignatedRevokers.
+func (pubkey *Pubkey) designatedRevoker(sig *Signature) string {
+	if sig.RIssuerKeyId == "" {
+		return ""
+	}
+	issuerFpr := sig.IssuerFingerprint()
+	for _, fpr := range pubkey.DesignatedRevokers() {
+		if issuerFpr != "" && issuerFpr == fpr {
+			return fpr
+		} else if issuerFpr == "" && strings.HasSuffix(fpr, sig.IssuerKeyId()) {
+			return fpr
+		}
+	}
+	return ""
+}
+
+// isDesignatedRevoker returns whether the signature was issued by a key a
+// direct-key signature authorizes to revoke this key.
+func (pubkey *Pubkey) isDesignatedRevoker(sig *Signature) bool {
+	return pubkey.designatedRevoker(sig) != ""
+}
+
+// LinkDesignatedRevocations honors revocations of the key made by its
+// designated revokers. The revoker's key is not part of the key material, so
+// lookup is used to find it by fingerprint, and the revocation is only
+// honored if it verifies against that key. Revocations whose revoker cannot be
+// found are left unlinked.
+func (pubkey *Pubkey) LinkDesignatedRevocations(lookup func(fpr string) *Pubkey) {
+	for _, sig := range pubkey.signatures {
+		if sig.SigType != 0x20 || strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) {
+			continue
+		}
+		if pubkey.revSig != nil && sig.Creation.Unix() >= pubkey.revSig.Creation.Unix() {
+			continue
+		}
+		fpr := pubkey.designatedRevoker(sig)
+		if fpr == "" {
+			continue
+		}
+		revoker := lookup(fpr)
+		if revoker == nil || revoker.Fingerprint() != fpr {
+			continue
+		}
+		if err := pubkey.checkDesignatedRevocation(revoker, sig); err == nil {
+			pubkey.revSig = sig
+			pubkey.RevSigDigest = sql.NullString{sig.ScopedDigest, true}
+		}
+	}
+}
+
+// IsRevoked returns whether the key has been revoked, either by itself or by
+// one of its designated revokers.
+func (pubkey *Pubkey) IsRevoked() bool {
+	return pubkey.revSig != nil || pubkey.RevSigDigest.Valid
+}
+
+// String returns a one-line summary of the key for logging, such as
+// "<fingerprint> RSA 4096, 3 uids, 2 subkeys, revoked=false".
+func (pubkey *Pubkey) String() string {
+	fpr := pubkey.Fingerprint()
+	if fpr == "" {
+		fpr = "(no fingerprint)"
+	}
+	return fmt.Sprintf("%s %s, %d uids, %d subkeys, revoked=%t", fpr,
+		pubkey.AlgorithmDescription(), len(pubkey.userIds), len(pubkey.subkeys),
+		pubkey.IsRevoked())
+}
+
 func (pubkey *Pubkey) publicKey() *packet.PublicKey     { return pubkey.PublicKey }
 func (pubkey *Pubkey) publicKeyV3() *packet.PublicKeyV3 { return pubkey.PublicKeyV3 }
 
+// flagSigState records the outcome of verifying a self-signature in its state.
+// Only cryptographic verification failures flag the signature as bad; signatures
+// that could not be checked, such as those using unsupported algorithms, are left
+// unflagged.
+func flagSigState(sig *Signature, err error) {
+	if err == nil {
+		sig.State |= PacketStateSigOk
+	} else if _, is := err.(errors.SignatureError); is {
+		sig.State |= PacketStateSigBad
+	}
+}
+
 func (pubkey *Pubkey) verifyPublicKeySelfSig(keyrec publicKeyRecord, sig *Signature) (err error) {
 	if !Config().VerifySigs() {
 		return nil
 	}
+	return pubkey.checkPublicKeySelfSig(keyrec, sig)
+}
+
+// checkPublicKeySelfSig verifies a signature made by the key over itself or
+// one of its subkeys, regardless of the configured signature verification
+// policy.
+func (pubkey *Pubkey) checkPublicKeySelfSig(keyrec publicKeyRecord, sig *Signature) (err error) {
+	defer func() { flagSigState(sig, err) }()
 	if pubkey.PublicKey != nil && keyrec.publicKey() != nil {
 		if sig.Signature != nil {
 			err = pubkey.PublicKey.VerifyKeySignature(keyrec.publicKey(), sig.Signature)
-			if err == nil {
-				sig.State |= PacketStateSigOk
-			}
 			return
 		} else {
 			return ErrInvalidPacketType
@@ -334,9 +698,6 @@ func (pubkey *Pubkey) verifyPublicKeySelfSig(keyrec publicKeyRecord, sig *Signat
 	} else if pubkey.PublicKeyV3 != nil && keyrec.publicKeyV3() != nil {
 		if sig.SignatureV3 != nil {
 			err = pubkey.PublicKeyV3.VerifyKeySignatureV3(keyrec.publicKeyV3(), sig.SignatureV3)
-			if err == nil {
-				sig.State |= PacketStateSigOk
-			}
 			return
 		} else {
 			return ErrInvalidPacketType
@@ -345,25 +706,81 @@ func (pubkey *Pubkey) verifyPublicKeySelfSig(keyrec publicKeyRecord, sig *Signat
 	return ErrPacketRecordState
 }
 
+// verifyDirectKeySelfSig verifies a signature made by the key directly over
+// itself, which is hashed the same way as a key revocation.
+func (pubkey *Pubkey) verifyDirectKeySelfSig(sig *Signature) (err error) {
+	if !Config().VerifySigs() {
+		return nil
+	}
+	return pubkey.checkDirectKeySelfSig(sig)
+}
+
+// checkDirectKeySelfSig verifies a direct-key self-signature, regardless of
+// the configured signature verification policy.
+func (pubkey *Pubkey) checkDirectKeySelfSig(sig *Signature) (err error) {
+	defer func() { flagSigState(sig, err) }()
+	if pubkey.PublicKey == nil {
+		return ErrPacketRecordState
+	}
+	if sig.Signature == nil {
+		return ErrInvalidPacketType
+	}
+	return pubkey.PublicKey.VerifyRevocationSignature(sig.Signature)
+}
+
+// checkDesignatedRevocation verifies a revocation of the key made by the
+// revoker's key, regardless of the configured signature verification policy.
+// Like a self-revocation, it is made over the revoked key alone.
+func (pubkey *Pubkey) checkDesignatedRevocation(revoker *Pubkey, sig *Signature) (err error) {
+	defer func() { flagSigState(sig, err) }()
+	if pubkey.PublicKey == nil || revoker.PublicKey == nil {
+		return ErrPacketRecordState
+	}
+	if sig.Signature == nil {
+		return ErrInvalidPacketType
+	}
+	if !sig.Signature.Hash.Available() {
+		return errors.UnsupportedError("hash function")
+	}
+	var prefix, body bytes.Buffer
+	pubkey.PublicKey.SerializeSignaturePrefix(&prefix)
+	if err = pubkey.PublicKey.Serialize(&body); err != nil {
+		return
+	}
+	// The key is hashed with the prefix in place of its packet header.
+	n := int(prefix.Bytes()[1])<<8 | int(prefix.Bytes()[2])
+	h := sig.Signature.Hash.New()
+	h.Write(prefix.Bytes())
+	h.Write(body.Bytes()[body.Len()-n:])
+	return revoker.PublicKey.VerifySignature(h, sig.Signature)
+}
+
 func (pubkey *Pubkey) verifyUserIdSelfSig(uid *UserId, sig *Signature) (err error) {
 	if !Config().VerifySigs() {
 		return nil
 	}
+	return pubkey.checkUserIdSelfSig(uid, sig)
+}
+
+// checkUserIdSelfSig verifies a user ID self-signature, regardless of the
+// configured signature verification policy.
+func (pubkey *Pubkey) checkUserIdSelfSig(uid *UserId, sig *Signature) (err error) {
+	defer func() { flagSigState(sig, err) }()
+	return pubkey.userIdSelfSigError(uid, sig)
+}
+
+// userIdSelfSigError verifies a user ID self-signature without recording the
+// outcome in its state.
+func (pubkey *Pubkey) userIdSelfSigError(uid *UserId, sig *Signature) (err error) {
 	if uid.UserId == nil {
 		return ErrPacketRecordState
 	}
 	if pubkey.PublicKey != nil {
 		if sig.Signature != nil {
 			err = pubkey.PublicKey.VerifyUserIdSignature(uid.UserId.Id, pubkey.PublicKey, sig.Signature)
-			if err == nil {
-				sig.State |= PacketStateSigOk
-			}
 			return
 		} else if sig.SignatureV3 != nil {
 			err = pubkey.PublicKey.VerifyUserIdSignatureV3(uid.UserId.Id, pubkey.PublicKey, sig.SignatureV3)
-			if err == nil {
-				sig.State |= PacketStateSigOk
-			}
 			return
 		} else {
 			return ErrInvalidPacketType
@@ -382,6 +799,7 @@ func (pubkey *Pubkey) verifyUserAttrSelfSig(uat *UserAttribute, sig *Signature)
 	if !Config().VerifySigs() {
 		return nil
 	}
+	defer func() { flagSigState(sig, err) }()
 	if uat.UserAttribute == nil {
 		return ErrPacketRecordState
 	}
@@ -443,3 +861,368 @@ func (pubkey *Pubkey) AppendUnsupported(opkt *packet.OpaquePacket) {
 	opkt.Serialize(&buf)
 	pubkey.Unsupported = append(pubkey.Unsupported, buf.Bytes()...)
 }
+
+// IssuerKeyIds returns the distinct key IDs of all other keys which
+// have signed any part of this key's material, in the order first seen.
+func (pubkey *Pubkey) IssuerKeyIds() (result []string) {
+	seen := make(map[string]bool)
+	pubkey.Visit(func(rec PacketRecord) error {
+		sig, is := rec.(*Signature)
+		if !is || sig.RIssuerKeyId == "" || strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) {
+			return nil
+		}
+		if keyId := NormalizeIssuer(sig.IssuerKeyId()); keyId != "" && !seen[keyId] {
+			seen[keyId] = true
+			result = append(result, keyId)
+		}
+		return nil
+	})
+	return
+}
+
+// DirectKeySignature returns the most recent unexpired direct-key
+// self-signature, which carries key-wide preferences and designated revokers,
+// or nil if the key has none.
+func (pubkey *Pubkey) DirectKeySignature() *Signature {
+	var result *Signature
+	for _, sig := range pubkey.directKeySignatures() {
+		if result == nil || sig.Creation.After(result.Creation) {
+			result = sig
+		}
+	}
+	return result
+}
+
+// directKeySignatures returns the unexpired direct-key self-signatures that
+// verify. GnuPG adds a separate one for each designated revoker.
+func (pubkey *Pubkey) directKeySignatures() (result []*Signature) {
+	now := time.Now()
+	for _, sig := range pubkey.signatures {
+		if sig.SigType != SigTypeDirectKey || sig.State&PacketStateSigBad != 0 ||
+			!strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) || sig.IsExpired(now) {
+			continue
+		}
+		if err := pubkey.verifyDirectKeySelfSig(sig); err == nil {
+			result = append(result, sig)
+		}
+	}
+	return
+}
+
+// DesignatedRevokers returns the hex fingerprints of the keys authorized to
+// revoke this key, from the revocation key subpackets of its direct-key
+// signatures. Only direct-key signatures that verify authorize a revoker,
+// whether or not signatures are verified otherwise. Empty if there are none.
+func (pubkey *Pubkey) DesignatedRevokers() []string {
+	result := []string{}
+	seen := make(map[string]bool)
+	for _, sig := range pubkey.directKeySignatures() {
+		if pubkey.checkDirectKeySelfSig(sig) != nil {
+			continue
+		}
+		for _, fpr := range sig.revocationKeys() {
+			if !seen[fpr] {
+				seen[fpr] = true
+				result = append(result, fpr)
+			}
+		}
+	}
+	return result
+}
+
+// selfSignature returns the self-signature of the primary user ID, which
+// carries the key's preferences.
+func (pubkey *Pubkey) selfSignature() *Signature {
+	if pubkey.primaryUidSig != nil {
+		return pubkey.primaryUidSig
+	}
+	if uid := pubkey.PrimaryUserId(); uid != nil {
+		return uid.selfSignature
+	}
+	return nil
+}
+
+// preferences returns the contents of the given preference subpacket from
+// the primary user ID self-signature, falling back to the direct-key
+// signature for preferences not stated there.
+func (pubkey *Pubkey) preferences(spType byte) []uint8 {
+	if sig := pubkey.selfSignature(); sig != nil {
+		if prefs := sig.hashedSubpacket(spType); prefs != nil {
+			return prefs
+		}
+	}
+	if sig := pubkey.DirectKeySignature(); sig != nil {
+		return sig.hashedSubpacket(spType)
+	}
+	return nil
+}
+
+// PreferredSymmetric returns the symmetric cipher algorithm IDs preferred
+// by the key owner, in order of preference. Empty if none are declared.
+func (pubkey *Pubkey) PreferredSymmetric() []uint8 {
+	return pubkey.preferences(11) // Preferred symmetric algorithms
+}
+
+// PreferredHash returns the hash algorithm IDs preferred by the key owner,
+// in order of preference. Empty if none are declared.
+func (pubkey *Pubkey) PreferredHash() []uint8 {
+	return pubkey.preferences(21) // Preferred hash algorithms
+}
+
+// PreferredCompression returns the compression algorithm IDs preferred by
+// the key owner, in order of preference. Empty if none are declared.
+func (pubkey *Pubkey) PreferredCompression() []uint8 {
+	return pubkey.preferences(22) // Preferred compression algorithms
+}
+
+// AlgorithmUnknown is the PartitionByAlgorithm key for public keys whose
+// algorithm cannot be determined.
+const AlgorithmUnknown = -1
+
+// PartitionByAlgorithm groups keys by their public key algorithm ID. Keys in
+// an unsupported format, which have no Algorithm, are grouped by the
+// algorithm stated in their public key packet, or under AlgorithmUnknown if
+// it cannot be read. Keys keep their relative order within each group.
+func PartitionByAlgorithm(keys []*Pubkey) map[int][]*Pubkey {
+	result := make(map[int][]*Pubkey)
+	for _, key := range keys {
+		algorithm := key.Algorithm
+		if algorithm == 0 {
+			var ok bool
+			if algorithm, _, ok = keyAlgorithm(key.Packet); !ok {
+				algorithm = AlgorithmUnknown
+			}
+		}
+		result[algorithm] = append(result[algorithm], key)
+	}
+	return result
+}
+
+// Public key algorithm IDs not defined by the packet library.
+const (
+	pubKeyAlgoEdDSA   = 22
+	pubKeyAlgoX25519  = 25
+	pubKeyAlgoX448    = 26
+	pubKeyAlgoEd25519 = 27
+	pubKeyAlgoEd448   = 28
+)
+
+// Names of the RFC 9580 algorithms whose keys are a fixed size, without a
+// curve OID.
+var nativeCurveAlgorithms = map[int]string{
+	pubKeyAlgoX25519:  "X25519",
+	pubKeyAlgoX448:    "X448",
+	pubKeyAlgoEd25519: "Ed25519",
+	pubKeyAlgoEd448:   "Ed448",
+}
+
+// curveNames maps the hex-encoded OIDs of elliptic curves used in OpenPGP
+// public keys to their common names.
+var curveNames = map[string]string{
+	"2a8648ce3d030107":     "NIST P-256",
+	"2b81040022":           "NIST P-384",
+	"2b81040023":           "NIST P-521",
+	"2b2403030208010107":   "brainpoolP256r1",
+	"2b240303020801010b":   "brainpoolP384r1",
+	"2b240303020801010d":   "brainpoolP512r1",
+	"2b06010401da470f01":   "Ed25519",
+	"2b060104019755010501": "Curve25519",
+}
+
+// keyAlgorithm returns the public key algorithm and, for elliptic curve keys,
+// the curve OID stated in the public key packet contents.
+func keyAlgorithm(buf []byte) (algorithm int, oid []byte, ok bool) {
+	op, err := toOpaquePacket(buf)
+	if err != nil {
+		return 0, nil, false
+	}
+	c := op.Contents
+	var i int
+	switch {
+	case len(c) > 5 && c[0] >= 4 && c[0] <= 6:
+		i = 5 // version, creation time
+	case len(c) > 7 && (c[0] == 2 || c[0] == 3):
+		i = 7 // version, creation time, validity period
+	default:
+		return 0, nil, false
+	}
+	algorithm = int(c[i])
+	switch algorithm {
+	case int(packet.PubKeyAlgoECDH), int(packet.PubKeyAlgoECDSA), pubKeyAlgoEdDSA:
+		if c[0] >= 5 {
+			i += 4 // four-octet key material length
+		}
+		if len(c) > i+1 {
+			n := int(c[i+1])
+			if len(c) >= i+2+n {
+				oid = c[i+2 : i+2+n]
+			}
+		}
+	}
+	return algorithm, oid, true
+}
+
+// AlgorithmDescription returns a human-readable description of the primary
+// key's algorithm, such as "RSA 4096", "DSA 1024", "Ed25519" or
+// "NIST P-256 (ECDSA)". Returns "unknown" if the algorithm or curve is not
+// recognized.
+func (pubkey *Pubkey) AlgorithmDescription() string {
+	algorithm, oid, ok := keyAlgorithm(pubkey.Packet)
+	if !ok {
+		algorithm = pubkey.Algorithm
+	}
+	switch algorithm {
+	case int(packet.PubKeyAlgoRSA), int(packet.PubKeyAlgoRSAEncryptOnly), int(packet.PubKeyAlgoRSASignOnly):
+		return fmt.Sprintf("RSA %d", pubkey.BitLen)
+	case int(packet.PubKeyAlgoDSA):
+		return fmt.Sprintf("DSA %d", pubkey.BitLen)
+	case int(packet.PubKeyAlgoElGamal):
+		return fmt.Sprintf("ElGamal %d", pubkey.BitLen)
+	}
+	if name, native := nativeCurveAlgorithms[algorithm]; native {
+		return name
+	}
+	curve, known := curveNames[hex.EncodeToString(oid)]
+	if !known {
+		return "unknown"
+	}
+	switch algorithm {
+	case int(packet.PubKeyAlgoECDSA):
+		return curve + " (ECDSA)"
+	case int(packet.PubKeyAlgoECDH):
+		return curve + " (ECDH)"
+	case pubKeyAlgoEdDSA:
+		return curve
+	}
+	return "unknown"
+}
+
+// minKeyBits is the smallest RSA or DSA key size not reported as weak.
+const minKeyBits = 2048
+
+// WeaknessReport returns human-readable findings for a security audit of
+// the key: an RSA or DSA key shorter than 2048 bits, a self-signature made
+// with a weak hash such as SHA-1, or a fingerprint found in
+// weakFingerprints, such as the list of Debian weak keys. weakFingerprints
+// is keyed by lower-case hex fingerprint and may be nil. Returns nil if no
+// weaknesses are found.
+func (pubkey *Pubkey) WeaknessReport(weakFingerprints map[string]bool) (result []string) {
+	switch pubkey.Algorithm {
+	case int(packet.PubKeyAlgoRSA), int(packet.PubKeyAlgoRSAEncryptOnly), int(packet.PubKeyAlgoRSASignOnly),
+		int(packet.PubKeyAlgoDSA):
+		if pubkey.BitLen < minKeyBits {
+			result = append(result, fmt.Sprintf("%s key is shorter than %d bits",
+				pubkey.AlgorithmDescription(), minKeyBits))
+		}
+	}
+	if weakFingerprints[strings.ToLower(pubkey.Fingerprint())] {
+		result = append(result, "fingerprint is a known weak key")
+	}
+	if sig := pubkey.selfSignature(); sig != nil {
+		switch sig.HashAlgo {
+		case HashAlgoMD5, HashAlgoSHA1:
+			result = append(result, fmt.Sprintf("self-signature uses the weak %s hash",
+				sig.HashAlgorithmName()))
+		}
+	}
+	return
+}
+
+// NoModify returns whether the key owner has asked keyservers, with the
+// "no-modify" keyserver preference, to accept changes to the key only from
+// the owner. Returns false if no keyserver preferences are declared.
+func (pubkey *Pubkey) NoModify() bool {
+	prefs := pubkey.preferences(23) // Key server preferences
+	return len(prefs) > 0 && prefs[0]&0x80 != 0
+}
+
+// Feature flags declared in the features subpacket of a self-signature.
+const (
+	// FeatureMDC indicates support for modification detection (SEIPD).
+	FeatureMDC = 0x01
+	// FeatureAEAD indicates support for AEAD encrypted data packets.
+	FeatureAEAD = 0x02
+)
+
+// Features returns the feature flags declared in the key's self-signature,
+// such as FeatureMDC and FeatureAEAD. The second value is false if no
+// features are declared, in which case the key should be treated as
+// supporting only legacy encryption.
+func (pubkey *Pubkey) Features() (byte, bool) {
+	if features := pubkey.preferences(30); len(features) > 0 { // Features
+		return features[0], true
+	}
+	return 0, false
+}
+
+// Key usage flag for authentication, which the packet library does not define.
+const keyFlagAuthenticate = 0x20
+
+// KeyFlags returns the key usage flags declared for the primary key in its
+// self-signature, or zero if none are declared.
+func (pubkey *Pubkey) KeyFlags() byte {
+	if flags := pubkey.preferences(27); len(flags) > 0 { // Key flags
+		return flags[0]
+	}
+	return 0
+}
+
+// Capabilities summarizes the usage of the key as GnuPG does, with the
+// letters S (sign), C (certify), E (encrypt) and A (authenticate) in
+// brackets for the primary key, followed by the combined usage of its valid
+// subkeys if they have any, such as "[SC] [E]".
+func (pubkey *Pubkey) Capabilities() string {
+	result := "[" + usageLetters(pubkey.KeyFlags()) + "]"
+	var subkeyFlags byte
+	now := time.Now()
+	for _, subkey := range pubkey.subkeys {
+		if subkey.bindingSig != nil && !subkey.IsRevoked() && !subkey.IsExpired(now) {
+			subkeyFlags |= subkey.Flags()
+		}
+	}
+	if usage := usageLetters(subkeyFlags); usage != "" {
+		result += " [" + usage + "]"
+	}
+	return result
+}
+
+// CanEncrypt returns whether messages can be encrypted to the key at the
+// given time: the key must be neither revoked nor expired, and either the
+// primary key or one of its bound subkeys that is neither revoked nor expired
+// must declare an encryption usage flag. Keys that declare no usage flags
+// are not assumed to be able to encrypt.
+func (pubkey *Pubkey) CanEncrypt(now time.Time) bool {
+	const encryptFlags = packet.KeyFlagEncryptCommunications | packet.KeyFlagEncryptStorage
+	switch pubkey.EffectiveStatus(now) {
+	case StatusRevoked, StatusExpired, StatusGrace:
+		return false
+	}
+	if pubkey.KeyFlags()&encryptFlags != 0 {
+		return true
+	}
+	for _, subkey := range pubkey.subkeys {
+		if subkey.bindingSig != nil && !subkey.IsRevoked() && !subkey.IsExpired(now) &&
+			subkey.Flags()&encryptFlags != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// usageLetters returns the GnuPG usage letters for the given key flags.
+func usageLetters(flags byte) string {
+	var usage string
+	if flags&packet.KeyFlagSign != 0 {
+		usage += "S"
+	}
+	if flags&packet.KeyFlagCertify != 0 {
+		usage += "C"
+	}
+	if flags&(packet.KeyFlagEncryptCommunications|packet.KeyFlagEncryptStorage) != 0 {
+		usage += "E"
+	}
+	if flags&keyFlagAuthenticate != 0 {
+		usage += "A"
+	}
+	return usage
+}
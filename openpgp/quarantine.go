@@ -0,0 +1,140 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	quarantinePathKey     = "hockeypuck.openpgp.quarantinePath"
+	quarantineMaxFilesKey = "hockeypuck.openpgp.quarantineMaxFiles"
+)
+
+// QuarantinePath returns the directory where rejected keys are saved for
+// later inspection. When empty, rejected keys are discarded.
+func (s *Settings) QuarantinePath() string {
+	return s.GetString(quarantinePathKey)
+}
+
+// QuarantineMaxFiles returns the most files kept in the quarantine directory.
+// Once it holds this many, further rejected keys are discarded until some are
+// removed. 0 disables the limit.
+func (s *Settings) QuarantineMaxFiles() int {
+	return s.GetIntDefault(quarantineMaxFilesKey, 1000)
+}
+
+// validateQuarantine checks that the quarantine directory, if configured,
+// exists and is writable.
+func (s *Settings) validateQuarantine() error {
+	if s.QuarantineMaxFiles() < 0 {
+		return fmt.Errorf("%s must not be negative", quarantineMaxFilesKey)
+	}
+	dir := s.QuarantinePath()
+	if dir == "" {
+		return nil
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %v", quarantinePathKey, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: %s is not a directory", quarantinePathKey, dir)
+	}
+	f, err := ioutil.TempFile(dir, ".check-")
+	if err != nil {
+		return fmt.Errorf("%s: %v", quarantinePathKey, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// Quarantine saves the packets of a rejected key to the quarantine
+// directory, if configured. Each key is written to its own file as an
+// ASCII-armored block, with the reason for rejection in a "Comment" header.
+// The fingerprint names the file when known. No more than QuarantineMaxFiles
+// files are kept. This is best-effort: failures are logged and otherwise
+// ignored, so that they do not interrupt ingest.
+func Quarantine(packets []byte, fingerprint string, reason error) {
+	dir := Config().QuarantinePath()
+	if dir == "" {
+		return
+	}
+	if fingerprint == "" {
+		fingerprint = "unknown"
+	}
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+	if max := Config().QuarantineMaxFiles(); max > 0 {
+		if n, err := countFiles(dir); err != nil {
+			log.Println("Failed to quarantine key:", err)
+			return
+		} else if n >= max {
+			log.Printf("Quarantine %s is full, discarding rejected key %s", dir, fingerprint)
+			return
+		}
+	}
+	comment := strings.Replace(fmt.Sprintf("Rejected: %v", reason), "\n", " ", -1)
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("rejected-%s-", fingerprint))
+	if err != nil {
+		log.Println("Failed to quarantine key:", err)
+		return
+	}
+	defer f.Close()
+	err = writeArmoredBlock(f, packets, &ArmorOptions{
+		Headers: map[string]string{"Comment": comment}})
+	if err != nil {
+		log.Println("Failed to quarantine key:", err)
+	}
+}
+
+// quarantineLock serializes writes to the quarantine directory, so that
+// concurrent rejections cannot exceed its limit.
+var quarantineLock sync.Mutex
+
+// countFiles returns the number of entries in the directory.
+func countFiles(dir string) (int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	return len(names), err
+}
+
+// QuarantineKey saves a parsed key rejected for the given reason, as
+// described for Quarantine.
+func QuarantineKey(pubkey *Pubkey, reason error) {
+	if Config().QuarantinePath() == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err := WritePackets(&buf, pubkey); err != nil {
+		log.Println("Failed to quarantine key:", err)
+		return
+	}
+	Quarantine(buf.Bytes(), pubkey.Fingerprint(), reason)
+}
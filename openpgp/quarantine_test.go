@@ -0,0 +1,152 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+func setQuarantinePath(dir string) {
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+quarantinePath=%q
+`, dir))
+}
+
+func TestValidateQuarantine(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+
+	setQuarantinePath(dir)
+	assert.Nil(t, Config().Validate())
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	setQuarantinePath(filepath.Join(dir, "missing"))
+	assert.NotNil(t, Config().Validate())
+
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, nil, 0644))
+	setQuarantinePath(file)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestQuarantineKey(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := MustInputAscKey(t, "sksdigest.asc")
+
+	// Nothing is saved unless configured.
+	hockeypuck.SetConfig("")
+	QuarantineKey(key, ErrTooManyUserIds)
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	setQuarantinePath(dir)
+	QuarantineKey(key, ErrTooManyUserIds)
+	Quarantine([]byte("not a key"), "", ErrSecretKeyRejected)
+	files, err = ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	if !assert.Equal(t, 2, len(files)) {
+		return
+	}
+	for _, fi := range files {
+		f, err := os.Open(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		block, err := armor.Decode(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(block.Body)
+		assert.Nil(t, err)
+		if strings.HasPrefix(fi.Name(), "rejected-unknown-") {
+			assert.Equal(t, "Rejected: "+ErrSecretKeyRejected.Error(), block.Header["Comment"])
+			assert.Equal(t, []byte("not a key"), data)
+			continue
+		}
+		assert.True(t, strings.HasPrefix(fi.Name(), "rejected-"+key.Fingerprint()+"-"))
+		assert.Equal(t, "Rejected: "+ErrTooManyUserIds.Error(), block.Header["Comment"])
+		var keys []*Pubkey
+		for keyRead := range ReadKeys(bytes.NewBuffer(data)) {
+			assert.Nil(t, keyRead.Error)
+			keys = append(keys, keyRead.Pubkey)
+		}
+		if assert.Equal(t, 1, len(keys)) {
+			assert.Equal(t, key.Md5, keys[0].Md5)
+		}
+	}
+
+	// Failures to save are not fatal.
+	setQuarantinePath(filepath.Join(dir, "missing"))
+	QuarantineKey(key, ErrTooManyUserIds)
+}
+
+func TestQuarantineMaxFiles(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+quarantinePath=%q
+quarantineMaxFiles=2
+`, dir))
+	assert.Nil(t, Config().Validate())
+	for i := 0; i < 3; i++ {
+		Quarantine([]byte("not a key"), "", ErrSecretKeyRejected)
+	}
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+quarantineMaxFiles=-1
+`)
+	assert.NotNil(t, Config().Validate())
+}
@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -58,12 +59,168 @@ type RecoverKey struct {
 	response hkp.ResponseChan
 }
 
+const (
+	reconGossipIntervalKey = "hockeypuck.conflux.recon.gossipInterval"
+	reconMaxOutstandingKey = "hockeypuck.conflux.recon.maxOutstanding"
+	reconDigestKey         = "hockeypuck.conflux.recon.digest"
+	reconExcludeSigsKey    = "hockeypuck.conflux.recon.excludeSigs"
+	reconReadOnlyPullKey   = "hockeypuck.conflux.recon.readOnlyPull"
+
+	confluxGossipIntervalKey = "conflux.recon.gossipIntervalSecs"
+	confluxMaxOutstandingKey = "conflux.recon.maxOutstandingReconRequests"
+)
+
+// GossipInterval is the time to wait between gossip attempts with recon
+// partners, given as a duration such as "60s" or "5m".
+func (s *Settings) GossipInterval() (time.Duration, error) {
+	return time.ParseDuration(s.GetStringDefault(reconGossipIntervalKey, "60s"))
+}
+
+// MaxOutstanding is the maximum number of recon requests that may be
+// outstanding at once.
+func (s *Settings) MaxOutstanding() int {
+	return s.GetIntDefault(reconMaxOutstandingKey, 100)
+}
+
+// ReconDigest is the key digest algorithm identifying keys in the prefix
+// tree, either "md5" for SKS compatibility or "sha256". All peers in a
+// cluster must use the same digest in order to reconcile.
+func (s *Settings) ReconDigest() string {
+	return strings.ToLower(s.GetStringDefault(reconDigestKey, "md5"))
+}
+
+// ReconDigestExpr returns the SQL expression selecting the recon digest
+// of keys in the openpgp_pubkey table.
+func (s *Settings) ReconDigestExpr() string {
+	if s.ReconDigest() == "sha256" {
+		return "substr(sha256, 1, 32)"
+	}
+	return "md5"
+}
+
+// ExcludeSigs returns the number of signatures on a single user ID, or on
+// the primary key or subkeys, above which a key is considered poisoned and
+// automatically excluded from the prefix tree. Zero disables the exclusion.
+func (s *Settings) ExcludeSigs() int {
+	return s.GetIntDefault(reconExcludeSigsKey, 0)
+}
+
+// ReconPull returns whether keys recovered from recon peers are merged into
+// the database. A read-only mirror still pulls from its peers unless
+// readOnlyPull is set to false.
+func (s *Settings) ReconPull() bool {
+	if !s.ReadOnly() || s.Get(reconReadOnlyPullKey) == nil {
+		return true
+	}
+	return s.GetBool(reconReadOnlyPullKey)
+}
+
+// ExcludeFromRecon keeps the key out of the prefix tree. The key is still
+// stored and served, but is no longer reconciled with peers, so changes to
+// it do not propagate from this server. The key's state must be saved for
+// the exclusion to take effect.
+func (pubkey *Pubkey) ExcludeFromRecon() {
+	if !pubkey.IsReconExcluded() {
+		pubkey.State |= PacketStateNoRecon
+		pubkey.touch()
+	}
+}
+
+// IsReconExcluded returns whether the key is kept out of the prefix tree.
+func (pubkey *Pubkey) IsReconExcluded() bool {
+	return pubkey.State&PacketStateNoRecon != 0
+}
+
+// ApplyReconExclusion excludes the key from the prefix tree if it is
+// poisoned with more signatures than allowed by the configuration.
+func ApplyReconExclusion(pubkey *Pubkey) {
+	limit := Config().ExcludeSigs()
+	if limit <= 0 {
+		return
+	}
+	for _, n := range pubkey.SignatureCounts() {
+		if n > limit {
+			pubkey.ExcludeFromRecon()
+			return
+		}
+	}
+}
+
+// ReconIncludedExpr returns the SQL condition selecting keys in the
+// openpgp_pubkey table that are part of the prefix tree.
+func ReconIncludedExpr() string {
+	return fmt.Sprintf("state & %d = 0", PacketStateNoRecon)
+}
+
+// reconDigest returns the recon digest from the given key digests. SHA-256
+// digests are truncated to 128 bits, the size of an SKS prefix tree element.
+func reconDigest(md5, sha256 string) string {
+	if Config().ReconDigest() == "sha256" {
+		if len(sha256) > 32 {
+			return sha256[:32]
+		}
+		return sha256
+	}
+	return md5
+}
+
+// ReconDigest returns the hex digest identifying the key in the prefix tree.
+func (pubkey *Pubkey) ReconDigest() string {
+	return reconDigest(pubkey.Md5, pubkey.Sha256)
+}
+
+// validateRecon checks the recon tuning settings. A setting given both as a
+// Hockeypuck alias and directly as a conflux.recon setting must agree.
+func (s *Settings) validateRecon() error {
+	interval, err := s.GossipInterval()
+	if err != nil {
+		return fmt.Errorf("%s: %v", reconGossipIntervalKey, err)
+	}
+	if interval < time.Second {
+		return fmt.Errorf("%s must be at least 1s", reconGossipIntervalKey)
+	}
+	if digest := s.ReconDigest(); digest != "md5" && digest != "sha256" {
+		return fmt.Errorf("%s: unknown digest %q", reconDigestKey, digest)
+	}
+	if s.ExcludeSigs() < 0 {
+		return fmt.Errorf("%s must not be negative", reconExcludeSigsKey)
+	}
+	if s.MaxOutstanding() < 1 {
+		return fmt.Errorf("%s must be greater than zero", reconMaxOutstandingKey)
+	}
+	if s.Get(reconGossipIntervalKey) != nil && s.Get(confluxGossipIntervalKey) != nil &&
+		s.GetIntDefault(confluxGossipIntervalKey, 0) != int(interval/time.Second) {
+		return fmt.Errorf("%s conflicts with %s", reconGossipIntervalKey, confluxGossipIntervalKey)
+	}
+	if s.Get(reconMaxOutstandingKey) != nil && s.Get(confluxMaxOutstandingKey) != nil &&
+		s.GetIntDefault(confluxMaxOutstandingKey, 0) != s.MaxOutstanding() {
+		return fmt.Errorf("%s conflicts with %s", reconMaxOutstandingKey, confluxMaxOutstandingKey)
+	}
+	return nil
+}
+
+// resolveRecon maps the Hockeypuck recon tuning settings onto the
+// underlying conflux.recon settings. Settings made directly in
+// conflux.recon are left as they are, as validateRecon has checked that
+// they agree.
+func (s *Settings) resolveRecon() {
+	if s.Get(confluxGossipIntervalKey) == nil {
+		if interval, err := s.GossipInterval(); err == nil {
+			s.Set(confluxGossipIntervalKey, int64(interval/time.Second))
+		}
+	}
+	if s.Get(confluxMaxOutstandingKey) == nil {
+		s.Set(confluxMaxOutstandingKey, int64(s.MaxOutstanding()))
+	}
+}
+
 func NewSksPTree(reconSettings *recon.Settings) (recon.PrefixTree, error) {
 	treeSettings := leveldb.NewSettings(reconSettings)
 	return leveldb.New(treeSettings)
 }
 
 func NewSksPeer(s *hkp.Service) (*SksPeer, error) {
+	Config().resolveRecon()
 	reconSettings := recon.NewSettings(Config().Settings.TomlTree)
 	ptree, err := NewSksPTree(reconSettings)
 	if err != nil {
@@ -111,6 +268,48 @@ func DigestZp(digest string) (*Zp, error) {
 	return Zb(P_SKS, buf), nil
 }
 
+// Md5Digest returns the SKS MD5 digest of the key material as bytes,
+// or nil if the digest has not been calculated.
+func (pubkey *Pubkey) Md5Digest() []byte {
+	buf, err := hex.DecodeString(pubkey.Md5)
+	if err != nil || len(buf) == 0 {
+		return nil
+	}
+	return buf
+}
+
+// ReconDigestBytes returns the digest identifying the key in the prefix tree
+// as bytes, or nil if the digest has not been calculated.
+func (pubkey *Pubkey) ReconDigestBytes() []byte {
+	buf, err := hex.DecodeString(pubkey.ReconDigest())
+	if err != nil || len(buf) == 0 {
+		return nil
+	}
+	return buf
+}
+
+// DigestInRange returns whether the key's recon digest falls in the range
+// [low, high). A nil low or high leaves that end of the range open.
+func DigestInRange(pubkey *Pubkey, low, high []byte) bool {
+	digest := pubkey.ReconDigestBytes()
+	if digest == nil {
+		return false
+	}
+	return (low == nil || bytes.Compare(digest, low) >= 0) &&
+		(high == nil || bytes.Compare(digest, high) < 0)
+}
+
+// PubkeysByDigest sorts public keys by their recon digest.
+type PubkeysByDigest []*Pubkey
+
+func (p PubkeysByDigest) Len() int { return len(p) }
+
+func (p PubkeysByDigest) Less(i, j int) bool {
+	return bytes.Compare(p[i].ReconDigestBytes(), p[j].ReconDigestBytes()) < 0
+}
+
+func (p PubkeysByDigest) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
 func (r *SksPeer) HandleKeyUpdates() {
 	for {
 		select {
@@ -118,22 +317,34 @@ func (r *SksPeer) HandleKeyUpdates() {
 			if !ok {
 				return
 			}
-			digestZp, err := DigestZp(keyChange.CurrentMd5)
+			currentDigest := reconDigest(keyChange.CurrentMd5, keyChange.CurrentSha256)
+			previousDigest := reconDigest(keyChange.PreviousMd5, keyChange.PreviousSha256)
+			if keyChange.ReconExcluded {
+				// Take the key out of the prefix tree, in case it was in it.
+				for _, digest := range []string{previousDigest, currentDigest} {
+					if digestZp, err := DigestZp(digest); digest != "" && err == nil {
+						log.Println("Prefix tree: Remove excluded:", digestZp)
+						r.Peer.Remove(digestZp)
+					}
+				}
+				continue
+			}
+			digestZp, err := DigestZp(currentDigest)
 			if err != nil {
-				log.Println("bad digest:", keyChange.CurrentMd5)
+				log.Println("bad digest:", currentDigest)
 				continue
 			}
-			log.Println("Prefix tree: Insert:", hex.EncodeToString(digestZp.Bytes()), keyChange, keyChange.CurrentMd5)
+			log.Println("Prefix tree: Insert:", hex.EncodeToString(digestZp.Bytes()), keyChange, currentDigest)
 			err = r.Peer.Insert(digestZp)
 			if err != nil {
 				log.Println(err)
 			} else {
 				delete(r.recoverAttempts, digestZp.String())
 			}
-			if keyChange.PreviousMd5 != "" && keyChange.PreviousMd5 != keyChange.CurrentMd5 {
-				prevDigestZp, err := DigestZp(keyChange.PreviousMd5)
+			if previousDigest != "" && previousDigest != currentDigest {
+				prevDigestZp, err := DigestZp(previousDigest)
 				if err != nil {
-					log.Println("bad digest:", keyChange.PreviousMd5)
+					log.Println("bad digest:", previousDigest)
 					continue
 				}
 				log.Println("Prefix Tree: Remove:", prevDigestZp)
@@ -159,6 +370,9 @@ func (r *SksPeer) HandleRecovery() {
 			if !ok {
 				return
 			}
+			if !Config().ReconPull() {
+				continue
+			}
 			// Use remote HKP host:port as peer-unique identifier
 			remoteAddr, err := rcvr.HkpAddr()
 			if err != nil {
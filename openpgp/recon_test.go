@@ -0,0 +1,191 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"encoding/hex"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestDigestInRange(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	digest := mustDecodeHex(t, SKS_DIGEST__REFERENCE)
+	assert.Equal(t, digest, key.Md5Digest())
+
+	assert.True(t, DigestInRange(key, nil, nil))
+	// Low bound is inclusive, high bound is exclusive.
+	assert.True(t, DigestInRange(key, digest, nil))
+	assert.False(t, DigestInRange(key, nil, digest))
+	assert.True(t, DigestInRange(key, mustDecodeHex(t, "da"), mustDecodeHex(t, "db")))
+	assert.False(t, DigestInRange(key, mustDecodeHex(t, "db"), nil))
+	assert.False(t, DigestInRange(key, nil, mustDecodeHex(t, "da")))
+	assert.True(t, DigestInRange(key, mustDecodeHex(t, "da84f40d830a7be2a3c0b7f2e146bfa9"),
+		mustDecodeHex(t, "da84f40d830a7be2a3c0b7f2e146bfab")))
+
+	assert.False(t, DigestInRange(&Pubkey{}, nil, nil))
+
+	// With SHA-256 recon digests, the truncated SHA-256 digest is used.
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+digest="sha256"
+`)
+	sha256 := mustDecodeHex(t, key.Sha256[:32])
+	assert.Equal(t, sha256, key.ReconDigestBytes())
+	assert.True(t, DigestInRange(key, sha256, nil))
+	assert.False(t, DigestInRange(key, nil, sha256))
+}
+
+func TestPubkeysByDigest(t *testing.T) {
+	keys := PubkeysByDigest{
+		MustInputAscKey(t, "sksdigest.asc"),
+		MustInputAscKey(t, "alice_signed.asc"),
+		MustInputAscKey(t, "uat.asc"),
+	}
+	sort.Sort(keys)
+	for i := 1; i < len(keys); i++ {
+		assert.True(t, keys[i-1].Md5 < keys[i].Md5)
+	}
+
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+digest="sha256"
+`)
+	sort.Sort(keys)
+	for i := 1; i < len(keys); i++ {
+		assert.True(t, keys[i-1].Sha256 < keys[i].Sha256)
+	}
+}
+
+func TestReconSettings(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+	Config().resolveRecon()
+	assert.Equal(t, 60, Config().GetIntDefault(confluxGossipIntervalKey, 0))
+	assert.Equal(t, 100, Config().GetIntDefault(confluxMaxOutstandingKey, 0))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+gossipInterval="5m"
+maxOutstanding=10
+`)
+	assert.Nil(t, Config().Validate())
+	Config().resolveRecon()
+	assert.Equal(t, 300, Config().GetIntDefault(confluxGossipIntervalKey, 0))
+	assert.Equal(t, 10, Config().GetIntDefault(confluxMaxOutstandingKey, 0))
+
+	// Settings made directly in conflux.recon take precedence.
+	hockeypuck.SetConfig(`
+[conflux.recon]
+gossipIntervalSecs=30
+`)
+	Config().resolveRecon()
+	assert.Equal(t, 30, Config().GetIntDefault(confluxGossipIntervalKey, 0))
+
+	for _, conf := range []string{`
+[hockeypuck.conflux.recon]
+gossipInterval="soon"
+`, `
+[hockeypuck.conflux.recon]
+gossipInterval="10ms"
+`, `
+[hockeypuck.conflux.recon]
+maxOutstanding=0
+`, `
+[hockeypuck.conflux.recon]
+gossipInterval="60s"
+[conflux.recon]
+gossipIntervalSecs=30
+`} {
+		hockeypuck.SetConfig(conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
+
+func TestReconDigest(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "sksdigest.asc")
+
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, "md5", Config().ReconDigest())
+	assert.Equal(t, key.Md5, key.ReconDigest())
+	assert.Equal(t, "md5", Config().ReconDigestExpr())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+digest="SHA256"
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, key.Sha256[:32], key.ReconDigest())
+	assert.Equal(t, "substr(sha256, 1, 32)", Config().ReconDigestExpr())
+	// Truncated to the size of an SKS prefix tree element.
+	assert.Equal(t, 16, len(mustDecodeHex(t, key.ReconDigest())))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+digest="sha1"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestReconExclusion(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "lp1195901.asc")
+	hockeypuck.SetConfig("")
+	ApplyReconExclusion(key)
+	assert.False(t, key.IsReconExcluded())
+
+	// The first user ID of lp1195901.asc has many more than 10 signatures.
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+excludeSigs=10
+`)
+	assert.Nil(t, Config().Validate())
+	ApplyReconExclusion(key)
+	assert.True(t, key.IsReconExcluded())
+	assert.Equal(t, PacketStateNoRecon, key.State&PacketStateNoRecon)
+
+	other := MustInputAscKey(t, "sksdigest.asc")
+	ApplyReconExclusion(other)
+	assert.False(t, other.IsReconExcluded())
+	other.ExcludeFromRecon()
+	assert.True(t, other.IsReconExcluded())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+excludeSigs=-1
+`)
+	assert.NotNil(t, Config().Validate())
+}
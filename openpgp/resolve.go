@@ -23,8 +23,14 @@ import (
 	_ "crypto/sha256"
 	_ "crypto/sha512"
 	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+	"time"
 
 	_ "code.google.com/p/go.crypto/md4"
+	pgp "code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
 	_ "code.google.com/p/go.crypto/ripemd160"
 )
 
@@ -32,8 +38,520 @@ type resolver struct {
 	Pubkey *Pubkey
 }
 
+// VerifySigs returns whether self-signatures should be cryptographically
+// verified. Keys with self-signatures that fail verification are rejected.
+// Verification is implied by RequireValidSelfSig.
 func (s *Settings) VerifySigs() bool {
-	return s.GetBool("hockeypuck.openpgp.verifySigs")
+	return s.GetBool("hockeypuck.openpgp.verifySigs") || s.RequireValidSelfSig()
+}
+
+// RequireValidSelfSig returns whether keys must have at least one user ID
+// with a verified self-signature in order to be stored.
+func (s *Settings) RequireValidSelfSig() bool {
+	return s.GetBool("hockeypuck.openpgp.requireValidSelfSig")
+}
+
+// RequireUserId returns whether keys must have a self-signed user ID
+// in order to be stored.
+func (s *Settings) RequireUserId() bool {
+	return s.GetBool("hockeypuck.openpgp.requireUserId")
+}
+
+// MaxUserIds returns the maximum number of user IDs and user attributes
+// accepted on a single public key.
+func (s *Settings) MaxUserIds() int {
+	return s.GetIntDefault("hockeypuck.openpgp.maxUserIds", 100)
+}
+
+// MaxSubkeys returns the maximum number of subkeys accepted on a single
+// public key.
+func (s *Settings) MaxSubkeys() int {
+	return s.GetIntDefault("hockeypuck.openpgp.maxSubkeys", 100)
+}
+
+const (
+	minCreationKey     = "hockeypuck.openpgp.minCreation"
+	maxCreationSkewKey = "hockeypuck.openpgp.maxCreationSkew"
+)
+
+// MinCreation returns the earliest creation date, given as "YYYY-MM-DD",
+// accepted for a public key. The zero time if not set.
+func (s *Settings) MinCreation() (time.Time, error) {
+	v := s.GetString(minCreationKey)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// MaxCreationSkew returns how far in the future, given as a duration such as
+// "24h", a public key's creation time may be. Zero if not set, which disables
+// the check.
+func (s *Settings) MaxCreationSkew() (time.Duration, error) {
+	v := s.GetString(maxCreationSkewKey)
+	if v == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// validateCreationBounds checks that the key creation time bounds parse and
+// do not reject every key.
+func (s *Settings) validateCreationBounds() error {
+	minCreation, err := s.MinCreation()
+	if err != nil {
+		return fmt.Errorf("%s: %v", minCreationKey, err)
+	}
+	if minCreation.After(time.Now()) {
+		return fmt.Errorf("%s must not be in the future", minCreationKey)
+	}
+	skew, err := s.MaxCreationSkew()
+	if err != nil {
+		return fmt.Errorf("%s: %v", maxCreationSkewKey, err)
+	}
+	if skew < 0 {
+		return fmt.Errorf("%s must not be negative", maxCreationSkewKey)
+	}
+	return nil
+}
+
+var ErrBadSelfSig = fmt.Errorf("Key has a self-signature that failed verification")
+
+var ErrNoValidSelfSig = fmt.Errorf("Key has no user ID with a valid self-signature")
+
+// CheckSelfSigs returns an error if the key should not be stored because of
+// the verification state of its self-signatures, according to the configured
+// signature verification policy. Signatures made by other keys are not checked.
+func CheckSelfSigs(pubkey *Pubkey) error {
+	if !Config().VerifySigs() {
+		return nil
+	}
+	return checkSelfSigs(pubkey, Config().RequireValidSelfSig())
+}
+
+var ErrNoUserId = fmt.Errorf("Key has no self-signed user ID")
+
+// CheckUserId returns an error if the key should not be stored because it
+// lacks a self-signed user ID, when required by the configuration.
+func CheckUserId(pubkey *Pubkey) error {
+	if Config().RequireUserId() && pubkey.PrimaryUserId() == nil {
+		return ErrNoUserId
+	}
+	return nil
+}
+
+var ErrTooManyUserIds = fmt.Errorf("Key has too many user IDs")
+
+var ErrTooManySubkeys = fmt.Errorf("Key has too many subkeys")
+
+// CheckKeyLimits returns an error if the key should not be stored because
+// it has more user IDs or subkeys than allowed by the configuration.
+func CheckKeyLimits(pubkey *Pubkey) error {
+	if len(pubkey.userIds)+len(pubkey.userAttributes) > Config().MaxUserIds() {
+		return ErrTooManyUserIds
+	}
+	if len(pubkey.subkeys) > Config().MaxSubkeys() {
+		return ErrTooManySubkeys
+	}
+	return nil
+}
+
+// CheckMergedKeyLimits returns an error if merging an update into the stored
+// key gave it more user IDs or subkeys than allowed by the configuration.
+// Stored keys already over the limits may still be updated, such as to revoke
+// them, as long as the update does not add to them.
+func CheckMergedKeyLimits(stored, merged *Pubkey) error {
+	if len(merged.userIds)+len(merged.userAttributes) <= len(stored.userIds)+len(stored.userAttributes) &&
+		len(merged.subkeys) <= len(stored.subkeys) {
+		return nil
+	}
+	return CheckKeyLimits(merged)
+}
+
+var ErrKeyTooOld = fmt.Errorf("Key was created before the earliest accepted creation time")
+
+var ErrKeyTooNew = fmt.Errorf("Key creation time is too far in the future")
+
+// CheckCreation returns an error if the key should not be stored because its
+// creation time is before the configured minimum or too far in the future.
+func CheckCreation(pubkey *Pubkey) error {
+	return checkCreation(pubkey, time.Now())
+}
+
+func checkCreation(pubkey *Pubkey, now time.Time) error {
+	if minCreation, err := Config().MinCreation(); err == nil && pubkey.Creation.Before(minCreation) {
+		return ErrKeyTooOld
+	}
+	if skew, err := Config().MaxCreationSkew(); err == nil && skew > 0 && pubkey.Creation.After(now.Add(skew)) {
+		return ErrKeyTooNew
+	}
+	return nil
+}
+
+const (
+	blockedFingerprintsKey = "hockeypuck.openpgp.blockedFingerprints"
+	allowedFingerprintsKey = "hockeypuck.openpgp.allowedFingerprints"
+)
+
+// BlockedFingerprints returns the normalized fingerprints of keys that are
+// refused.
+func (s *Settings) BlockedFingerprints() []string {
+	return normalizeFingerprints(s.GetStrings(blockedFingerprintsKey))
+}
+
+// AllowedFingerprints returns the normalized fingerprints of the only keys
+// that are accepted. When empty, keys are accepted unless blocked.
+func (s *Settings) AllowedFingerprints() []string {
+	return normalizeFingerprints(s.GetStrings(allowedFingerprintsKey))
+}
+
+func normalizeFingerprints(fps []string) (result []string) {
+	for _, fp := range fps {
+		result = append(result, NormalizeFingerprint(fp))
+	}
+	return
+}
+
+// validateFingerprintLists checks that the blocked and allowed keys are given
+// as hexadecimal fingerprints.
+func (s *Settings) validateFingerprintLists() error {
+	for _, key := range []string{blockedFingerprintsKey, allowedFingerprintsKey} {
+		for _, fp := range s.GetStrings(key) {
+			if NormalizeFingerprint(fp) == "" {
+				return fmt.Errorf("%s: invalid fingerprint %q", key, fp)
+			}
+		}
+	}
+	return nil
+}
+
+var ErrKeyBlocked = fmt.Errorf("Key is blocked")
+
+var ErrKeyNotAllowed = fmt.Errorf("Key is not on the list of allowed keys")
+
+// CheckFingerprint returns an error if the key should not be stored because
+// its fingerprint is blocked, or is not allowed when the configuration only
+// allows certain keys. A blocked key is refused even if it is also allowed.
+func CheckFingerprint(pubkey *Pubkey) error {
+	fp := pubkey.Fingerprint()
+	for _, blocked := range Config().BlockedFingerprints() {
+		if fp == blocked {
+			return ErrKeyBlocked
+		}
+	}
+	allowed := Config().AllowedFingerprints()
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, allow := range allowed {
+		if fp == allow {
+			return nil
+		}
+	}
+	return ErrKeyNotAllowed
+}
+
+var ErrKeyRevoked = fmt.Errorf("Key has been revoked")
+
+var ErrKeyExpired = fmt.Errorf("Key has expired")
+
+var ErrUserIdRevoked = fmt.Errorf("Primary user ID has been revoked")
+
+var ErrNoCrossCertification = fmt.Errorf("Signing subkey has no valid cross-certification")
+
+// Validate checks whether the key is usable at the given time: it must not be
+// revoked or expired, as by IsExpired, and its primary user ID must not be
+// revoked and must have a self-signature that verifies. Signing subkeys must
+// be cross-certified by a valid embedded back-signature. Self-signatures are
+// verified regardless of the configured verification policy. The key is not
+// modified. Returns whether the key is valid, along with every problem found.
+func (pubkey *Pubkey) Validate(now time.Time) (bool, []error) {
+	var errs []error
+	if pubkey.IsRevoked() {
+		errs = append(errs, ErrKeyRevoked)
+	}
+	if pubkey.IsExpired(now) {
+		errs = append(errs, ErrKeyExpired)
+	}
+	if uid := pubkey.PrimaryUserId(); uid == nil {
+		errs = append(errs, ErrNoUserId)
+	} else {
+		if uid.revSig != nil {
+			errs = append(errs, ErrUserIdRevoked)
+		}
+		if uid.selfSignature == nil || pubkey.userIdSelfSigError(uid, uid.selfSignature) != nil {
+			errs = append(errs, ErrBadSelfSig)
+		}
+	}
+	for _, subkey := range pubkey.subkeys {
+		if err := pubkey.checkCrossCertification(subkey); err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	return len(errs) == 0, errs
+}
+
+const (
+	expiredGracePeriodKey = "hockeypuck.openpgp.expiredGracePeriod"
+	hideExpiredKey        = "hockeypuck.openpgp.hideExpired"
+)
+
+// HideExpired returns whether expired keys are hidden from index results
+// once the grace period has passed.
+func (s *Settings) HideExpired() bool {
+	return s.GetBool(hideExpiredKey)
+}
+
+// ExpiredGracePeriod returns how long an expired key is still treated as
+// servable, with a warning, before it is considered expired. Zero if not set,
+// in which case keys are considered expired as soon as they expire.
+func (s *Settings) ExpiredGracePeriod() (time.Duration, error) {
+	v := s.GetString(expiredGracePeriodKey)
+	if v == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// validateExpiredGracePeriod checks that the grace period parses and is not
+// negative.
+func (s *Settings) validateExpiredGracePeriod() error {
+	grace, err := s.ExpiredGracePeriod()
+	if err != nil {
+		return fmt.Errorf("%s: %v", expiredGracePeriodKey, err)
+	}
+	if grace < 0 {
+		return fmt.Errorf("%s must not be negative", expiredGracePeriodKey)
+	}
+	return nil
+}
+
+// Status is the effective state of a key at some point in time.
+type Status int
+
+const (
+	StatusUnknown Status = iota // no self-certification to go by
+	StatusValid   Status = iota
+	StatusExpired Status = iota
+	StatusRevoked Status = iota
+	StatusGrace   Status = iota // expired, but within the grace period
+)
+
+func (status Status) String() string {
+	switch status {
+	case StatusValid:
+		return "valid"
+	case StatusExpired:
+		return "expired"
+	case StatusRevoked:
+		return "revoked"
+	case StatusGrace:
+		return "grace"
+	}
+	return "unknown"
+}
+
+// EffectiveStatus resolves the state of the key at the given time from its
+// revocations and self-certifications. A key revocation takes precedence over
+// expiration, and expiration over validity. A key whose self-certifications
+// have all been revoked is also considered revoked. Otherwise the most recent
+// self-certification across user IDs and user attributes decides whether the
+// key has expired, so that a newer certification overrides an older one
+// whether it shortens or extends the key lifetime. A key expired for less
+// than the configured grace period is StatusGrace rather than
+// StatusExpired. Returns StatusUnknown if the key has no self-certification.
+func (pubkey *Pubkey) EffectiveStatus(now time.Time) Status {
+	if pubkey.IsRevoked() {
+		return StatusRevoked
+	}
+	expiration, status := pubkey.effectiveExpiration(now)
+	if status != StatusValid || expiration.IsZero() || !now.After(expiration) {
+		return status
+	}
+	if grace, err := Config().ExpiredGracePeriod(); err == nil && !now.After(expiration.Add(grace)) {
+		return StatusGrace
+	}
+	return StatusExpired
+}
+
+// IsExpired returns whether the key has expired at the given time and the
+// configured grace period has passed. Revocation is not considered.
+func (pubkey *Pubkey) IsExpired(now time.Time) bool {
+	expiration, status := pubkey.effectiveExpiration(now)
+	if status != StatusValid || expiration.IsZero() {
+		return false
+	}
+	grace, err := Config().ExpiredGracePeriod()
+	if err != nil {
+		grace = 0
+	}
+	return now.After(expiration.Add(grace))
+}
+
+// effectiveExpiration returns when the key expires according to its most
+// recent self-certification at the given time, or the zero time if it does
+// not expire. The status is StatusValid if a self-certification applies,
+// StatusRevoked if all of them have been revoked, or StatusUnknown if the key
+// has none.
+func (pubkey *Pubkey) effectiveExpiration(now time.Time) (time.Time, Status) {
+	if pubkey.PublicKey == nil {
+		// V3 keys declare their expiration in the key packet.
+		if pubkey.Expiration.Unix() == NeverExpires.Unix() {
+			return time.Time{}, StatusValid
+		}
+		return pubkey.Expiration, StatusValid
+	}
+	var latest *Signature
+	var revoked bool
+	consider := func(sigs []*Signature, isRevoked bool) {
+		sig := pubkey.selfCertification(sigs, now)
+		if sig == nil {
+			revoked = revoked || isRevoked
+		} else if latest == nil || sig.Creation.After(latest.Creation) {
+			latest = sig
+		}
+	}
+	for _, uid := range pubkey.userIds {
+		consider(uid.signatures, uid.IsRevoked())
+	}
+	for _, uat := range pubkey.userAttributes {
+		consider(uat.signatures, uat.revSig != nil || uat.RevSigDigest.Valid)
+	}
+	if latest == nil {
+		if revoked {
+			return time.Time{}, StatusRevoked
+		}
+		return time.Time{}, StatusUnknown
+	}
+	if lifetime := latest.Signature.KeyLifetimeSecs; lifetime != nil && *lifetime > 0 {
+		return pubkey.Creation.Add(time.Duration(*lifetime) * time.Second), StatusValid
+	}
+	return time.Time{}, StatusValid
+}
+
+// KeyVerdict is the result of validating one public key.
+type KeyVerdict struct {
+	Fingerprint string
+	Valid       bool
+	Errors      []error
+}
+
+// VerifyKeys validates many keys concurrently, as of the current time, using
+// the given number of workers, or the configured number of workers if not
+// positive. Verdicts are returned in the same order as the keys.
+func VerifyKeys(keys []*Pubkey, workers int) []KeyVerdict {
+	if workers <= 0 {
+		workers = Config().NumWorkers()
+	}
+	now := time.Now()
+	verdicts := make([]KeyVerdict, len(keys))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				valid, errs := keys[i].Validate(now)
+				verdicts[i] = KeyVerdict{Fingerprint: keys[i].Fingerprint(), Valid: valid, Errors: errs}
+			}
+		}()
+	}
+	for i := range keys {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return verdicts
+}
+
+// checkCrossCertification returns an error if the subkey is bound for signing
+// without a cross-certification that verifies.
+func (pubkey *Pubkey) checkCrossCertification(subkey *Subkey) error {
+	binding := subkey.bindingSig
+	if binding == nil || binding.Signature == nil ||
+		!binding.Signature.FlagsValid || !binding.Signature.FlagSign {
+		return nil
+	}
+	if subkey.CrossCertification() == nil || pubkey.PublicKey == nil || subkey.PublicKey == nil {
+		return ErrNoCrossCertification
+	}
+	// The binding signature of a signing subkey only verifies along with
+	// its embedded cross-certification.
+	if err := pubkey.PublicKey.VerifyKeySignature(subkey.PublicKey, binding.Signature); err != nil {
+		return ErrNoCrossCertification
+	}
+	return nil
+}
+
+var ErrUnsupportedHash = fmt.Errorf("Signature hash algorithm is not supported")
+
+var ErrUnusableSigningKey = fmt.Errorf("Signing subkey is revoked, expired or not flagged for signing")
+
+// VerifyDetached verifies a detached signature over the message, made by the
+// key or by one of its bound subkeys as identified by the signature's
+// issuer key ID. Returns ErrMissingIssuer if the issuer is neither, and
+// ErrUnusableSigningKey if it is a subkey which is revoked, has expired or
+// is not flagged for signing.
+func (pubkey *Pubkey) VerifyDetached(message io.Reader, sig *packet.Signature) error {
+	signer, err := pubkey.signingKey(sig)
+	if err != nil {
+		return err
+	}
+	if !sig.Hash.Available() {
+		return ErrUnsupportedHash
+	}
+	h := sig.Hash.New()
+	if sig.SigType == packet.SigTypeText {
+		h = pgp.NewCanonicalTextHash(h)
+	}
+	if _, err := io.Copy(h, message); err != nil {
+		return err
+	}
+	return signer.VerifySignature(h, sig)
+}
+
+// signingKey returns the key or bound subkey which issued the signature.
+func (pubkey *Pubkey) signingKey(sig *packet.Signature) (*packet.PublicKey, error) {
+	if sig.IssuerKeyId == nil {
+		return nil, ErrMissingIssuer
+	}
+	if pubkey.PublicKey != nil && pubkey.PublicKey.KeyId == *sig.IssuerKeyId {
+		return pubkey.PublicKey, nil
+	}
+	for _, subkey := range pubkey.subkeys {
+		if subkey.bindingSig != nil && subkey.PublicKey != nil &&
+			subkey.PublicKey.KeyId == *sig.IssuerKeyId {
+			if subkey.IsRevoked() || subkey.IsExpired(time.Now()) ||
+				subkey.Flags()&packet.KeyFlagSign == 0 {
+				return nil, ErrUnusableSigningKey
+			}
+			return subkey.PublicKey, nil
+		}
+	}
+	return nil, ErrMissingIssuer
+}
+
+func checkSelfSigs(pubkey *Pubkey, requireValid bool) error {
+	err := pubkey.Visit(func(rec PacketRecord) error {
+		if sig, is := rec.(*Signature); is && sig.State&PacketStateSigBad != 0 {
+			return ErrBadSelfSig
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if requireValid {
+		for _, uid := range pubkey.userIds {
+			if uid.selfSignature != nil {
+				return nil
+			}
+		}
+		return ErrNoValidSelfSig
+	}
+	return nil
 }
 
 // Resolve resolves and connects relationship references
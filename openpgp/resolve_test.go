@@ -22,12 +22,18 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"io/ioutil"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"code.google.com/p/go.crypto/openpgp/armor"
 	"code.google.com/p/go.crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
 )
 
 func TestBadSelfSigUid(t *testing.T) {
@@ -103,6 +109,59 @@ func TestDupSig(t *testing.T) {
 	assert.Equal(t, key.Md5, "6d57b48c83d6322076d634059bb3b94b")
 }
 
+// addUnhashedSubpacket returns a copy of a V4 signature packet with a
+// private-use subpacket appended to its unhashed area.
+func addUnhashedSubpacket(t *testing.T, sig *Signature, data byte) *Signature {
+	op, err := toOpaquePacket(sig.Packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := op.Contents
+	hashedEnd := 6 + int(binary.BigEndian.Uint16(c[4:6]))
+	unhashedLen := int(binary.BigEndian.Uint16(c[hashedEnd : hashedEnd+2]))
+	unhashedEnd := hashedEnd + 2 + unhashedLen
+	var contents []byte
+	contents = append(contents, c[:hashedEnd]...)
+	contents = append(contents, byte((unhashedLen+3)>>8), byte(unhashedLen+3))
+	contents = append(contents, c[hashedEnd+2:unhashedEnd]...)
+	contents = append(contents, 2, 100, data) // Private subpacket
+	contents = append(contents, c[unhashedEnd:]...)
+	var buf bytes.Buffer
+	if err = (&packet.OpaquePacket{Tag: op.Tag, Contents: contents}).Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return &Signature{Packet: buf.Bytes()}
+}
+
+func TestEquivalentSignatures(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	uid := key.userIds[0]
+	sig := uid.selfSignature
+	copy1 := addUnhashedSubpacket(t, sig, 1)
+	copy2 := addUnhashedSubpacket(t, sig, 2)
+	scope := uid.ScopedDigest
+	assert.NotEqual(t, sig.calcScopedDigest(key, scope), copy1.calcScopedDigest(key, scope))
+	assert.NotEqual(t, copy1.calcScopedDigest(key, scope), copy2.calcScopedDigest(key, scope))
+	assert.Equal(t, sig.EquivalenceDigest(), copy1.EquivalenceDigest())
+	assert.Equal(t, sig.EquivalenceDigest(), copy2.EquivalenceDigest())
+
+	// The copies still parse as the same signature.
+	p, err := packet.Read(bytes.NewBuffer(copy1.Packet))
+	if assert.Nil(t, err) {
+		assert.Equal(t, sig.Creation.Unix(), p.(*packet.Signature).CreationTime.Unix())
+	}
+
+	// Signatures differing in what they sign are not collapsed.
+	other := key.subkeys[0].signatures[0]
+	assert.NotEqual(t, sig.EquivalenceDigest(), other.EquivalenceDigest())
+	packetBefore := append([]byte(nil), copy1.Packet...)
+	assert.Equal(t, []*Signature{sig, other},
+		CollapseEquivalentSignatures([]*Signature{sig, copy1, other, copy2}))
+	assert.Equal(t, []*Signature{copy2, other},
+		CollapseEquivalentSignatures([]*Signature{copy2, other, sig}))
+	assert.Equal(t, packetBefore, copy1.Packet)
+}
+
 func TestPrimaryUidSelection(t *testing.T) {
 	key := MustInputAscKey(t, "lp1195901.asc")
 	Resolve(key)
@@ -136,6 +195,82 @@ func TestSortPrimaryUid(t *testing.T) {
 	}
 }
 
+func TestExpiredGracePeriod(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "expire_old.asc")
+	assert.Nil(t, key.ResolveExpiration())
+	expiration := key.Expiration
+	justExpired, longExpired := expiration.Add(time.Hour), expiration.Add(25*time.Hour)
+	valid := MustInputAscKey(t, "sksdigest.asc")
+
+	// Without a grace period, expired keys are expired at once. They are
+	// not hidden unless configured.
+	assert.False(t, Config().HideExpired())
+	assert.False(t, key.IsExpired(expiration))
+	assert.Equal(t, StatusExpired, key.EffectiveStatus(justExpired))
+	assert.True(t, key.IsExpired(justExpired))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+expiredGracePeriod="24h"
+hideExpired=true
+`)
+	assert.Nil(t, Config().Validate())
+	assert.True(t, Config().HideExpired())
+	grace, err := Config().ExpiredGracePeriod()
+	assert.Nil(t, err)
+	assert.Equal(t, 24*time.Hour, grace)
+	assert.Equal(t, StatusValid, key.EffectiveStatus(expiration))
+	assert.Equal(t, StatusGrace, key.EffectiveStatus(justExpired))
+	assert.False(t, key.IsExpired(justExpired))
+	assert.False(t, key.CanEncrypt(justExpired))
+	assert.Equal(t, []*Pubkey{key, valid}, FilterExpired([]*Pubkey{key, valid}, justExpired))
+	assert.Equal(t, StatusExpired, key.EffectiveStatus(longExpired))
+	assert.True(t, key.IsExpired(longExpired))
+	assert.Equal(t, []*Pubkey{valid}, FilterExpired([]*Pubkey{key, valid}, longExpired))
+
+	// Revocation still takes precedence.
+	key.revSig = key.userIds[0].selfSignature
+	assert.Equal(t, StatusRevoked, key.EffectiveStatus(justExpired))
+
+	for _, bad := range []string{"-1h", "soon"} {
+		hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+expiredGracePeriod=%q
+`, bad))
+		assert.NotNil(t, Config().Validate(), bad)
+	}
+}
+
+func TestSortUserIds(t *testing.T) {
+	key := MustInputAscKey(t, "lp1195901.asc")
+	primary := key.PrimaryUserId()
+	digest := SksDigest(key, md5.New())
+	// Restore the order the user IDs were uploaded in, primary last.
+	uploaded := []string{
+		"Phil Pennock <pdp@exim.org>",
+		"Phil Pennock <pdp@spodhuis.org>",
+		"Phil Pennock <pdp@spodhuis.demon.nl>",
+		"Phil Pennock <phil.pennock@globnix.org>",
+		"Phil Pennock <phil.pennock@spodhuis.org>"}
+	var userIds []*UserId
+	for _, kw := range uploaded {
+		userIds = append(userIds, key.UserIdByKeyword(kw))
+	}
+	key.userIds = userIds
+	assert.Equal(t, "Phil Pennock <phil.pennock@spodhuis.org>", primary.Keywords)
+	assert.Equal(t, digest, SksDigest(key, md5.New()))
+
+	key.SortUserIds()
+	assert.Equal(t, primary, key.userIds[0])
+	for i := 1; i < len(key.userIds)-1; i++ {
+		assert.False(t, key.userIds[i].selfSignature.Creation.Before(key.userIds[i+1].selfSignature.Creation))
+	}
+	assert.Equal(t, digest, SksDigest(key, md5.New()))
+	assert.Equal(t, key.Md5, SksDigest(key, md5.New()))
+}
+
 func TestKeyExpiration(t *testing.T) {
 	key := MustInputAscKey(t, "lp1195901.asc")
 	Resolve(key)
@@ -205,3 +340,405 @@ func TestV3NoUidSig(t *testing.T) {
 	md5 := hex.EncodeToString(h.Sum(nil))
 	assert.Equal(t, "0005127a8b7da8c32998d7e81dc92540", md5)
 }
+
+func TestCheckSelfSigs(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	assert.Nil(t, checkSelfSigs(key, false))
+	assert.Nil(t, checkSelfSigs(key, true))
+
+	// Signatures are only flagged bad by self-signature verification.
+	uid := key.userIds[0]
+	uid.signatures[0].State |= PacketStateSigBad
+	assert.Equal(t, ErrBadSelfSig, checkSelfSigs(key, false))
+	uid.signatures[0].State &^= PacketStateSigBad
+
+	uid.selfSignature = nil
+	assert.Nil(t, checkSelfSigs(key, false))
+	assert.Equal(t, ErrNoValidSelfSig, checkSelfSigs(key, true))
+}
+
+func TestCheckUserId(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "sksdigest.asc")
+	assert.Equal(t, key.userIds[0], key.PrimaryUserId())
+
+	hockeypuck.SetConfig("")
+	key.userIds[0].selfSignature = nil
+	assert.Nil(t, key.PrimaryUserId())
+	assert.Nil(t, CheckUserId(key))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+requireUserId=true
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, ErrNoUserId, CheckUserId(key))
+	assert.Nil(t, CheckUserId(MustInputAscKey(t, "sksdigest.asc")))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+requireUserId="maybe"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestCheckKeyLimits(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	// uat.asc has 2 user IDs, 1 user attribute and 3 subkeys.
+	key := MustInputAscKey(t, "uat.asc")
+	hockeypuck.SetConfig("")
+	assert.Nil(t, Config().Validate())
+	assert.Nil(t, CheckKeyLimits(key))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxUserIds=3
+maxSubkeys=3
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Nil(t, CheckKeyLimits(key))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxUserIds=2
+`)
+	assert.Equal(t, ErrTooManyUserIds, CheckKeyLimits(key))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxSubkeys=2
+`)
+	assert.Equal(t, ErrTooManySubkeys, CheckKeyLimits(key))
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxSubkeys=0
+`)
+	assert.NotNil(t, Config().Validate())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxSubkeys=-1
+maxUserIds="many"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestCheckMergedKeyLimits(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxUserIds=2
+maxSubkeys=2
+`)
+	// The stored key is already over both limits, but may still be updated
+	// with signatures such as revocations.
+	stored := MustInputAscKey(t, "uat.asc")
+	merged := stored.Clone()
+	assert.Nil(t, CheckMergedKeyLimits(stored, merged))
+
+	merged.AddUserId(MustInputAscKey(t, "alice_signed.asc").userIds[0])
+	assert.Equal(t, ErrTooManyUserIds, CheckMergedKeyLimits(stored, merged))
+
+	merged = stored.Clone()
+	merged.AddSubkey(MustInputAscKey(t, "weasel.asc").subkeys[0])
+	assert.Equal(t, ErrTooManyUserIds, CheckMergedKeyLimits(stored, merged))
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+maxSubkeys=2
+`)
+	assert.Equal(t, ErrTooManySubkeys, CheckMergedKeyLimits(stored, merged))
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	key := MustInputAscKey(t, "sksdigest.asc")
+	valid, errs := key.Validate(now)
+	assert.True(t, valid)
+	assert.Empty(t, errs)
+
+	// Expiration is decided as by EffectiveStatus, including the grace
+	// period, and validation does not change signature states.
+	key = MustInputAscKey(t, "expire_old.asc")
+	assert.Nil(t, key.ResolveExpiration())
+	expiration := key.Expiration
+	state := key.userIds[0].selfSignature.State
+	valid, errs = key.Validate(expiration.Add(time.Hour))
+	assert.False(t, valid)
+	assert.Equal(t, []error{ErrKeyExpired}, errs)
+	assert.Equal(t, StatusExpired, key.EffectiveStatus(expiration.Add(time.Hour)))
+	valid, errs = key.Validate(expiration.Add(-time.Hour))
+	assert.True(t, valid)
+	assert.Equal(t, state, key.userIds[0].selfSignature.State)
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+expiredGracePeriod="24h"
+`)
+	valid, errs = key.Validate(expiration.Add(time.Hour))
+	assert.True(t, valid)
+	assert.Equal(t, StatusGrace, key.EffectiveStatus(expiration.Add(time.Hour)))
+	hockeypuck.SetConfig("")
+
+	key = MustInputAscKey(t, "sksdigest.asc")
+	key.userIds[0].revSig = key.userIds[0].selfSignature
+	_, errs = key.Validate(now)
+	assert.Equal(t, []error{ErrUserIdRevoked}, errs)
+
+	key.userIds = nil
+	key.primaryUid = nil
+	_, errs = key.Validate(now)
+	assert.Equal(t, []error{ErrNoUserId}, errs)
+
+	valid, errs = MustInputAscKey(t, "252B8B37.dupsig.asc").Validate(now)
+	assert.False(t, valid)
+	assert.Contains(t, errs, ErrKeyRevoked)
+
+	// The self-signature no longer matches an altered user ID.
+	key = MustInputAscKey(t, "sksdigest.asc")
+	key.userIds[0].UserId.Id = "Mallory <mallory@example.com>"
+	valid, errs = key.Validate(now)
+	assert.False(t, valid)
+	assert.Equal(t, []error{ErrBadSelfSig}, errs)
+}
+
+func TestCheckCreation(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "sksdigest.asc")
+	hockeypuck.SetConfig("")
+	assert.Nil(t, CheckCreation(key))
+
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+minCreation="%s"
+maxCreationSkew="24h"
+`, key.Creation.Format("2006-01-02")))
+	assert.Nil(t, Config().Validate())
+	assert.Nil(t, CheckCreation(key))
+	assert.Nil(t, checkCreation(key, key.Creation.Add(-23*time.Hour)))
+	assert.Equal(t, ErrKeyTooNew, checkCreation(key, key.Creation.Add(-25*time.Hour)))
+
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+minCreation="%s"
+`, key.Creation.Add(48*time.Hour).Format("2006-01-02")))
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, ErrKeyTooOld, CheckCreation(key))
+
+	for _, conf := range []string{
+		`minCreation="yesterday"`,
+		`minCreation="9999-01-01"`,
+		`maxCreationSkew="a while"`,
+		`maxCreationSkew="-1h"`,
+	} {
+		hockeypuck.SetConfig("[hockeypuck.openpgp]\n" + conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
+
+func TestCheckFingerprint(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	key := MustInputAscKey(t, "sksdigest.asc")
+	other := MustInputAscKey(t, "uat.asc")
+	fp := key.Fingerprint()
+	upper := "0x" + strings.ToUpper(fp)
+	hockeypuck.SetConfig("")
+	assert.Nil(t, CheckFingerprint(key))
+
+	assert.Equal(t, fp, NormalizeFingerprint(upper))
+	assert.Equal(t, fp, NormalizeFingerprint(strings.ToUpper(fp[:4]+" "+fp[4:])))
+	assert.Equal(t, "", NormalizeFingerprint(fp[:16]))
+	assert.Equal(t, "", NormalizeFingerprint("0x"+fp[:39]+"z"))
+
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+blockedFingerprints=[%q]
+`, upper))
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, ErrKeyBlocked, CheckFingerprint(key))
+	assert.Nil(t, CheckFingerprint(other))
+
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+allowedFingerprints=[%q]
+`, upper))
+	assert.Nil(t, Config().Validate())
+	assert.Nil(t, CheckFingerprint(key))
+	assert.Equal(t, ErrKeyNotAllowed, CheckFingerprint(other))
+
+	// Blocking takes precedence over allowing.
+	hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+blockedFingerprints=[%q]
+allowedFingerprints=[%q, %q]
+`, fp, upper, other.Fingerprint()))
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, ErrKeyBlocked, CheckFingerprint(key))
+	assert.Nil(t, CheckFingerprint(other))
+
+	for _, conf := range []string{
+		`blockedFingerprints=["` + key.KeyId() + `"]`,
+		`allowedFingerprints=["not a fingerprint"]`,
+	} {
+		hockeypuck.SetConfig("[hockeypuck.openpgp]\n" + conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	var keys []*Pubkey
+	var expect []bool
+	for i := 0; i < 10; i++ {
+		keys = append(keys, MustInputAscKey(t, "sksdigest.asc"), MustInputAscKey(t, "252B8B37.dupsig.asc"),
+			MustInputAscKey(t, "crosscert_missing.asc"))
+		expect = append(expect, true, false, false)
+	}
+	verdicts := VerifyKeys(keys, 4)
+	assert.Equal(t, len(keys), len(verdicts))
+	for i, verdict := range verdicts {
+		assert.Equal(t, keys[i].Fingerprint(), verdict.Fingerprint)
+		assert.Equal(t, expect[i], verdict.Valid)
+	}
+	assert.Empty(t, verdicts[0].Errors)
+	assert.Contains(t, verdicts[1].Errors, ErrKeyRevoked)
+	assert.Equal(t, []error{ErrNoCrossCertification}, verdicts[2].Errors)
+
+	// The configured number of workers is used by default.
+	assert.Equal(t, verdicts[:3], VerifyKeys(keys[:3], 0))
+	assert.Empty(t, VerifyKeys(nil, 2))
+}
+
+func mustDetachedSig(t *testing.T, name string) *packet.Signature {
+	f := MustInput(t, name)
+	defer f.Close()
+	block, err := armor.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, is := p.(*packet.Signature)
+	if !is {
+		t.Fatal("Not a signature packet:", name)
+	}
+	return sig
+}
+
+func TestVerifyDetached(t *testing.T) {
+	key := MustInputAscKey(t, "crosscert.asc")
+	f := MustInput(t, "detached.txt")
+	defer f.Close()
+	msg, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	tampered := bytes.Replace(msg, []byte("test"), []byte("TEST"), 1)
+
+	// Binary and text signatures made by the signing subkey.
+	for _, name := range []string{"detached_sub.sig", "detached_text.sig"} {
+		sig := mustDetachedSig(t, name)
+		assert.Nil(t, key.VerifyDetached(bytes.NewBuffer(msg), sig), name)
+		assert.NotNil(t, key.VerifyDetached(bytes.NewBuffer(tampered), sig), name)
+	}
+	// Text signatures are made over canonical line endings.
+	crlf := bytes.Replace(msg, []byte("\n"), []byte("\r\n"), -1)
+	assert.Nil(t, key.VerifyDetached(bytes.NewBuffer(crlf), mustDetachedSig(t, "detached_text.sig")))
+
+	// Made by another key.
+	assert.Equal(t, ErrMissingIssuer,
+		key.VerifyDetached(bytes.NewBuffer(msg), mustDetachedSig(t, "detached_other.sig")))
+
+	// Made by subkeys which have since expired or been revoked, or which
+	// are only for encryption.
+	key = MustInputAscKey(t, "detached_subkeys.asc")
+	for _, name := range []string{"detached_expired.sig", "detached_revoked.sig", "detached_encrypt.sig"} {
+		assert.Equal(t, ErrUnusableSigningKey,
+			key.VerifyDetached(bytes.NewBuffer(msg), mustDetachedSig(t, name)), name)
+	}
+}
+
+func TestUserIdRevoked(t *testing.T) {
+	// The revocation is newer than the self-signature.
+	key := MustInputAscKey(t, "revoked_uid.asc")
+	current := key.UserIdByKeyword("Revoke Test <revoke@example.com>")
+	revoked := key.UserIdByKeyword("Revoke Test <old@example.com>")
+	assert.False(t, current.IsRevoked())
+	assert.True(t, revoked.IsRevoked())
+	var buf bytes.Buffer
+	assert.Nil(t, key.WriteMRIndex(&buf, true))
+	assert.Contains(t, buf.String(), "uid:Revoke Test <old@example.com>:1792117809::r\n")
+
+	// A self-signature newer than the revocation certifies the user ID again.
+	key = MustInputAscKey(t, "recertified_uid.asc")
+	recertified := key.UserIdByKeyword("Recertify Test <old@example.com>")
+	assert.Equal(t, 3, len(recertified.signatures))
+	assert.False(t, recertified.IsRevoked())
+	assert.False(t, recertified.RevSigDigest.Valid)
+	buf.Reset()
+	assert.Nil(t, key.WriteMRIndex(&buf, true))
+	assert.Contains(t, buf.String(), "uid:Recertify Test <old@example.com>:1792117900::\n")
+
+	// The outcome depends on signature creation times, not packet order.
+	for name, keyword := range map[string]string{
+		"revoked_uid.asc":     "Revoke Test <old@example.com>",
+		"recertified_uid.asc": "Recertify Test <old@example.com>",
+	} {
+		key = MustInputAscKey(t, name)
+		uid := key.UserIdByKeyword(keyword)
+		for i, j := 0, len(uid.signatures)-1; i < j; i, j = i+1, j-1 {
+			uid.signatures[i], uid.signatures[j] = uid.signatures[j], uid.signatures[i]
+		}
+		buf.Reset()
+		assert.Nil(t, WritePackets(&buf, key))
+		var keys []*Pubkey
+		for keyRead := range ReadKeys(&buf) {
+			assert.Nil(t, keyRead.Error)
+			keys = append(keys, keyRead.Pubkey)
+		}
+		if assert.Equal(t, 1, len(keys), name) {
+			assert.Equal(t, name == "revoked_uid.asc", keys[0].UserIdByKeyword(keyword).IsRevoked(), name)
+		}
+	}
+}
+
+func TestEffectiveStatus(t *testing.T) {
+	// Valid until the key lifetime in its only self-signature runs out.
+	key := MustInputAscKey(t, "expire_old.asc")
+	assert.Nil(t, key.ResolveExpiration())
+	oldExpiration := key.Expiration
+	assert.Equal(t, StatusValid, key.EffectiveStatus(key.Creation.Add(time.Hour)))
+	assert.Equal(t, StatusExpired, key.EffectiveStatus(oldExpiration.Add(time.Hour)))
+
+	// The newest self-signature wins over an older one that has run out.
+	update := MustInputAscKey(t, "expire_new.asc")
+	assert.Nil(t, update.ResolveExpiration())
+	MergeKey(key, update)
+	assert.Equal(t, 3, len(key.userIds[0].signatures))
+	assert.Equal(t, StatusValid, key.EffectiveStatus(oldExpiration.Add(time.Hour)))
+	assert.Equal(t, StatusExpired, key.EffectiveStatus(update.Expiration.Add(time.Hour)))
+
+	// Revocation takes precedence over expiration.
+	key.revSig = key.userIds[0].selfSignature
+	assert.Equal(t, StatusRevoked, key.EffectiveStatus(key.Creation.Add(time.Hour)))
+	assert.Equal(t, StatusRevoked, key.EffectiveStatus(update.Expiration.Add(time.Hour)))
+
+	// A key revocation applies even with a validly self-signed user ID.
+	key = MustInputAscKey(t, "revoked_uid.asc")
+	now := key.Creation.Add(time.Hour)
+	assert.Equal(t, StatusRevoked, key.EffectiveStatus(now))
+
+	// So does revoking every self-certified user ID.
+	key.revSig = nil
+	assert.Equal(t, StatusValid, key.EffectiveStatus(now))
+	key.userIds = []*UserId{key.UserIdByKeyword("Revoke Test <old@example.com>")}
+	assert.Equal(t, StatusRevoked, key.EffectiveStatus(now))
+
+	// A self-signature newer than the revocation makes the key valid again.
+	key = MustInputAscKey(t, "recertified_uid.asc")
+	assert.Equal(t, StatusValid, key.EffectiveStatus(now))
+
+	key.userIds = nil
+	assert.Equal(t, StatusUnknown, key.EffectiveStatus(now))
+	assert.Equal(t, "unknown", StatusUnknown.String())
+	assert.Equal(t, "revoked", StatusRevoked.String())
+}
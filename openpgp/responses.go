@@ -68,11 +68,13 @@ type AddResponse struct {
 	Errors  []*ReadKeyResult
 }
 
+var ErrAddFailed = errors.New("One or more keys had an error")
+
 func (r *AddResponse) Error() error {
 	if len(r.Changes) > 0 || len(r.Errors) == 0 {
 		return nil
 	}
-	return errors.New("One or more keys had an error")
+	return ErrAddFailed
 }
 
 func (r *AddResponse) WriteTo(w http.ResponseWriter) (err error) {
@@ -137,7 +139,11 @@ func (r *StatsResponse) WriteTo(w http.ResponseWriter) (err error) {
 			"http_port": r.Stats.Port,
 			"numkeys":   r.Stats.TotalKeys,
 			"software":  filepath.Base(os.Args[0]),
-			"version":   hockeypuck.Version}
+			"version":   hockeypuck.Version,
+			"nodename":  r.Stats.NodeName}
+		if r.Stats.AdminContact != "" {
+			msg["contact"] = r.Stats.AdminContact
+		}
 		// Convert hourly stats
 		hours := []interface{}{}
 		for _, hour := range r.Stats.KeyStatsHourly {
@@ -187,8 +193,9 @@ func (k *KeyringResponse) Error() error {
 }
 
 func (k *KeyringResponse) WriteTo(w http.ResponseWriter) error {
+	opts := Config().ArmorOptions()
 	for _, key := range k.Keys {
-		err := WriteArmoredPackets(w, key)
+		err := WriteArmoredPacketsOpts(w, key, opts)
 		if err != nil {
 			return err
 		}
@@ -20,15 +20,18 @@ package openpgp
 import (
 	"bytes"
 	"crypto/md5"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/cmars/conflux/recon"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/hockeypuck/hockeypuck"
 	"github.com/hockeypuck/hockeypuck/hkp"
 )
 
@@ -72,3 +75,132 @@ func TestHashqueryRequest(t *testing.T) {
 	assert.Equal(t, refDigestStr, hq.Digests[0])
 	t.Log(hq.Digests)
 }
+
+func TestWriteMRIndex(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	var buf bytes.Buffer
+	err := key.WriteMRIndex(&buf, true)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, fmt.Sprintf("pub:%s:%d:%d:%d::",
+		strings.ToUpper(key.Fingerprint()), key.Algorithm, key.BitLen, key.Creation.Unix()), lines[0])
+
+	// Without the fingerprint option, the key is listed by its key ID.
+	var short bytes.Buffer
+	assert.Nil(t, key.WriteMRIndex(&short, false))
+	assert.True(t, strings.HasPrefix(short.String(), "pub:"+strings.ToUpper(key.ShortId())+":"), short.String())
+	assert.True(t, strings.HasPrefix(lines[1], "uid:"))
+	assert.True(t, strings.HasPrefix(lines[2], "sub:"+strings.ToUpper(key.Subkeys()[0].Fingerprint())+":"))
+	t.Log(buf.String())
+
+	key = MustInputAscKey(t, "revoked_subkey.asc")
+	buf.Reset()
+	assert.Nil(t, key.WriteMRIndex(&buf, true))
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.True(t, strings.HasSuffix(lines[2], ":r"), lines[2])
+}
+
+func TestMrEscape(t *testing.T) {
+	assert.Equal(t, "Alice %3A) %25 <alice@example.com>", mrEscape("Alice :) % <alice@example.com>"))
+	// UTF-8 user IDs are escaped byte by byte.
+	assert.Equal(t, "J%C3%BCrgen <j@example.com>", mrEscape("Jürgen <j@example.com>"))
+}
+
+func TestIndexResponseTruncated(t *testing.T) {
+	uuids := []string{"a", "b", "c"}
+	limited, truncated := limitUuids(uuids, 2)
+	assert.Equal(t, []string{"a", "b"}, limited)
+	assert.True(t, truncated)
+	limited, truncated = limitUuids(uuids, 3)
+	assert.Equal(t, uuids, limited)
+	assert.False(t, truncated)
+
+	key := MustInputAscKey(t, "sksdigest.asc")
+	for _, op := range []hkp.Operation{hkp.Index, hkp.Vindex} {
+		for _, truncated := range []bool{false, true} {
+			resp := &IndexResponse{Lookup: &hkp.Lookup{Op: op, Search: "alice"},
+				Keys: []*Pubkey{key}, Verbose: op == hkp.Vindex, Truncated: truncated}
+			rec := httptest.NewRecorder()
+			assert.Nil(t, resp.WriteTo(rec))
+			assert.Equal(t, truncated, strings.Contains(rec.Body.String(),
+				"Only the first 1 matching keys are shown."))
+			assert.True(t, strings.HasSuffix(rec.Body.String(), "</body></html>"))
+		}
+	}
+
+	// The machine-readable index honors the fingerprint option.
+	for _, fingerprint := range []bool{false, true} {
+		resp := &IndexResponse{Lookup: &hkp.Lookup{Op: hkp.Index, Search: "alice",
+			Option: hkp.MachineReadable, Fingerprint: fingerprint}, Keys: []*Pubkey{key}}
+		rec := httptest.NewRecorder()
+		assert.Nil(t, resp.WriteTo(rec))
+		assert.Equal(t, fingerprint, strings.Contains(rec.Body.String(),
+			"pub:"+strings.ToUpper(key.Fingerprint())+":"))
+		assert.Equal(t, !fingerprint, strings.Contains(rec.Body.String(),
+			"pub:"+strings.ToUpper(key.ShortId())+":"))
+	}
+}
+
+func TestFormatFingerprint(t *testing.T) {
+	fp := "0123456789abcdef0123456789abcdef01234567"
+	assert.Equal(t, fp, FormatFingerprint(fp, FingerprintPlain))
+	assert.Equal(t, "0123 4567 89ab cdef 0123  4567 89ab cdef 0123 4567",
+		FormatFingerprint(fp, FingerprintSpaced))
+	assert.Equal(t, "01:23:45:67:89:ab:cd:ef:01:23:45:67:89:ab:cd:ef:01:23:45:67",
+		FormatFingerprint(fp, FingerprintColons))
+	assert.Equal(t, fp, FormatFingerprint(fp, "dotted"))
+}
+
+func TestFingerprintStyle(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig("")
+	assert.Equal(t, FingerprintSpaced, Config().FingerprintStyle())
+
+	key := MustInputAscKey(t, "sksdigest.asc")
+	for style, expect := range map[string]string{
+		FingerprintPlain:  strings.ToUpper(key.Fingerprint()),
+		FingerprintSpaced: strings.ToUpper(FormatFingerprint(key.Fingerprint(), FingerprintSpaced)),
+		FingerprintColons: strings.ToUpper(FormatFingerprint(key.Fingerprint(), FingerprintColons)),
+	} {
+		hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+fingerprintStyle=%q
+`, strings.ToUpper(style)))
+		assert.Nil(t, Config().Validate())
+		assert.Equal(t, style, Config().FingerprintStyle())
+		resp := &IndexResponse{Lookup: &hkp.Lookup{Op: hkp.Index, Search: "alice", Fingerprint: true},
+			Keys: []*Pubkey{key}}
+		rec := httptest.NewRecorder()
+		assert.Nil(t, resp.WriteTo(rec))
+		assert.Contains(t, rec.Body.String(), "Fingerprint="+expect+"\n")
+	}
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+fingerprintStyle="dotted"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestIndexExpiredWarning(t *testing.T) {
+	key := MustInputAscKey(t, "expire_old.asc")
+	for _, op := range []hkp.Operation{hkp.Index, hkp.Vindex} {
+		resp := &IndexResponse{Lookup: &hkp.Lookup{Op: op, Search: "expire"},
+			Keys: []*Pubkey{key}, Verbose: op == hkp.Vindex}
+		rec := httptest.NewRecorder()
+		assert.Nil(t, resp.WriteTo(rec))
+		assert.NotContains(t, rec.Body.String(), "[expired]")
+	}
+
+	// Shorten the key lifetime so that it has expired by now.
+	lifetime := uint32(1)
+	key.userIds[0].selfSignature.Signature.KeyLifetimeSecs = &lifetime
+	for _, op := range []hkp.Operation{hkp.Index, hkp.Vindex} {
+		resp := &IndexResponse{Lookup: &hkp.Lookup{Op: op, Search: "expire"},
+			Keys: []*Pubkey{key}, Verbose: op == hkp.Vindex}
+		rec := httptest.NewRecorder()
+		assert.Nil(t, resp.WriteTo(rec))
+		assert.Contains(t, rec.Body.String(), `<span class="warn">[expired]</span>`)
+	}
+}
@@ -151,7 +151,9 @@ signer TEXT NOT NULL,
 -- Matched reference to the signer in *this* database, if found
 signer_uuid TEXT,
 -- Reference to a revocation on this signature, if any
-revsig_uuid TEXT
+revsig_uuid TEXT,
+-- Hash algorithm, RFC 4880, Section 9.4
+hash_algo INTEGER NOT NULL DEFAULT 0
 )`
 
 const Cr_openpgp_subkey = `
@@ -247,6 +249,11 @@ PRIMARY KEY (uuid),
 UNIQUE (email_addr)
 )`
 
+// Columns added since the tables were first created are added to existing
+// databases when the tables are created.
+const Alt_openpgp_sig_hash_algo = `
+ALTER TABLE openpgp_sig ADD COLUMN IF NOT EXISTS hash_algo INTEGER NOT NULL DEFAULT 0`
+
 var CreateTablesSql []string = []string{
 	Cr_openpgp_pubkey,
 	Cr_openpgp_sig,
@@ -254,12 +261,14 @@ var CreateTablesSql []string = []string{
 	Cr_openpgp_uid,
 	Cr_openpgp_uat,
 	Cr_pks_status,
+	Alt_openpgp_sig_hash_algo,
 }
 
 var Cr_openpgp_pubkey_constraints []string = []string{
 	`ALTER TABLE openpgp_pubkey ADD CONSTRAINT openpgp_pubkey_pk PRIMARY KEY (uuid);`,
 	`ALTER TABLE openpgp_pubkey ADD CONSTRAINT openpgp_pubkey_md5 UNIQUE (md5);`,
 	`ALTER TABLE openpgp_pubkey ADD CONSTRAINT openpgp_pubkey_sha256 UNIQUE (sha256);`,
+	`CREATE INDEX openpgp_pubkey_sha256_recon ON openpgp_pubkey (substr(sha256, 1, 32));`,
 	`CREATE INDEX openpgp_pubkey_ctime ON openpgp_pubkey (ctime);`,
 	`CREATE INDEX openpgp_pubkey_mtime ON openpgp_pubkey (mtime);`,
 }
@@ -390,6 +399,7 @@ var Dr_openpgp_pubkey_constraints []string = []string{
 	`ALTER TABLE openpgp_pubkey DROP CONSTRAINT openpgp_pubkey_pk;`,
 	`ALTER TABLE openpgp_pubkey DROP CONSTRAINT openpgp_pubkey_md5;`,
 	`ALTER TABLE openpgp_pubkey DROP CONSTRAINT openpgp_pubkey_sha256;`,
+	`DROP INDEX openpgp_pubkey_sha256_recon;`,
 	`DROP INDEX openpgp_pubkey_ctime;`,
 	`DROP INDEX openpgp_pubkey_mtime;`,
 }
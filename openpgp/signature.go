@@ -19,6 +19,7 @@ package openpgp
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/ascii85"
@@ -26,13 +27,19 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"strings"
 	"time"
 
 	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.crypto/openpgp/s2k"
 
 	"github.com/hockeypuck/hockeypuck/util"
 )
 
+// SigTypeDirectKey is the signature type of a direct-key signature, made by a
+// key over itself to state key-wide preferences and designated revokers.
+const SigTypeDirectKey = 0x1F
+
 type Signature struct {
 	ScopedDigest       string         `db:"uuid"`        // immutable
 	Creation           time.Time      `db:"creation"`    // immutable
@@ -43,6 +50,7 @@ type Signature struct {
 	RIssuerKeyId       string         `db:"signer"`      // immutable
 	RIssuerFingerprint sql.NullString `db:"signer_uuid"` // mutable
 	RevSigDigest       sql.NullString `db:"revsig_uuid"` // mutable
+	HashAlgo           int            `db:"hash_algo"`   // immutable
 
 	/* Containment references */
 
@@ -56,6 +64,10 @@ type Signature struct {
 
 	revSig *Signature
 
+	// Issuer fingerprint claimed by the signature packet. This is kept apart
+	// from RIssuerFingerprint, which only references keys in the database.
+	rIssuerFpr string
+
 	/* Parsed packet data */
 
 	Signature   *packet.Signature
@@ -66,12 +78,40 @@ func (sig *Signature) IssuerKeyId() string {
 	return util.Reverse(sig.RIssuerKeyId)
 }
 
+// NormalizeIssuer returns the lower-case 16-digit hex key ID of a signer
+// given by its key ID, V4 fingerprint or V5 fingerprint in hex, with or
+// without a "0x" prefix, so that signers identified either way can be
+// compared. Returns the empty string if the issuer is not in any of these
+// forms.
+func NormalizeIssuer(issuer string) string {
+	issuer = strings.ToLower(issuer)
+	issuer = strings.TrimPrefix(issuer, "0x")
+	if _, err := hex.DecodeString(issuer); err != nil {
+		return ""
+	}
+	switch len(issuer) {
+	case 16:
+		return issuer
+	case 40:
+		return issuer[24:]
+	case v5FingerprintLen:
+		return issuer[:16]
+	}
+	return ""
+}
+
 func (sig *Signature) IssuerShortId() string {
 	return sig.IssuerKeyId()[8:16]
 }
 
+// IssuerFingerprint returns the fingerprint of the signer key found in the
+// database, or else the issuer fingerprint claimed by the signature packet,
+// if any.
 func (sig *Signature) IssuerFingerprint() string {
-	return util.Reverse(sig.RIssuerFingerprint.String)
+	if sig.RIssuerFingerprint.Valid {
+		return util.Reverse(sig.RIssuerFingerprint.String)
+	}
+	return util.Reverse(sig.rIssuerFpr)
 }
 
 func toAscii85String(buf []byte) string {
@@ -88,7 +128,7 @@ func (sig *Signature) calcScopedDigest(pubkey *Pubkey, scope string) string {
 	h.Write([]byte("{sig}"))
 	h.Write([]byte(scope))
 	h.Write([]byte("{sig}"))
-	h.Write(sig.Packet)
+	h.Write(canonicalPacket(sig.Packet))
 	return toAscii85String(h.Sum(nil))
 }
 
@@ -127,6 +167,13 @@ func (sig *Signature) setPacket(p packet.Packet) (err error) {
 }
 
 func (sig *Signature) Read() (err error) {
+	if sig.Packet, err = unpackBytes(sig.Packet); err != nil {
+		return
+	}
+	if sig.isV6() {
+		// Kept unparsed.
+		return nil
+	}
 	buf := bytes.NewBuffer(sig.Packet)
 	var p packet.Packet
 	if p, err = packet.Read(buf); err != nil {
@@ -163,11 +210,59 @@ func NewSignature(op *packet.OpaquePacket) (sig *Signature, err error) {
 	return
 }
 
+// NewV6Signature returns a V6 signature, which is not supported by the packet
+// library. The signature is kept unparsed, with its type, creation and
+// issuer read from the packet, so that it stays with the key material it
+// certifies. It cannot be verified.
+func NewV6Signature(op *packet.OpaquePacket) (sig *Signature, err error) {
+	var buf bytes.Buffer
+	if err = op.Serialize(&buf); err != nil {
+		return
+	}
+	sig = &Signature{Packet: buf.Bytes()}
+	return sig, sig.initV6()
+}
+
+func (sig *Signature) isV6() bool {
+	op, err := toOpaquePacket(sig.Packet)
+	return err == nil && len(op.Contents) > 0 && op.Contents[0] == 6
+}
+
+func (sig *Signature) initV6() (err error) {
+	op, err := toOpaquePacket(sig.Packet)
+	if err != nil {
+		return err
+	}
+	if len(op.Contents) < 4 || op.Contents[0] != 6 {
+		return ErrInvalidPacketType
+	}
+	sig.SigType = int(op.Contents[1])
+	sig.HashAlgo = int(op.Contents[3])
+	created := sig.hashedSubpacket(2) // Signature creation time
+	if len(created) != 4 {
+		return ErrInvalidPacketType
+	}
+	sig.Creation = time.Unix(int64(binary.BigEndian.Uint32(created)), 0).UTC()
+	sig.Expiration = NeverExpires
+	if lifetime := sig.hashedSubpacket(3); len(lifetime) == 4 && binary.BigEndian.Uint32(lifetime) > 0 {
+		sig.Expiration = sig.Creation.Add(time.Duration(binary.BigEndian.Uint32(lifetime)) * time.Second)
+	}
+	// V6 signatures identify their issuer by fingerprint.
+	fpr := sig.issuerFingerprintSubpacket()
+	if fpr == "" {
+		return ErrMissingIssuer
+	}
+	sig.rIssuerFpr = util.Reverse(fpr)
+	sig.RIssuerKeyId = util.Reverse(NormalizeIssuer(fpr))
+	return nil
+}
+
 func (sig *Signature) initV3() (err error) {
-	sig.Creation = sig.SignatureV3.CreationTime
+	sig.Creation = sig.SignatureV3.CreationTime.UTC()
 	// V3 packets do not have an expiration time
 	sig.Expiration = NeverExpires
 	sig.SigType = int(sig.SignatureV3.SigType)
+	sig.HashAlgo = hashAlgoId(sig.SignatureV3.Hash)
 	// Extract the issuer key id
 	var issuerKeyId [8]byte
 	binary.BigEndian.PutUint64(issuerKeyId[:], sig.SignatureV3.IssuerKeyId)
@@ -176,32 +271,301 @@ func (sig *Signature) initV3() (err error) {
 	return
 }
 
+var ErrMissingIssuer = errors.New("Signature missing issuer key ID")
+
 func (sig *Signature) initV4() (err error) {
-	if sig.Signature.IssuerKeyId == nil {
-		return errors.New("Signature missing issuer key ID")
+	fpr := sig.issuerFingerprintSubpacket()
+	if sig.Signature.IssuerKeyId == nil && fpr == "" {
+		return ErrMissingIssuer
 	}
-	sig.Creation = sig.Signature.CreationTime
+	sig.Creation = sig.Signature.CreationTime.UTC()
 	sig.Expiration = NeverExpires
 	sig.SigType = int(sig.Signature.SigType)
+	sig.HashAlgo = hashAlgoId(sig.Signature.Hash)
 	// Extract the issuer key id
 	var issuerKeyId [8]byte
 	if sig.Signature.IssuerKeyId != nil {
 		binary.BigEndian.PutUint64(issuerKeyId[:], *sig.Signature.IssuerKeyId)
 		sigKeyId := hex.EncodeToString(issuerKeyId[:])
 		sig.RIssuerKeyId = util.Reverse(sigKeyId)
+	} else {
+		// Only identified by the issuer fingerprint.
+		sig.RIssuerKeyId = util.Reverse(NormalizeIssuer(fpr))
+	}
+	// Issuer fingerprint, which must agree with the issuer key ID
+	if fpr != "" {
+		sig.rIssuerFpr = util.Reverse(fpr)
+		if keyIdOf(sig.rIssuerFpr, 16) != sig.IssuerKeyId() {
+			sig.State |= PacketStateIssuerMismatch
+		}
 	}
 	// Expiration time
 	if sig.Signature.SigLifetimeSecs != nil {
-		sig.Expiration = sig.Signature.CreationTime.Add(
+		sig.Expiration = sig.Creation.Add(
 			time.Duration(*sig.Signature.SigLifetimeSecs) * time.Second)
 	}
 	return
 }
 
+// Hash algorithm IDs, RFC 4880, Section 9.4.
+const (
+	HashAlgoMD5       = 1
+	HashAlgoSHA1      = 2
+	HashAlgoRIPEMD160 = 3
+	HashAlgoSHA256    = 8
+	HashAlgoSHA384    = 9
+	HashAlgoSHA512    = 10
+	HashAlgoSHA224    = 11
+)
+
+var hashAlgoNames = map[int]string{
+	HashAlgoMD5:       "MD5",
+	HashAlgoSHA1:      "SHA-1",
+	HashAlgoRIPEMD160: "RIPEMD-160",
+	HashAlgoSHA256:    "SHA-256",
+	HashAlgoSHA384:    "SHA-384",
+	HashAlgoSHA512:    "SHA-512",
+	HashAlgoSHA224:    "SHA-224",
+}
+
+// hashAlgoId returns the RFC 4880 ID of the hash function, or 0 if it has
+// none.
+func hashAlgoId(h crypto.Hash) int {
+	id, _ := s2k.HashToHashId(h)
+	return int(id)
+}
+
+// HashAlgorithmName returns the name of the hash algorithm used to make the
+// signature, such as "SHA-256", or "unknown" if it is not recognized.
+func (sig *Signature) HashAlgorithmName() string {
+	if name, ok := hashAlgoNames[sig.HashAlgo]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 func (sig *Signature) Visit(visitor PacketVisitor) (err error) {
 	return visitor(sig)
 }
 
+// IsExpired returns whether the signature itself has expired at the given
+// time. This is independent of the lifetime of the key it certifies.
+func (sig *Signature) IsExpired(now time.Time) bool {
+	expiration := sig.Expiration
+	if sig.Signature != nil {
+		// Self-signature expiration may have been extended to the key lifetime
+		// when resolved, so go back to the signature lifetime in the packet.
+		if sig.Signature.SigLifetimeSecs == nil || *sig.Signature.SigLifetimeSecs == 0 {
+			return false
+		}
+		expiration = sig.Creation.Add(time.Duration(*sig.Signature.SigLifetimeSecs) * time.Second)
+	}
+	if expiration.IsZero() || expiration.Unix() == NeverExpires.Unix() {
+		return false
+	}
+	return now.After(expiration)
+}
+
+// sigSubpacket is a raw OpenPGP V4 signature subpacket.
+type sigSubpacket struct {
+	Type     byte
+	Hashed   bool
+	Contents []byte
+}
+
+var ErrInvalidSubpackets = errors.New("Invalid signature subpacket data")
+
+// subpackets returns the hashed and unhashed subpackets of a V4 or V6
+// signature.
+func (sig *Signature) subpackets() (result []*sigSubpacket, err error) {
+	op, err := toOpaquePacket(sig.Packet)
+	if err != nil {
+		return nil, err
+	}
+	buf := op.Contents
+	if len(buf) < 4 || (buf[0] != 4 && buf[0] != 6) {
+		return nil, nil
+	}
+	// V6 subpacket areas have four-octet lengths.
+	countLen := 2
+	if buf[0] == 6 {
+		countLen = 4
+	}
+	buf = buf[4:]
+	for _, hashed := range []bool{true, false} {
+		if len(buf) < countLen {
+			return nil, ErrInvalidSubpackets
+		}
+		var n int
+		if countLen == 4 {
+			n = int(binary.BigEndian.Uint32(buf[:4]))
+		} else {
+			n = int(buf[0])<<8 | int(buf[1])
+		}
+		if n < 0 || len(buf) < countLen+n {
+			return nil, ErrInvalidSubpackets
+		}
+		area := buf[countLen : countLen+n]
+		buf = buf[countLen+n:]
+		for len(area) > 0 {
+			var length, hdrLen int
+			switch {
+			case area[0] < 192:
+				length, hdrLen = int(area[0]), 1
+			case area[0] < 255:
+				if len(area) < 2 {
+					return nil, ErrInvalidSubpackets
+				}
+				length, hdrLen = (int(area[0])-192)<<8+int(area[1])+192, 2
+			default:
+				if len(area) < 5 {
+					return nil, ErrInvalidSubpackets
+				}
+				length, hdrLen = int(binary.BigEndian.Uint32(area[1:5])), 5
+			}
+			if length < 1 || len(area) < hdrLen+length {
+				return nil, ErrInvalidSubpackets
+			}
+			result = append(result, &sigSubpacket{
+				Type:     area[hdrLen] & 0x7f,
+				Hashed:   hashed,
+				Contents: area[hdrLen+1 : hdrLen+length],
+			})
+			area = area[hdrLen+length:]
+		}
+	}
+	return result, nil
+}
+
+// withoutUnhashed returns the contents of a V4 or V6 signature packet with
+// its unhashed subpacket area left empty. Other signatures, and signatures
+// too short to hold the subpacket areas, are returned as they are.
+func withoutUnhashed(contents []byte) []byte {
+	if len(contents) < 4 || (contents[0] != 4 && contents[0] != 6) {
+		return contents
+	}
+	countLen := 2
+	if contents[0] == 6 {
+		countLen = 4
+	}
+	areaLen := func(buf []byte) int {
+		if countLen == 4 {
+			return int(binary.BigEndian.Uint32(buf[:4]))
+		}
+		return int(buf[0])<<8 | int(buf[1])
+	}
+	hashedEnd := 4 + countLen
+	if len(contents) < hashedEnd {
+		return contents
+	}
+	hashedEnd += areaLen(contents[4:])
+	if hashedEnd < 0 || len(contents) < hashedEnd+countLen {
+		return contents
+	}
+	unhashedEnd := hashedEnd + countLen + areaLen(contents[hashedEnd:])
+	if unhashedEnd < hashedEnd || len(contents) < unhashedEnd {
+		return contents
+	}
+	result := append([]byte(nil), contents[:hashedEnd]...)
+	result = append(result, make([]byte, countLen)...)
+	return append(result, contents[unhashedEnd:]...)
+}
+
+// EquivalenceDigest returns a digest of the signature that ignores its
+// unhashed subpackets. These are not covered by the signature and anyone
+// may add or change them, so two copies of a signature differing only there
+// are the same signature, though their packets and scoped digests differ.
+// The stored packet is not changed.
+func (sig *Signature) EquivalenceDigest() string {
+	op, err := toOpaquePacket(sig.Packet)
+	if err != nil {
+		return sig.ScopedDigest
+	}
+	h := sha256.New()
+	h.Write([]byte{op.Tag})
+	h.Write(withoutUnhashed(op.Contents))
+	return toAscii85String(h.Sum(nil))
+}
+
+// CollapseEquivalentSignatures returns the signatures without any that are
+// equivalent to an earlier one, differing from it only in unhashed
+// subpackets. The first copy of each is kept, in the original order. The
+// signatures themselves are not modified.
+func CollapseEquivalentSignatures(sigs []*Signature) (result []*Signature) {
+	seen := make(map[string]bool)
+	for _, sig := range sigs {
+		digest := sig.EquivalenceDigest()
+		if !seen[digest] {
+			seen[digest] = true
+			result = append(result, sig)
+		}
+	}
+	return
+}
+
+// RevocationReason returns the reason code and explanation given in the
+// reason-for-revocation subpacket of the signature. ok is false if the
+// signature has no such subpacket.
+func (sig *Signature) RevocationReason() (code byte, text string, ok bool) {
+	reason := sig.hashedSubpacket(29) // Reason for revocation
+	if len(reason) == 0 {
+		return 0, "", false
+	}
+	return reason[0], string(reason[1:]), true
+}
+
+// hashedSubpacket returns the contents of the first hashed subpacket of the
+// given type, or nil if there is none.
+func (sig *Signature) hashedSubpacket(spType byte) []byte {
+	subpackets, err := sig.subpackets()
+	if err != nil {
+		return nil
+	}
+	for _, sp := range subpackets {
+		if sp.Type == spType && sp.Hashed {
+			return sp.Contents
+		}
+	}
+	return nil
+}
+
+// revocationKeys returns the hex fingerprints of the designated revokers
+// named in the hashed revocation key subpackets. Each subpacket holds a
+// class octet, the revoker's public key algorithm and its fingerprint.
+func (sig *Signature) revocationKeys() (result []string) {
+	subpackets, err := sig.subpackets()
+	if err != nil {
+		return nil
+	}
+	for _, sp := range subpackets {
+		if sp.Type == 12 && sp.Hashed && len(sp.Contents) == 22 { // Revocation key
+			result = append(result, hex.EncodeToString(sp.Contents[2:]))
+		}
+	}
+	return
+}
+
+// issuerFingerprintSubpacket returns the hex fingerprint from the issuer
+// fingerprint subpacket of a V4 signature, or the empty string if there is
+// none. The subpacket holds the version of the signer key, followed by its
+// fingerprint.
+func (sig *Signature) issuerFingerprintSubpacket() string {
+	subpackets, err := sig.subpackets()
+	if err != nil {
+		return ""
+	}
+	for _, sp := range subpackets {
+		if sp.Type != 33 { // issuer fingerprint
+			continue
+		}
+		if len(sp.Contents) == 21 && sp.Contents[0] == 4 ||
+			len(sp.Contents) == 33 && (sp.Contents[0] == 5 || sp.Contents[0] == 6) {
+			return hex.EncodeToString(sp.Contents[1:])
+		}
+	}
+	return ""
+}
+
 func (sig *Signature) IsPrimary() bool {
 	return sig.Signature != nil && sig.Signature.IsPrimaryId != nil && *sig.Signature.IsPrimaryId
 }
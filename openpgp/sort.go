@@ -57,6 +57,30 @@ func (s *uidSorter) Swap(i, j int) {
 	s.userIds[i], s.userIds[j] = s.userIds[j], s.userIds[i]
 }
 
+// displayUidSorter orders user IDs for display: the primary user ID first,
+// then by most recent self-signature.
+type displayUidSorter struct {
+	userIds []*UserId
+	primary *UserId
+}
+
+func (s *displayUidSorter) Len() int { return len(s.userIds) }
+
+func (s *displayUidSorter) Less(i, j int) bool {
+	if (s.userIds[i] == s.primary) != (s.userIds[j] == s.primary) {
+		return s.userIds[i] == s.primary
+	}
+	iSig, jSig := s.userIds[i].selfSignature, s.userIds[j].selfSignature
+	if iSig != nil && jSig != nil {
+		return iSig.Creation.Unix() > jSig.Creation.Unix()
+	}
+	return iSig != nil
+}
+
+func (s *displayUidSorter) Swap(i, j int) {
+	s.userIds[i], s.userIds[j] = s.userIds[j], s.userIds[i]
+}
+
 type uatSorter struct {
 	*Pubkey
 }
@@ -121,3 +145,12 @@ func Sort(pubkey *Pubkey) {
 	sort.Sort(&uatSorter{pubkey})
 	sort.Sort(&subkeySorter{pubkey})
 }
+
+// SortUserIds reorders the user IDs of the key for display, with the primary
+// user ID first and the rest by the creation time of their self-signatures,
+// newest first. User IDs without a self-signature go last, in their existing
+// order. This does not affect the key digest, which is calculated over the
+// packets in SKS order.
+func (pubkey *Pubkey) SortUserIds() {
+	sort.Stable(&displayUidSorter{userIds: pubkey.userIds, primary: pubkey.PrimaryUserId()})
+}
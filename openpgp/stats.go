@@ -20,7 +20,9 @@ package openpgp
 import (
 	"log"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -129,6 +131,8 @@ type HkpStats struct {
 	Timestamp      time.Time
 	Hostname       string
 	Port           int
+	NodeName       string
+	AdminContact   string
 	Version        string
 	PksPeers       []PksStatus
 	TotalKeys      int
@@ -142,6 +146,8 @@ func (s *HkpStats) NotReady() bool {
 
 func (s *HkpStats) fetchServerInfo(l *hkp.Lookup) {
 	s.Timestamp = time.Now()
+	s.NodeName = Config().NodeName()
+	s.AdminContact = Config().AdminContact()
 	if host, port, err := net.SplitHostPort(l.Host); err == nil {
 		s.Hostname = host
 		if s.Port, err = strconv.Atoi(port); err != nil {
@@ -153,6 +159,265 @@ func (s *HkpStats) fetchServerInfo(l *hkp.Lookup) {
 	}
 }
 
+const (
+	SigCountPrimary = "_primary"
+	SigCountSubkeys = "_subkeys"
+)
+
+// sigCounter is a packet visitor that counts signatures by the packet they
+// certify.
+type sigCounter struct {
+	counts map[string]int
+	bucket string
+}
+
+func (c *sigCounter) visit(rec PacketRecord) error {
+	switch r := rec.(type) {
+	case *Pubkey:
+		c.bucket = SigCountPrimary
+	case *UserId:
+		c.bucket = r.Keywords
+	case *UserAttribute:
+		c.bucket = SigCountPrimary
+	case *Subkey:
+		c.bucket = SigCountSubkeys
+	case *Signature:
+		c.counts[c.bucket]++
+	}
+	return nil
+}
+
+// SignatureCounts returns the number of signatures on the key, keyed by the
+// keywords of the user ID they certify. Signatures directly on the primary key
+// and on user attributes are counted under SigCountPrimary, and signatures on
+// subkeys under SigCountSubkeys. Useful for finding keys flooded with
+// certifications.
+func (pubkey *Pubkey) SignatureCounts() map[string]int {
+	c := &sigCounter{counts: make(map[string]int)}
+	pubkey.Visit(c.visit)
+	return c.counts
+}
+
+// Certification is a third-party signature over one of a key's user IDs.
+type Certification struct {
+	UserId      string
+	IssuerKeyId string
+	SigType     int
+	Creation    time.Time
+}
+
+// certCollector is a packet visitor that collects third-party certifications
+// on user IDs, keyed by issuer key ID.
+type certCollector struct {
+	pubkey *Pubkey
+	certs  map[string][]Certification
+	userId *UserId
+}
+
+func (c *certCollector) visit(rec PacketRecord) error {
+	switch r := rec.(type) {
+	case *Pubkey, *UserAttribute, *Subkey:
+		c.userId = nil
+	case *UserId:
+		c.userId = r
+	case *Signature:
+		if c.userId == nil {
+			return nil
+		}
+		if !(r.SigType >= 0x10 && r.SigType <= 0x13) && r.SigType != 0x30 {
+			return nil
+		}
+		if strings.HasPrefix(c.pubkey.RFingerprint, r.RIssuerKeyId) {
+			return nil
+		}
+		issuer := NormalizeIssuer(r.IssuerKeyId())
+		c.certs[issuer] = append(c.certs[issuer], Certification{
+			UserId:      c.userId.Keywords,
+			IssuerKeyId: issuer,
+			SigType:     r.SigType,
+			Creation:    r.Creation,
+		})
+	}
+	return nil
+}
+
+// Certifications returns the certifications and certification revocations
+// made on the key's user IDs by other keys, grouped by issuer key ID.
+// Self-signatures are excluded.
+func (pubkey *Pubkey) Certifications() map[string][]Certification {
+	c := &certCollector{pubkey: pubkey, certs: make(map[string][]Certification)}
+	pubkey.Visit(c.visit)
+	return c.certs
+}
+
+type certSorter struct {
+	certs []Certification
+}
+
+func (s *certSorter) Len() int { return len(s.certs) }
+
+func (s *certSorter) Less(i, j int) bool {
+	return s.certs[i].Creation.Unix() < s.certs[j].Creation.Unix()
+}
+
+func (s *certSorter) Swap(i, j int) {
+	s.certs[i], s.certs[j] = s.certs[j], s.certs[i]
+}
+
+// hasCertification returns whether any of an issuer's certifications has not
+// been cancelled by a later certification revocation from that issuer on the
+// same user ID.
+func hasCertification(certs []Certification) bool {
+	events := make([]Certification, len(certs))
+	copy(events, certs)
+	sort.Stable(&certSorter{events})
+	pending := make(map[string]int)
+	for _, cert := range events {
+		if cert.SigType != 0x30 {
+			pending[cert.UserId]++
+		} else if pending[cert.UserId] > 0 {
+			pending[cert.UserId]--
+		}
+	}
+	for _, n := range pending {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WebOfTrustInDegree returns the number of distinct other keys which have
+// certified any of each key's user IDs, by key fingerprint. Self-signatures
+// and signers whose certifications have all been revoked are not counted.
+func WebOfTrustInDegree(keys []*Pubkey) map[string]int {
+	result := make(map[string]int)
+	for _, key := range keys {
+		certs := key.Certifications()
+		n := 0
+		for _, issuer := range key.IssuerKeyIds() {
+			if hasCertification(certs[issuer]) {
+				n++
+			}
+		}
+		result[key.Fingerprint()] = n
+	}
+	return result
+}
+
+// CertificationTarget returns the keywords of the user ID that a signature on
+// the key certifies. Signatures directly on the primary key or on a user
+// attribute return SigCountPrimary, and signatures on a subkey return
+// SigCountSubkeys, the same buckets used by SignatureCounts. Returns an empty
+// string if the signature is not on the key.
+func (pubkey *Pubkey) CertificationTarget(sig *Signature) string {
+	has := func(sigs []*Signature) bool {
+		for _, s := range sigs {
+			if s == sig {
+				return true
+			}
+		}
+		return false
+	}
+	for _, uid := range pubkey.userIds {
+		if has(uid.signatures) {
+			return uid.Keywords
+		}
+	}
+	if has(pubkey.signatures) {
+		return SigCountPrimary
+	}
+	for _, uat := range pubkey.userAttributes {
+		if has(uat.signatures) {
+			return SigCountPrimary
+		}
+	}
+	for _, subkey := range pubkey.subkeys {
+		if has(subkey.signatures) {
+			return SigCountSubkeys
+		}
+	}
+	return ""
+}
+
+// RevocationTarget identifies what a revocation signature revokes.
+type RevocationTarget int
+
+const (
+	RevokesKey           RevocationTarget = iota // the primary key (0x20)
+	RevokesSubkey        RevocationTarget = iota // a subkey (0x28)
+	RevokesUserId        RevocationTarget = iota // a user ID certification (0x30)
+	RevokesUserAttribute RevocationTarget = iota // a user attribute certification (0x30)
+)
+
+func (target RevocationTarget) String() string {
+	switch target {
+	case RevokesKey:
+		return "key"
+	case RevokesSubkey:
+		return "subkey"
+	case RevokesUserId:
+		return "uid"
+	case RevokesUserAttribute:
+		return "uat"
+	}
+	return "unknown"
+}
+
+// revocationCollector is a packet visitor that collects revocation
+// signatures by what they revoke.
+type revocationCollector struct {
+	sigs    []*Signature
+	targets map[RevocationTarget][]*Signature
+	target  RevocationTarget
+}
+
+func (c *revocationCollector) visit(rec PacketRecord) error {
+	switch r := rec.(type) {
+	case *Pubkey:
+		c.target = RevokesKey
+	case *Subkey:
+		c.target = RevokesSubkey
+	case *UserId:
+		c.target = RevokesUserId
+	case *UserAttribute:
+		c.target = RevokesUserAttribute
+	case *Signature:
+		var sigType int
+		switch c.target {
+		case RevokesKey:
+			sigType = 0x20 // TODO: add packet.SigTypeKeyRevocation
+		case RevokesSubkey:
+			sigType = 0x28 // TODO: add packet.SigTypeSubkeyRevocation
+		default:
+			sigType = 0x30 // TODO: add packet.SigTypeCertRevocation
+		}
+		if r.SigType == sigType {
+			c.sigs = append(c.sigs, r)
+			c.targets[c.target] = append(c.targets[c.target], r)
+		}
+	}
+	return nil
+}
+
+// Revocations returns all of the revocation signatures on the key, in the
+// order they are written: key revocations, subkey revocations and
+// certification revocations on user IDs and user attributes. Revocations
+// are included whether or not they verify.
+func (pubkey *Pubkey) Revocations() []*Signature {
+	c := &revocationCollector{targets: make(map[RevocationTarget][]*Signature)}
+	pubkey.Visit(c.visit)
+	return c.sigs
+}
+
+// RevocationsByTarget returns the revocation signatures on the key, as
+// returned by Revocations, grouped by what they revoke.
+func (pubkey *Pubkey) RevocationsByTarget() map[RevocationTarget][]*Signature {
+	c := &revocationCollector{targets: make(map[RevocationTarget][]*Signature)}
+	pubkey.Visit(c.visit)
+	return c.targets
+}
+
 var selectTotalKeys string = `SELECT COUNT(1) AS total_keys FROM openpgp_pubkey`
 
 var selectHourlyStats string = `
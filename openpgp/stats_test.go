@@ -0,0 +1,150 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureCounts(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	counts := key.SignatureCounts()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	assert.Equal(t, countSigs(key), total)
+	assert.Equal(t, len(key.subkeys), counts[SigCountSubkeys])
+	for _, uid := range key.userIds {
+		assert.Equal(t, len(uid.signatures), counts[uid.Keywords])
+	}
+	assert.Equal(t, len(key.signatures)+len(key.userAttributes[0].signatures), counts[SigCountPrimary])
+}
+
+func TestCertifications(t *testing.T) {
+	key := MustInputAscKey(t, "lp1195901.asc")
+	certs := key.Certifications()
+	assert.NotEmpty(t, certs)
+	_, has := certs[key.KeyId()]
+	assert.False(t, has)
+
+	keywords := make(map[string]bool)
+	for _, uid := range key.userIds {
+		keywords[uid.Keywords] = true
+	}
+	for issuer, issuerCerts := range certs {
+		for _, cert := range issuerCerts {
+			assert.Equal(t, issuer, cert.IssuerKeyId)
+			assert.True(t, keywords[cert.UserId])
+			assert.False(t, cert.Creation.IsZero())
+		}
+	}
+
+	// This signer certified several of the user IDs.
+	uids := make(map[string]bool)
+	for _, cert := range certs["d2bb0d0165d0fd58"] {
+		assert.Equal(t, 0x10, cert.SigType)
+		uids[cert.UserId] = true
+	}
+	assert.True(t, len(uids) > 1)
+}
+
+func TestRevocations(t *testing.T) {
+	key := MustInputAscKey(t, "revoked_uid.asc")
+	revs := key.Revocations()
+	if !assert.Equal(t, 2, len(revs)) {
+		return
+	}
+	assert.Equal(t, 0x20, revs[0].SigType)
+	assert.Equal(t, 0x30, revs[1].SigType)
+	assert.True(t, key.IsRevoked())
+
+	byTarget := key.RevocationsByTarget()
+	assert.Equal(t, []*Signature{revs[0]}, byTarget[RevokesKey])
+	assert.Equal(t, []*Signature{revs[1]}, byTarget[RevokesUserId])
+	assert.Empty(t, byTarget[RevokesSubkey])
+	assert.Empty(t, byTarget[RevokesUserAttribute])
+	assert.Equal(t, "uid", RevokesUserId.String())
+
+	// The user ID revocation is on the revoked user ID only.
+	uid := key.UserIdByKeyword("Revoke Test <old@example.com>")
+	if assert.NotNil(t, uid) {
+		assert.Contains(t, uid.Signatures(), revs[1])
+	}
+
+	assert.Empty(t, MustInputAscKey(t, "sksdigest.asc").Revocations())
+}
+
+func TestCertificationTarget(t *testing.T) {
+	key := MustInputAscKey(t, "lp1195901.asc")
+	uid := key.UserIdByKeyword("Phil Pennock <pdp@exim.org>")
+	if !assert.NotNil(t, uid) {
+		return
+	}
+	var cert *Signature
+	for _, sig := range uid.signatures {
+		if sig.IssuerKeyId() == "d2bb0d0165d0fd58" {
+			cert = sig
+		}
+	}
+	if assert.NotNil(t, cert) {
+		assert.Equal(t, "Phil Pennock <pdp@exim.org>", key.CertificationTarget(cert))
+	}
+	for _, uid := range key.userIds {
+		for _, sig := range uid.signatures {
+			assert.Equal(t, uid.Keywords, key.CertificationTarget(sig))
+		}
+	}
+
+	key = MustInputAscKey(t, "uat.asc")
+	assert.Equal(t, SigCountPrimary, key.CertificationTarget(key.userAttributes[0].signatures[0]))
+	assert.Equal(t, SigCountSubkeys, key.CertificationTarget(key.subkeys[0].signatures[0]))
+	assert.Equal(t, "", key.CertificationTarget(cert))
+}
+
+func TestWebOfTrustInDegree(t *testing.T) {
+	// A is certified by B on both user IDs and by C on one, and B is
+	// certified by A. C has no certifications.
+	keys := MustInputAscKeys(t, "wot.asc")
+	if !assert.Len(t, keys, 3) {
+		return
+	}
+	degrees := WebOfTrustInDegree(keys)
+	assert.Equal(t, map[string]int{
+		"0d5cc97ec62820c11ce8b03b52fd1ee9aa9257ff": 2,
+		"75cd860c0acf82098c45faefac7d401c1b565b18": 1,
+		"786c0e1d1a22411e02c63f9a9f39c4dba4f8052d": 0,
+	}, degrees)
+}
+
+func TestWebOfTrustInDegreeRevoked(t *testing.T) {
+	// As wot.asc, but C has revoked its certification of A, and B has
+	// revoked its certification of one of A's user IDs.
+	keys := MustInputAscKeys(t, "wot_revoked.asc")
+	if !assert.Len(t, keys, 3) {
+		return
+	}
+	degrees := WebOfTrustInDegree(keys)
+	assert.Equal(t, map[string]int{
+		"0d5cc97ec62820c11ce8b03b52fd1ee9aa9257ff": 1,
+		"75cd860c0acf82098c45faefac7d401c1b565b18": 1,
+		"786c0e1d1a22411e02c63f9a9f39c4dba4f8052d": 0,
+	}, degrees)
+}
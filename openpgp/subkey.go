@@ -20,6 +20,7 @@ package openpgp
 import (
 	"bytes"
 	"database/sql"
+	"encoding/binary"
 	"io"
 	"log"
 	"strings"
@@ -61,11 +62,11 @@ func (subkey *Subkey) Fingerprint() string {
 }
 
 func (subkey *Subkey) KeyId() string {
-	return util.Reverse(subkey.RFingerprint[:16])
+	return keyIdOf(subkey.RFingerprint, 16)
 }
 
 func (subkey *Subkey) ShortId() string {
-	return util.Reverse(subkey.RFingerprint[:8])
+	return keyIdOf(subkey.RFingerprint, 8)
 }
 
 func (subkey *Subkey) Signatures() []*Signature { return subkey.signatures }
@@ -104,6 +105,9 @@ func (subkey *Subkey) setPacket(p packet.Packet) (err error) {
 			return ErrInvalidPacketType
 		}
 		subkey.PublicKeyV3 = pk
+	case *packet.PrivateKey:
+		log.Println("Warning: rejected secret subkey material")
+		err = ErrSecretKeyRejected
 	default:
 		err = ErrInvalidPacketType
 	}
@@ -111,6 +115,13 @@ func (subkey *Subkey) setPacket(p packet.Packet) (err error) {
 }
 
 func (subkey *Subkey) Read() (err error) {
+	if subkey.Packet, err = unpackBytes(subkey.Packet); err != nil {
+		return
+	}
+	if op, err := toOpaquePacket(subkey.Packet); err == nil && len(op.Contents) > 0 && op.Contents[0] == 6 {
+		// Kept unparsed.
+		return nil
+	}
 	buf := bytes.NewBuffer(subkey.Packet)
 	var p packet.Packet
 	if p, err = packet.Read(buf); err != nil {
@@ -142,6 +153,25 @@ func NewSubkey(op *packet.OpaquePacket) (subkey *Subkey, err error) {
 	return
 }
 
+// NewV6Subkey returns a V6 subkey, which is not supported by the packet
+// library. The key material is kept unparsed, with the fingerprint, creation
+// and algorithm read from the packet.
+func NewV6Subkey(op *packet.OpaquePacket) (subkey *Subkey, err error) {
+	if len(op.Contents) < 6 || op.Contents[0] != 6 {
+		return nil, ErrInvalidPacketType
+	}
+	var buf bytes.Buffer
+	if err = op.Serialize(&buf); err != nil {
+		return
+	}
+	subkey = &Subkey{Packet: buf.Bytes()}
+	subkey.RFingerprint = util.Reverse(opaqueFingerprint(op))
+	subkey.Creation = time.Unix(int64(binary.BigEndian.Uint32(op.Contents[1:5])), 0).UTC()
+	subkey.Expiration = NeverExpires
+	subkey.Algorithm = int(op.Contents[5])
+	return subkey, nil
+}
+
 func (subkey *Subkey) initV4() error {
 	fingerprint := Fingerprint(subkey.PublicKey)
 	bitLen, err := subkey.PublicKey.BitLength()
@@ -153,7 +183,7 @@ func (subkey *Subkey) initV4() error {
 		return ErrInvalidPacketType
 	}
 	subkey.RFingerprint = util.Reverse(fingerprint)
-	subkey.Creation = subkey.PublicKey.CreationTime
+	subkey.Creation = subkey.PublicKey.CreationTime.UTC()
 	subkey.Expiration = NeverExpires
 	subkey.Algorithm = int(subkey.PublicKey.PubKeyAlgo)
 	subkey.BitLen = int(bitLen)
@@ -171,7 +201,7 @@ func (subkey *Subkey) initV3() error {
 		return ErrInvalidPacketType
 	}
 	subkey.RFingerprint = util.Reverse(fingerprint)
-	subkey.Creation = subkey.PublicKeyV3.CreationTime
+	subkey.Creation = subkey.PublicKeyV3.CreationTime.UTC()
 	subkey.Expiration = NeverExpires
 	if subkey.PublicKeyV3.DaysToExpire > 0 {
 		subkey.Expiration = subkey.Creation.Add(time.Duration(subkey.PublicKeyV3.DaysToExpire) * time.Hour * 24)
@@ -208,10 +238,11 @@ func (subkey *Subkey) linkSelfSigs(pubkey *Pubkey) {
 		if !strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) {
 			continue
 		}
-		if sig.SigType == 0x20 { // TODO: add packet.SigTypeKeyRevocation
-			// Use the earliest valid revocation of this key
+		if sig.SigType == 0x28 { // TODO: add packet.SigTypeSubkeyRevocation
+			// Use the earliest valid revocation of this key. It is always
+			// verified, since anyone could otherwise revoke the subkey.
 			if subkey.revSig == nil || sig.Creation.Unix() < subkey.revSig.Creation.Unix() {
-				if err := pubkey.verifyPublicKeySelfSig(subkey, sig); err == nil {
+				if err := pubkey.checkPublicKeySelfSig(subkey, sig); err == nil {
 					subkey.revSig = sig
 					subkey.RevSigDigest = sql.NullString{sig.ScopedDigest, true}
 				}
@@ -237,3 +268,91 @@ func (subkey *Subkey) linkSelfSigs(pubkey *Pubkey) {
 
 func (subkey *Subkey) publicKey() *packet.PublicKey     { return subkey.PublicKey }
 func (subkey *Subkey) publicKeyV3() *packet.PublicKeyV3 { return subkey.PublicKeyV3 }
+
+// IsExpired returns whether the subkey has expired at the given time,
+// according to the key lifetime in its binding signature.
+func (subkey *Subkey) IsExpired(now time.Time) bool {
+	if subkey.bindingSig == nil || subkey.bindingSig.Signature == nil {
+		// Without a V4 binding signature, only a V3 key can declare an expiration.
+		return !subkey.Expiration.IsZero() && now.After(subkey.Expiration)
+	}
+	lifetime := subkey.bindingSig.Signature.KeyLifetimeSecs
+	if lifetime == nil || *lifetime == 0 {
+		return false
+	}
+	return now.After(subkey.Creation.Add(time.Duration(*lifetime) * time.Second))
+}
+
+// IsRevoked returns whether the subkey has been revoked by the primary key.
+func (subkey *Subkey) IsRevoked() bool {
+	return subkey.revSig != nil || subkey.RevSigDigest.Valid
+}
+
+// Flags returns the key usage flags declared for the subkey in its binding
+// signature, or zero if it has none.
+func (subkey *Subkey) Flags() byte {
+	if subkey.bindingSig == nil {
+		return 0
+	}
+	if flags := subkey.bindingSig.hashedSubpacket(27); len(flags) > 0 { // Key flags
+		return flags[0]
+	}
+	return 0
+}
+
+// CrossCertification returns the primary key binding signature (type 0x19)
+// embedded in the subkey's binding signature, made by the subkey over the
+// primary key. Signing subkeys must carry one, so that a subkey cannot be
+// claimed by another primary key. Returns nil if the subkey has no binding
+// signature or it embeds no such signature.
+func (subkey *Subkey) CrossCertification() *Signature {
+	if subkey.bindingSig == nil {
+		return nil
+	}
+	subpackets, err := subkey.bindingSig.subpackets()
+	if err != nil {
+		return nil
+	}
+	for _, sp := range subpackets {
+		if sp.Type != 32 { // Embedded signature
+			continue
+		}
+		sig, err := NewSignature(&packet.OpaquePacket{Tag: 2, Contents: sp.Contents})
+		if err == nil && sig.SigType == 0x19 { // Primary key binding
+			return sig
+		}
+	}
+	return nil
+}
+
+// DuplicateSubkeys finds subkey material shared by more than one primary
+// public key, which may indicate key theft or a misbehaving client.
+// The result maps each shared subkey fingerprint to the fingerprints of the
+// primary keys it appears under.
+func DuplicateSubkeys(keys []*Pubkey) map[string][]string {
+	owners := make(map[string][]string)
+	for _, key := range keys {
+		for _, subkey := range key.subkeys {
+			fp := subkey.Fingerprint()
+			if !containsString(owners[fp], key.Fingerprint()) {
+				owners[fp] = append(owners[fp], key.Fingerprint())
+			}
+		}
+	}
+	result := make(map[string][]string)
+	for fp, keyFps := range owners {
+		if len(keyFps) > 1 {
+			result[fp] = keyFps
+		}
+	}
+	return result
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubkeyNoBindingSig(t *testing.T) {
+	subkey := &Subkey{Creation: time.Now(), Expiration: NeverExpires}
+	assert.False(t, subkey.IsExpired(time.Now()))
+	assert.False(t, subkey.IsRevoked())
+	subkey = &Subkey{}
+	assert.False(t, subkey.IsExpired(time.Now()))
+}
+
+func TestSubkeyExpired(t *testing.T) {
+	creation := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := uint32(86400)
+	subkey := &Subkey{Creation: creation, Expiration: NeverExpires,
+		bindingSig: &Signature{Signature: &packet.Signature{KeyLifetimeSecs: &lifetime}}}
+	assert.False(t, subkey.IsExpired(creation.Add(time.Hour)))
+	assert.True(t, subkey.IsExpired(creation.Add(48*time.Hour)))
+
+	subkey.bindingSig.Signature.KeyLifetimeSecs = nil
+	assert.False(t, subkey.IsExpired(creation.Add(48*time.Hour)))
+}
+
+func TestSubkeyRevoked(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	subkey := key.Subkeys()[0]
+	assert.False(t, subkey.IsRevoked())
+	assert.False(t, subkey.IsExpired(time.Now()))
+
+	key = MustInputAscKey(t, "revoked_subkey.asc")
+	subkey = key.Subkeys()[0]
+	assert.True(t, subkey.IsRevoked())
+	if assert.NotNil(t, subkey.revSig) {
+		assert.Equal(t, 0x28, subkey.revSig.SigType)
+		assert.Equal(t, subkey.revSig.ScopedDigest, subkey.RevSigDigest.String)
+	}
+
+	key = MustInputAscKey(t, "lp1195901_2.asc")
+	for _, subkey := range key.Subkeys() {
+		assert.Equal(t, subkey.KeyId() == "a55e848938304dbe", subkey.IsRevoked(), subkey.KeyId())
+	}
+
+	// Only one of the subkey revocations here verifies.
+	key = MustInputAscKey(t, "rtt-140.asc")
+	for _, subkey := range key.Subkeys() {
+		assert.Equal(t, subkey.KeyId() == "53bf1b0fe9577cae", subkey.IsRevoked(), subkey.KeyId())
+	}
+}
+
+func TestSubkeyRevocationForged(t *testing.T) {
+	// The subkey revocation signature has been corrupted, so it is not
+	// honored even when signatures are not otherwise verified.
+	key := MustInputAscKey(t, "revoked_subkey_forged.asc")
+	subkey := key.Subkeys()[0]
+	assert.False(t, subkey.IsRevoked())
+	assert.False(t, subkey.RevSigDigest.Valid)
+}
+
+func TestDuplicateSubkeys(t *testing.T) {
+	key1 := MustInputAscKey(t, "sksdigest.asc")
+	key2 := MustInputAscKey(t, "alice_unsigned.asc")
+	assert.Empty(t, DuplicateSubkeys([]*Pubkey{key1, key2}))
+	// The same key listed twice does not reuse its own subkey.
+	assert.Empty(t, DuplicateSubkeys([]*Pubkey{key1, key1}))
+
+	shared := key1.subkeys[0]
+	key2.subkeys = append(key2.subkeys, shared)
+	dups := DuplicateSubkeys([]*Pubkey{key1, key2})
+	assert.Equal(t, 1, len(dups))
+	assert.Equal(t, []string{key1.Fingerprint(), key2.Fingerprint()}, dups[shared.Fingerprint()])
+}
+
+func TestCrossCertification(t *testing.T) {
+	now := time.Now()
+	key := MustInputAscKey(t, "crosscert.asc")
+	assert.Equal(t, 1, len(key.subkeys))
+	cross := key.subkeys[0].CrossCertification()
+	if assert.NotNil(t, cross) {
+		assert.Equal(t, 0x19, cross.SigType)
+		assert.Equal(t, key.subkeys[0].KeyId(), cross.IssuerKeyId())
+	}
+	valid, errs := key.Validate(now)
+	assert.True(t, valid)
+	assert.Empty(t, errs)
+
+	// The same signing subkey, with the back-signature stripped from the
+	// unhashed area of its binding signature.
+	key = MustInputAscKey(t, "crosscert_missing.asc")
+	assert.Nil(t, key.subkeys[0].CrossCertification())
+	valid, errs = key.Validate(now)
+	assert.False(t, valid)
+	assert.Equal(t, []error{ErrNoCrossCertification}, errs)
+
+	// Encryption subkeys need no cross-certification.
+	key = MustInputAscKey(t, "sksdigest.asc")
+	assert.Nil(t, key.subkeys[0].CrossCertification())
+	valid, _ = key.Validate(now)
+	assert.True(t, valid)
+}
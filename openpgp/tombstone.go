@@ -0,0 +1,52 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"database/sql"
+)
+
+// Tombstone removes the personal data from the key: its user IDs and user
+// attributes, along with their signatures, and any unsupported packets that
+// may hold copies of them. The primary public key packet, its direct
+// signatures and its subkeys are kept, so that the key can still be
+// identified and its revocations honored. The database records of the
+// removed packets must be deleted separately.
+//
+// The digests of the key are deliberately left unchanged. The key keeps its
+// place in the prefix tree, so peers see nothing missing and do not send the
+// removed content back through recon. Key material later received for a
+// tombstoned key is not merged into it. As a result, the stored digest no
+// longer matches the key material, and updates made to the key elsewhere
+// are ignored by this server.
+func (pubkey *Pubkey) Tombstone() {
+	pubkey.userIds = nil
+	pubkey.userAttributes = nil
+	pubkey.Unsupported = nil
+	pubkey.primaryUid, pubkey.primaryUidSig = nil, nil
+	pubkey.primaryUat, pubkey.primaryUatSig = nil, nil
+	pubkey.PrimaryUid = sql.NullString{"", false}
+	pubkey.PrimaryUat = sql.NullString{"", false}
+	pubkey.State |= PacketStateTombstone
+	pubkey.touch()
+}
+
+// IsTombstone returns whether the key has had its personal data removed.
+func (pubkey *Pubkey) IsTombstone() bool {
+	return pubkey.State&PacketStateTombstone != 0
+}
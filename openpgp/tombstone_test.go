@@ -0,0 +1,62 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstone(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	md5, sha256 := key.Md5, key.Sha256
+	nsubkeys := len(key.subkeys)
+	assert.False(t, key.IsTombstone())
+
+	key.Tombstone()
+	assert.True(t, key.IsTombstone())
+	assert.Empty(t, key.UserIds())
+	assert.Empty(t, key.UserAttributes())
+	assert.False(t, key.PrimaryUid.Valid)
+	assert.False(t, key.PrimaryUat.Valid)
+	assert.Equal(t, nsubkeys, len(key.Subkeys()))
+	// Digests are kept for recon.
+	assert.Equal(t, md5, key.Md5)
+	assert.Equal(t, sha256, key.Sha256)
+
+	// The remaining key material is still readable.
+	var buf bytes.Buffer
+	assert.Nil(t, WritePackets(&buf, key))
+	var keys []*Pubkey
+	for keyRead := range ReadKeys(&buf) {
+		assert.Nil(t, keyRead.Error)
+		keys = append(keys, keyRead.Pubkey)
+	}
+	if assert.Equal(t, 1, len(keys)) {
+		assert.Equal(t, key.Fingerprint(), keys[0].Fingerprint())
+		assert.Empty(t, keys[0].UserIds())
+		assert.NotEqual(t, md5, keys[0].Md5)
+	}
+
+	changed, err := RecomputeAll([]*Pubkey{key})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, changed)
+	assert.Equal(t, md5, key.Md5)
+}
@@ -26,6 +26,7 @@ import (
 )
 
 var ErrInvalidPacketType error = errors.New("Invalid packet type")
+var ErrSecretKeyRejected error = errors.New("Secret key material is not accepted")
 var ErrPacketRecordState error = errors.New("Packet record state has not been properly initialized")
 
 // PacketState indicates the validity of the public key material and special
@@ -49,6 +50,14 @@ const (
 	// Signature has been checked and verified
 	PacketStateSigOk = 1 << 2
 
+	// Public key is served, but kept out of the prefix tree so that it is
+	// not reconciled with peers.
+	PacketStateNoRecon = 1 << 3
+
+	// Public key has a user attribute containing an image (photo ID),
+	// indexed so that keys with photos can be searched for.
+	PacketStateHasImage = 1 << 4
+
 	// Bits 16-23 indicate verification failure of the key material.
 
 	// Key material is banned from HKP results unconditionally. Could be signature
@@ -66,6 +75,15 @@ const (
 
 	// Public key is unsupported (unknown algorithm code, etc.)
 	PacketStateUnsuppPubkey = 1 << 20
+
+	// Signature has been checked and failed to verify
+	PacketStateSigBad = 1 << 21
+
+	// Signature issuer fingerprint does not match its issuer key ID
+	PacketStateIssuerMismatch = 1 << 22
+
+	// Public key has had its user IDs and user attributes removed
+	PacketStateTombstone = 1 << 23
 )
 
 type PacketVisitor func(PacketRecord) error
@@ -95,6 +113,22 @@ func toOpaquePacket(buf []byte) (*packet.OpaquePacket, error) {
 	return r.Next()
 }
 
+// canonicalPacket returns the packet encoded with a new-format header, the
+// form in which scoped digests are calculated, so that the same packet
+// received in different encodings is recognized as the same. The packet
+// contents are not changed.
+func canonicalPacket(buf []byte) []byte {
+	op, err := toOpaquePacket(buf)
+	if err != nil {
+		return buf
+	}
+	var out bytes.Buffer
+	if err = op.Serialize(&out); err != nil {
+		return buf
+	}
+	return out.Bytes()
+}
+
 type packetSlice []*packet.OpaquePacket
 
 func (ps packetSlice) Len() int {
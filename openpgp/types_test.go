@@ -18,9 +18,20 @@
 package openpgp
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"code.google.com/p/go.crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/hockeypuck/hockeypuck"
+	Errors "github.com/hockeypuck/hockeypuck/errors"
+	"github.com/hockeypuck/hockeypuck/util"
 )
 
 func TestVisitor(t *testing.T) {
@@ -46,6 +57,82 @@ func TestVisitor(t *testing.T) {
 	assert.Equal(t, 2, nsig)
 }
 
+// Every packet record type must satisfy the record interfaces.
+var (
+	_ PacketRecord = (*Pubkey)(nil)
+	_ PacketRecord = (*Subkey)(nil)
+	_ PacketRecord = (*UserId)(nil)
+	_ PacketRecord = (*UserAttribute)(nil)
+	_ PacketRecord = (*Signature)(nil)
+
+	_ Signable = (*Pubkey)(nil)
+	_ Signable = (*Subkey)(nil)
+	_ Signable = (*UserId)(nil)
+	_ Signable = (*UserAttribute)(nil)
+)
+
+// expectVisitOrder lists the records of a key in the order Visit is
+// expected to reach them: the primary key and its signatures, then each
+// user ID, user attribute and subkey, each followed by its signatures.
+func expectVisitOrder(key *Pubkey) (result []PacketRecord) {
+	result = append(result, key)
+	for _, sig := range key.signatures {
+		result = append(result, sig)
+	}
+	for _, uid := range key.userIds {
+		result = append(result, uid)
+		for _, sig := range uid.signatures {
+			result = append(result, sig)
+		}
+	}
+	for _, uat := range key.userAttributes {
+		result = append(result, uat)
+		for _, sig := range uat.signatures {
+			result = append(result, sig)
+		}
+	}
+	for _, subkey := range key.subkeys {
+		result = append(result, subkey)
+		for _, sig := range subkey.signatures {
+			result = append(result, sig)
+		}
+	}
+	return
+}
+
+func TestVisitContract(t *testing.T) {
+	for _, name := range []string{"sksdigest.asc", "uat.asc", "alice_signed.asc"} {
+		key := MustInputAscKey(t, name)
+		var visited []PacketRecord
+		seen := make(map[PacketRecord]bool)
+		err := key.Visit(func(rec PacketRecord) error {
+			assert.False(t, seen[rec], "%s: record visited more than once", name)
+			seen[rec] = true
+			visited = append(visited, rec)
+			return nil
+		})
+		assert.Nil(t, err)
+		expected := expectVisitOrder(key)
+		if assert.Equal(t, len(expected), len(visited), name) {
+			for i := range expected {
+				assert.True(t, expected[i] == visited[i], "%s: unexpected record at %d", name, i)
+			}
+		}
+		// Visiting stops at the first error.
+		stop := fmt.Errorf("stop")
+		var n int
+		err = key.Visit(func(rec PacketRecord) error {
+			n++
+			if n == 2 {
+				return stop
+			}
+			return nil
+		})
+		assert.Equal(t, stop, err)
+		assert.Equal(t, 2, n)
+	}
+}
+
 func TestIterOpaque(t *testing.T) {
 	key := MustInputAscKey(t, "sksdigest.asc")
 	hits := make(map[uint8]int)
@@ -72,3 +159,688 @@ func TestIterOpaque(t *testing.T) {
 	assert.Equal(t, 1, len(key.subkeys[0].signatures))
 	assert.Equal(t, 4, len(hits))
 }
+
+func TestIssuerKeyIds(t *testing.T) {
+	key := MustInputAscKey(t, "alice_unsigned.asc")
+	assert.Empty(t, key.IssuerKeyIds())
+
+	key = MustInputAscKey(t, "alice_signed.asc")
+	keyIds := key.IssuerKeyIds()
+	assert.Equal(t, []string{"62aea01d67640fb5"}, keyIds)
+
+	key = MustInputAscKey(t, "weasel.asc")
+	keyIds = key.IssuerKeyIds()
+	assert.True(t, len(keyIds) > 1)
+	seen := make(map[string]bool)
+	for _, keyId := range keyIds {
+		assert.False(t, seen[keyId], "duplicate issuer %s", keyId)
+		assert.NotEqual(t, key.KeyId(), keyId)
+		assert.Equal(t, 16, len(keyId))
+		seen[keyId] = true
+	}
+}
+
+func TestNormalizeIssuer(t *testing.T) {
+	for _, tc := range []struct{ in, out string }{
+		{"68f58868e58cb56a", "68f58868e58cb56a"},
+		{"0x68F58868E58CB56A", "68f58868e58cb56a"},
+		{"7BA723516A6D828C4D15C1C068F58868E58CB56A", "68f58868e58cb56a"},
+		{"19347bc9872464025f99df3ec2e0000ed9884892e1f7b3ea4c94009159569b54", "19347bc987246402"},
+		{"e58cb56a", ""},
+		{"not a key id!!!!", ""},
+		{"", ""},
+	} {
+		assert.Equal(t, tc.out, NormalizeIssuer(tc.in), "input %q", tc.in)
+	}
+}
+
+func TestIssuerFingerprintOnly(t *testing.T) {
+	// Third-party certification identified only by the issuer
+	// fingerprint subpacket.
+	fprOnly := MustInputAscKey(t, "issuerfpr_only.asc")
+	assert.Equal(t, []string{"68f58868e58cb56a"}, fprOnly.IssuerKeyIds())
+	var sig *Signature
+	for _, s := range fprOnly.userIds[0].signatures {
+		if s.SigType == 0x10 {
+			sig = s
+		}
+	}
+	if assert.NotNil(t, sig) {
+		assert.Equal(t, "68f58868e58cb56a", sig.IssuerKeyId())
+		assert.Equal(t, 0, sig.State&PacketStateIssuerMismatch)
+	}
+
+	// The same certification with only an issuer key ID.
+	keyIdOnly := MustInputAscKey(t, "nomodify.asc")
+	assert.Equal(t, []string{"68f58868e58cb56a"}, keyIdOnly.IssuerKeyIds())
+
+	MergeKey(keyIdOnly, fprOnly)
+	assert.Equal(t, []string{"68f58868e58cb56a"}, keyIdOnly.IssuerKeyIds())
+	certs := keyIdOnly.Certifications()
+	assert.Equal(t, 1, len(certs))
+	assert.Equal(t, 2, len(certs["68f58868e58cb56a"]))
+}
+
+func TestSignatureHashAlgo(t *testing.T) {
+	for _, tc := range []struct {
+		file     string
+		hashAlgo int
+		name     string
+	}{
+		{"aead.asc", HashAlgoSHA256, "SHA-256"},
+		{"dsa1024.asc", HashAlgoSHA1, "SHA-1"},
+		{"crosscert.asc", HashAlgoSHA512, "SHA-512"},
+	} {
+		key := MustInputAscKey(t, tc.file)
+		sig := key.selfSignature()
+		if assert.NotNil(t, sig, tc.file) {
+			assert.Equal(t, tc.hashAlgo, sig.HashAlgo, tc.file)
+			assert.Equal(t, tc.name, sig.HashAlgorithmName(), tc.file)
+		}
+	}
+	assert.Equal(t, "unknown", (&Signature{}).HashAlgorithmName())
+}
+
+func TestWeaknessReport(t *testing.T) {
+	// RSA 1024 self-signed with SHA-256.
+	key := MustInputAscKey(t, "aead.asc")
+	assert.Equal(t, []string{"RSA 1024 key is shorter than 2048 bits"}, key.WeaknessReport(nil))
+	weak := map[string]bool{key.Fingerprint(): true}
+	assert.Equal(t, []string{
+		"RSA 1024 key is shorter than 2048 bits",
+		"fingerprint is a known weak key",
+	}, key.WeaknessReport(weak))
+
+	// DSA 1024 self-signed with SHA-1.
+	key = MustInputAscKey(t, "dsa1024.asc")
+	assert.Equal(t, []string{
+		"DSA 1024 key is shorter than 2048 bits",
+		"self-signature uses the weak SHA-1 hash",
+	}, key.WeaknessReport(weak))
+
+	// RSA 2048 self-signed with SHA-512.
+	key = MustInputAscKey(t, "crosscert.asc")
+	assert.Empty(t, key.WeaknessReport(weak))
+}
+
+func TestFeatures(t *testing.T) {
+	key := MustInputAscKey(t, "aead.asc")
+	features, ok := key.Features()
+	assert.True(t, ok)
+	assert.Equal(t, byte(FeatureMDC|FeatureAEAD), features)
+
+	key = MustInputAscKey(t, "crosscert.asc")
+	features, ok = key.Features()
+	assert.True(t, ok)
+	assert.Equal(t, byte(FeatureMDC), features)
+
+	// Legacy keys without a features subpacket.
+	key = MustInputAscKey(t, "d7346e26.asc")
+	_, ok = key.Features()
+	assert.False(t, ok)
+}
+
+func TestPubkeyString(t *testing.T) {
+	key := MustInputAscKey(t, "crosscert.asc")
+	assert.Equal(t, key.Fingerprint()+" "+key.AlgorithmDescription()+", 1 uids, 1 subkeys, revoked=false",
+		key.String())
+	assert.Equal(t, key.String(), fmt.Sprint(key))
+
+	// Partially constructed keys must not panic.
+	assert.Equal(t, "(no fingerprint) unknown, 0 uids, 0 subkeys, revoked=false", (&Pubkey{}).String())
+	assert.Equal(t, "abc unknown, 0 uids, 0 subkeys, revoked=false", (&Pubkey{RFingerprint: "cba"}).String())
+}
+
+func TestSignatureIsExpired(t *testing.T) {
+	now := time.Now()
+	creation := now.Add(-48 * time.Hour)
+	day := uint32(24 * 60 * 60)
+	expired := &Signature{Creation: creation,
+		Signature: &packet.Signature{CreationTime: creation, SigLifetimeSecs: &day}}
+	assert.True(t, expired.IsExpired(now))
+	assert.False(t, expired.IsExpired(creation.Add(time.Hour)))
+	// A key lifetime folded into the expiration does not affect the signature.
+	expired.Expiration = now.Add(time.Hour)
+	assert.True(t, expired.IsExpired(now))
+
+	key := MustInputAscKey(t, "sksdigest.asc")
+	for _, sig := range key.userIds[0].signatures {
+		assert.False(t, sig.IsExpired(now))
+	}
+	assert.False(t, (&Signature{}).IsExpired(now))
+	assert.False(t, (&Signature{Expiration: NeverExpires}).IsExpired(now))
+	assert.True(t, (&Signature{Expiration: creation}).IsExpired(now))
+}
+
+func TestSignatureExpiration(t *testing.T) {
+	creation := time.Unix(1368410889, 0)
+	lifetime := uint32(30 * 24 * 60 * 60)
+	issuer := uint64(0x26a61d89c87d8e91)
+	sig := &Signature{Signature: &packet.Signature{
+		CreationTime: creation, SigLifetimeSecs: &lifetime, IssuerKeyId: &issuer}}
+	assert.Nil(t, sig.initV4())
+	assert.Equal(t, creation.Add(time.Duration(lifetime)*time.Second).Unix(), sig.Expiration.Unix())
+
+	sig = &Signature{Signature: &packet.Signature{CreationTime: creation, IssuerKeyId: &issuer}}
+	assert.Nil(t, sig.initV4())
+	assert.Equal(t, NeverExpires.Unix(), sig.Expiration.Unix())
+}
+
+func TestUserIdParse(t *testing.T) {
+	for _, tc := range []struct {
+		uid, name, comment, email string
+	}{
+		{"Jenny Ondioline <jennyo@transient.net>", "Jenny Ondioline", "", "jennyo@transient.net"},
+		{"Alice Example (work) <alice@example.com>", "Alice Example", "work", "alice@example.com"},
+		{"<bob@example.com>", "", "", "bob@example.com"},
+		{"bob@example.com", "", "", "bob@example.com"},
+		{"Carol", "Carol", "", ""},
+		{"Dave (no email)", "Dave", "no email", ""},
+		{"just some text, no brackets", "just some text, no brackets", "", ""},
+		{"Eve <eve@example.com", "Eve <eve@example.com", "", ""},
+		{"", "", "", ""},
+	} {
+		name, comment, email := (&UserId{Keywords: tc.uid}).Parse()
+		assert.Equal(t, tc.name, name, tc.uid)
+		assert.Equal(t, tc.comment, comment, tc.uid)
+		assert.Equal(t, tc.email, email, tc.uid)
+	}
+}
+
+func TestUserIdByKeyword(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	uid := key.UserIdByKeyword("Jenny Ondioline <jennyo@transient.net>")
+	assert.NotNil(t, uid)
+	assert.Equal(t, key.userIds[0], uid)
+	assert.Nil(t, key.UserIdByKeyword("jenny ondioline <jennyo@transient.net>"))
+	assert.Nil(t, key.UserIdByKeyword("Jenny Ondioline"))
+	// Invalid UTF-8 is cleaned the same way as on ingest.
+	key.userIds[0].Keywords = util.CleanUtf8("J\xffenny")
+	assert.Equal(t, key.userIds[0], key.UserIdByKeyword("J\xffenny"))
+}
+
+func findSigs(key *Pubkey, sigType int) (result []*Signature) {
+	key.Visit(func(rec PacketRecord) error {
+		if sig, is := rec.(*Signature); is && sig.SigType == sigType {
+			result = append(result, sig)
+		}
+		return nil
+	})
+	return
+}
+
+func TestRevocationReason(t *testing.T) {
+	key := MustInputAscKey(t, "252B8B37.dupsig.asc")
+	revSigs := findSigs(key, 0x20)
+	assert.Equal(t, 1, len(revSigs))
+	code, text, ok := revSigs[0].RevocationReason()
+	assert.True(t, ok)
+	assert.Equal(t, byte(1), code)
+	assert.Equal(t, "", text)
+
+	key = MustInputAscKey(t, "lp1195901_2.asc")
+	revSigs = findSigs(key, 0x28)
+	assert.Equal(t, 1, len(revSigs))
+	code, text, ok = revSigs[0].RevocationReason()
+	assert.True(t, ok)
+	assert.Equal(t, byte(2), code)
+	assert.Equal(t, "Possibly generated on Debian system.\nPlaying safe and deleting DSA subkey from 2006.", text)
+
+	// Certifications carry no reason.
+	key = MustInputAscKey(t, "sksdigest.asc")
+	_, _, ok = key.userIds[0].signatures[0].RevocationReason()
+	assert.False(t, ok)
+}
+
+func TestPreferences(t *testing.T) {
+	key := MustInputAscKey(t, "tails.asc")
+	assert.Equal(t, []uint8{9, 8, 7, 3}, key.PreferredSymmetric())
+	assert.Equal(t, []uint8{10, 9, 8, 11}, key.PreferredHash())
+	assert.Equal(t, []uint8{2, 3, 1, 0}, key.PreferredCompression())
+
+	key = MustInputAscKey(t, "sksdigest.asc")
+	assert.Equal(t, []uint8{9, 8, 7, 3, 2}, key.PreferredSymmetric())
+	assert.Equal(t, []uint8{8, 2, 9, 10, 11}, key.PreferredHash())
+	assert.Equal(t, []uint8{2, 3, 1}, key.PreferredCompression())
+
+	// Without a self-signed user ID, there are no declared preferences.
+	key.primaryUidSig = nil
+	key.userIds[0].selfSignature = nil
+	assert.Empty(t, key.PreferredSymmetric())
+	assert.Empty(t, key.PreferredHash())
+	assert.Empty(t, key.PreferredCompression())
+}
+
+func TestSortKey(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	assert.Equal(t, key.Creation.UTC().Format("20060102150405")+"/"+key.Fingerprint(), key.SortKey())
+
+	earlier := &Pubkey{RFingerprint: util.Reverse("ffff"), Creation: time.Unix(1000, 0)}
+	a := &Pubkey{RFingerprint: util.Reverse("aaaa"), Creation: time.Unix(2000, 0)}
+	b := &Pubkey{RFingerprint: util.Reverse("bbbb"), Creation: time.Unix(2000, 0)}
+	assert.True(t, earlier.SortKey() < a.SortKey())
+	assert.True(t, a.SortKey() < b.SortKey())
+	assert.Equal(t, "19700101003320/aaaa", a.SortKey())
+}
+
+func TestCreationSkew(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	// Not stored yet.
+	assert.Equal(t, time.Duration(0), key.CreationSkew())
+
+	// First seen years after the claimed creation time.
+	backdated := 5 * 365 * 24 * time.Hour
+	key.Ctime = key.Creation.Add(backdated)
+	assert.Equal(t, backdated, key.CreationSkew())
+
+	key.Ctime = key.Creation
+	assert.Equal(t, time.Duration(0), key.CreationSkew())
+}
+
+func TestTimesAreUTC(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("UTC-5", -5*60*60)
+	for _, name := range []string{"sksdigest.asc", "uat.asc", "lp1195901.asc"} {
+		key := MustInputAscKey(t, name)
+		key.Visit(func(rec PacketRecord) error {
+			var times []time.Time
+			switch r := rec.(type) {
+			case *Pubkey:
+				times = []time.Time{r.Creation, r.Expiration}
+			case *Subkey:
+				times = []time.Time{r.Creation, r.Expiration}
+			case *Signature:
+				times = []time.Time{r.Creation, r.Expiration}
+			case *UserId:
+				times = []time.Time{r.Creation, r.Expiration}
+			case *UserAttribute:
+				times = []time.Time{r.Creation, r.Expiration}
+			}
+			for _, tm := range times {
+				assert.Equal(t, time.UTC, tm.Location(), "%s: %T", name, rec)
+			}
+			return nil
+		})
+	}
+}
+
+func TestKeyIdV5(t *testing.T) {
+	v4 := MustInputAscKey(t, "sksdigest.asc")
+	assert.Equal(t, "cc5112bdce353cf4", v4.KeyId())
+	assert.Equal(t, "ce353cf4", v4.ShortId())
+
+	fp := "19347bc9872464025f99df3ec2e0000a5b6a0f2e4f5fbdd6f7d6b6d1dbd9a5e1"
+	v5 := &Pubkey{RFingerprint: util.Reverse(fp)}
+	assert.Equal(t, fp, v5.Fingerprint())
+	assert.Equal(t, "19347bc987246402", v5.KeyId())
+	assert.Equal(t, "19347bc9", v5.ShortId())
+	subkey := &Subkey{RFingerprint: util.Reverse(fp)}
+	assert.Equal(t, "19347bc987246402", subkey.KeyId())
+
+	// Unsupported V5 key packets get a full SHA-256 fingerprint.
+	unsupp := &Pubkey{}
+	assert.Nil(t, unsupp.initUnsupported(&packet.OpaquePacket{Tag: 6, Contents: []byte{5, 0, 0, 0, 0}}))
+	assert.Equal(t, 64, len(unsupp.Fingerprint()))
+	assert.Equal(t, unsupp.Fingerprint()[:16], unsupp.KeyId())
+}
+
+func TestKeyIdType(t *testing.T) {
+	id, err := ParseKeyId("0x0123 4567 89AB CDEF 0123  4567 89AB CDEF 0123 4567")
+	assert.Nil(t, err)
+	assert.Equal(t, KeyId("0123456789abcdef0123456789abcdef01234567"), id)
+	assert.True(t, id.IsFingerprint())
+	assert.Equal(t, "0123456789abcdef0123456789abcdef01234567", id.Fingerprint())
+	assert.Equal(t, "89abcdef01234567", id.Long())
+	assert.Equal(t, "01234567", id.Short())
+	assert.Equal(t, "76543210fedcba9876543210fedcba9876543210", id.Reversed())
+	assert.Equal(t, id, KeyIdFromReversed(id.Reversed()))
+
+	// The same representations as a stored key.
+	key := MustInputAscKey(t, "sksdigest.asc")
+	id = KeyIdFromReversed(key.RFingerprint)
+	assert.Equal(t, key.Fingerprint(), id.Fingerprint())
+	assert.Equal(t, key.KeyId(), id.Long())
+	assert.Equal(t, key.ShortId(), id.Short())
+	assert.Equal(t, key.RFingerprint, id.Reversed())
+
+	// V5 key IDs are taken from the start of the fingerprint.
+	id, err = ParseKeyId("19347BC9872464025F99DF3EC2E0000A5B6A0F2E4F5FBDD6F7D6B6D1DBD9A5E1")
+	assert.Nil(t, err)
+	assert.Equal(t, "19347bc987246402", id.Long())
+	assert.Equal(t, "19347bc9", id.Short())
+
+	id, err = ParseKeyId("CC5112BDCE353CF4")
+	assert.Nil(t, err)
+	assert.False(t, id.IsFingerprint())
+	assert.Equal(t, "", id.Fingerprint())
+	assert.Equal(t, "cc5112bdce353cf4", id.Long())
+	assert.Equal(t, "ce353cf4", id.Short())
+	assert.Equal(t, "4fc353ecdb2115cc", id.Reversed())
+
+	id, err = ParseKeyId("0xce353cf4")
+	assert.Nil(t, err)
+	assert.Equal(t, "", id.Long())
+	assert.Equal(t, "ce353cf4", id.Short())
+
+	for _, bad := range []string{"", "0x", "ce353cf", "ce353cf4ce", "not a key id", "0x" + strings.Repeat("a", 48)} {
+		_, err = ParseKeyId(bad)
+		assert.Equal(t, Errors.ErrInvalidKeyId, err, bad)
+	}
+}
+
+func TestIssuerFingerprint(t *testing.T) {
+	key := MustInputAscKey(t, "issuerfpr.asc")
+	sig := key.userIds[0].selfSignature
+	if !assert.NotNil(t, sig) {
+		return
+	}
+	assert.Equal(t, key.Fingerprint(), sig.IssuerFingerprint())
+	assert.Equal(t, 0, sig.State&PacketStateIssuerMismatch)
+
+	// Alter the issuer fingerprint in the packet so that it no longer
+	// matches the issuer key ID.
+	fpr, err := hex.DecodeString(key.Fingerprint())
+	assert.Nil(t, err)
+	tampered := append([]byte(nil), sig.Packet...)
+	i := bytes.Index(tampered, fpr)
+	if !assert.True(t, i >= 0) {
+		return
+	}
+	tampered[i+len(fpr)-1] ^= 0xff
+	op, err := toOpaquePacket(tampered)
+	assert.Nil(t, err)
+	bad, err := NewSignature(op)
+	assert.Nil(t, err)
+	assert.NotEqual(t, key.Fingerprint(), bad.IssuerFingerprint())
+	assert.Equal(t, PacketStateIssuerMismatch, bad.State&PacketStateIssuerMismatch)
+
+	// Signatures without the subpacket are not flagged.
+	for _, sig := range MustInputAscKey(t, "sksdigest.asc").userIds[0].signatures {
+		assert.Equal(t, 0, sig.State&PacketStateIssuerMismatch)
+		assert.Equal(t, "", sig.IssuerFingerprint())
+	}
+}
+
+func TestEmails(t *testing.T) {
+	key := MustInputAscKey(t, "uat.asc")
+	assert.Equal(t, []string{"casey.marshall@gazzang.com", "casey.marshall@gmail.com"}, key.Emails())
+
+	key = &Pubkey{userIds: []*UserId{
+		{Keywords: "Alice <Alice@Example.com>"},
+		{Keywords: "Alice (no email)"},
+		{Keywords: "Alice Work <alice@work.example.com>"},
+		{Keywords: "alice@example.com"},
+	}}
+	assert.Equal(t, []string{"alice@example.com", "alice@work.example.com"}, key.Emails())
+	assert.Nil(t, (&Pubkey{}).Emails())
+}
+
+func TestDirectKeySignature(t *testing.T) {
+	key := MustInputAscKey(t, "directkey.asc")
+	sig := key.DirectKeySignature()
+	if !assert.NotNil(t, sig) {
+		return
+	}
+	assert.Equal(t, SigTypeDirectKey, sig.SigType)
+	assert.Equal(t, []string{"7ba723516a6d828c4d15c1c068f58868e58cb56a"}, key.DesignatedRevokers())
+	// Preferences on the primary user ID are used before the direct-key signature.
+	assert.Equal(t, []uint8{10, 9, 8, 11, 2}, key.PreferredHash())
+
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+verifySigs=true
+`)
+	sig = key.DirectKeySignature()
+	if assert.NotNil(t, sig) {
+		assert.NotEqual(t, 0, sig.State&PacketStateSigOk)
+	}
+
+	key = MustInputAscKey(t, "sksdigest.asc")
+	assert.Nil(t, key.DirectKeySignature())
+	assert.Equal(t, []string{}, key.DesignatedRevokers())
+
+	// Without preferences on the primary user ID, those of the direct-key
+	// signature are used.
+	key = MustInputAscKey(t, "directkey_prefs.asc")
+	if assert.NotNil(t, key.DirectKeySignature()) {
+		assert.Nil(t, key.selfSignature().hashedSubpacket(11))
+	}
+	assert.Equal(t, []uint8{9, 8, 7}, key.PreferredSymmetric())
+	assert.Equal(t, []uint8{10, 8}, key.PreferredHash())
+	assert.Equal(t, []uint8{2, 1}, key.PreferredCompression())
+}
+
+func TestDesignatedRevokers(t *testing.T) {
+	// GnuPG adds a direct-key signature for each revoker.
+	key := MustInputAscKey(t, "two_revokers.asc")
+	assert.Equal(t, 2, len(key.signatures))
+	assert.Equal(t, []string{
+		"7ba723516a6d828c4d15c1c068f58868e58cb56a",
+		"675a1836c88dc033b076b20cd0395d9be1662326",
+	}, key.DesignatedRevokers())
+
+	// Both are authorized to revoke the key.
+	for _, fpr := range key.DesignatedRevokers() {
+		sig := &Signature{SigType: 0x20, rIssuerFpr: util.Reverse(fpr), RIssuerKeyId: util.Reverse(fpr[24:])}
+		assert.True(t, key.isDesignatedRevoker(sig), fpr)
+	}
+	other := "0123456789abcdef0123456789abcdef01234567"
+	sig := &Signature{SigType: 0x20, rIssuerFpr: util.Reverse(other), RIssuerKeyId: util.Reverse(other[24:])}
+	assert.False(t, key.isDesignatedRevoker(sig))
+}
+
+func TestDesignatedRevocation(t *testing.T) {
+	revoker := MustInputAscKey(t, "revoker.asc")
+	lookup := func(fpr string) *Pubkey {
+		if fpr == revoker.Fingerprint() {
+			return revoker
+		}
+		return nil
+	}
+
+	key := MustInputAscKey(t, "directkey.asc")
+	key.LinkDesignatedRevocations(lookup)
+	assert.False(t, key.IsRevoked())
+
+	// The revocation is not honored until it is verified against the
+	// revoker's key.
+	key = MustInputAscKey(t, "directkey_revoked.asc")
+	assert.False(t, key.IsRevoked())
+	key.LinkDesignatedRevocations(func(string) *Pubkey { return nil })
+	assert.False(t, key.IsRevoked())
+	key.LinkDesignatedRevocations(lookup)
+	assert.True(t, key.IsRevoked())
+	if assert.NotNil(t, key.revSig) {
+		assert.Equal(t, "68f58868e58cb56a", key.revSig.IssuerKeyId())
+		assert.Equal(t, key.revSig.ScopedDigest, key.RevSigDigest.String)
+	}
+	valid, errs := key.Validate(time.Now())
+	assert.False(t, valid)
+	assert.Contains(t, errs, ErrKeyRevoked)
+
+	// Without the direct-key signature, the revoker is not authorized.
+	var sigs []*Signature
+	for _, sig := range key.signatures {
+		if sig.SigType != SigTypeDirectKey {
+			sigs = append(sigs, sig)
+		}
+	}
+	key.signatures = sigs
+	key.revSig = nil
+	key.RevSigDigest = sql.NullString{}
+	key.LinkDesignatedRevocations(lookup)
+	assert.False(t, key.IsRevoked())
+}
+
+func TestForgedDesignatedRevocation(t *testing.T) {
+	revoker := MustInputAscKey(t, "revoker.asc")
+	lookup := func(string) *Pubkey { return revoker }
+	defer hockeypuck.SetConfig("")
+	for _, verifySigs := range []string{"false", "true"} {
+		hockeypuck.SetConfig(fmt.Sprintf(`
+[hockeypuck.openpgp]
+verifySigs=%s
+`, verifySigs))
+		// The revocation signature, or the direct-key signature authorizing
+		// the revoker, has been tampered with.
+		for _, name := range []string{"directkey_forged.asc", "directkey_forged_auth.asc"} {
+			key := MustInputAscKey(t, name)
+			key.LinkDesignatedRevocations(lookup)
+			assert.False(t, key.IsRevoked(), name, verifySigs)
+			assert.False(t, key.RevSigDigest.Valid, name, verifySigs)
+			_, errs := key.Validate(time.Now())
+			assert.NotContains(t, errs, ErrKeyRevoked, name, verifySigs)
+		}
+	}
+}
+
+func mustPubkeyPacket(t *testing.T, contents []byte) []byte {
+	var buf bytes.Buffer
+	op := &packet.OpaquePacket{Tag: 6, Contents: contents}
+	if err := op.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAlgorithmDescription(t *testing.T) {
+	for _, tc := range []struct {
+		name, desc string
+	}{
+		{"tails.asc", "RSA 4096"},
+		{"sksdigest.asc", "RSA 2048"},
+		{"dsa1024.asc", "DSA 1024"},
+		{"nistp256.asc", "NIST P-256 (ECDSA)"},
+		{"ed25519.asc", "Ed25519"},
+	} {
+		key := MustInputAscKey(t, tc.name)
+		assert.Equal(t, tc.desc, key.AlgorithmDescription(), tc.name)
+	}
+
+	// Curve25519 ECDH, described by its curve.
+	oid := mustDecodeHex(t, "2b060104019755010501")
+	contents := append([]byte{4, 0x53, 0, 0, 0, 18, byte(len(oid))}, oid...)
+	key := &Pubkey{Packet: mustPubkeyPacket(t, append(contents, 0, 8, 0x40))}
+	assert.Equal(t, "Curve25519 (ECDH)", key.AlgorithmDescription())
+
+	// An unrecognized curve.
+	contents = []byte{4, 0x53, 0, 0, 0, 19, 3, 1, 2, 3, 0, 8, 0x40}
+	key = &Pubkey{Packet: mustPubkeyPacket(t, contents)}
+	assert.Equal(t, "unknown", key.AlgorithmDescription())
+
+	// An unrecognized algorithm.
+	contents = []byte{4, 0x53, 0, 0, 0, 99, 0, 8, 0x40}
+	key = &Pubkey{Packet: mustPubkeyPacket(t, contents)}
+	assert.Equal(t, "unknown", key.AlgorithmDescription())
+}
+
+func TestUserIdIndexTerms(t *testing.T) {
+	uid := &UserId{Keywords: "Jenny Ondioline <jennyo@transient.net>"}
+	assert.Equal(t, []string{"Jenny Ondioline <jennyo@transient.net>"}, uid.IndexTerms(IndexModeExact))
+	assert.Equal(t, []string{"jenny", "jennyo", "net", "ondioline", "transient"},
+		uid.IndexTerms(IndexModeFulltext))
+	assert.Nil(t, uid.IndexTerms("soundex"))
+
+	uid = &UserId{Keywords: "Bo Bob"}
+	assert.Equal(t, []string{"  b", " bo", "bo ", "bob", "ob "}, uid.IndexTerms(IndexModeTrigram))
+}
+
+func TestIndexModeSettings(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+	hockeypuck.SetConfig("")
+	assert.Equal(t, IndexModeFulltext, Config().IndexMode())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+indexMode="Trigram"
+`)
+	assert.Nil(t, Config().Validate())
+	assert.Equal(t, IndexModeTrigram, Config().IndexMode())
+
+	hockeypuck.SetConfig(`
+[hockeypuck.openpgp]
+indexMode="soundex"
+`)
+	assert.NotNil(t, Config().Validate())
+}
+
+func TestIndexVector(t *testing.T) {
+	uid := &UserId{Keywords: "Bo O'Bob"}
+	expr, arg := uid.indexVector(IndexModeFulltext, "$9")
+	assert.Equal(t, "to_tsvector($9)", expr)
+	assert.Equal(t, "bo bob o", arg)
+	expr, arg = uid.indexVector(IndexModeExact, "$9")
+	assert.Equal(t, "$9::tsvector", expr)
+	assert.Equal(t, `'Bo O''Bob'`, arg)
+	_, arg = (&UserId{Keywords: "Bo"}).indexVector(IndexModeTrigram, "$9")
+	assert.Equal(t, `'  b' ' bo' 'bo '`, arg)
+
+	expr, arg = indexQuery("alice bob", IndexModeFulltext, "$1")
+	assert.Equal(t, "to_tsquery($1)", expr)
+	assert.Equal(t, "alice+bob", arg)
+	expr, arg = indexQuery("Bo O'Bob", IndexModeExact, "$1")
+	assert.Equal(t, "$1::tsquery", expr)
+	assert.Equal(t, `'Bo O''Bob'`, arg)
+	// Trigram searches match within words, and short words as prefixes.
+	_, arg = indexQuery("Lic bo", IndexModeTrigram, "$1")
+	assert.Equal(t, `'  b' & ' bo' & 'lic'`, arg)
+}
+
+func TestCollidingKeyIds(t *testing.T) {
+	key1 := MustInputAscKey(t, "sksdigest.asc")
+	key2 := MustInputAscKey(t, "alice_unsigned.asc")
+	assert.Empty(t, CollidingKeyIds([]*Pubkey{key1, key2}))
+	// The same key listed twice does not collide with itself.
+	assert.Empty(t, CollidingKeyIds([]*Pubkey{key1, key1}))
+
+	// Fabricated keys with the same last 64 bits of fingerprint.
+	fp1 := "0123456789abcdef01234567deadbeefcafef00d"
+	fp2 := "fedcba9876543210fedcba98deadbeefcafef00d"
+	fake1 := &Pubkey{RFingerprint: util.Reverse(fp1)}
+	fake2 := &Pubkey{RFingerprint: util.Reverse(fp2)}
+	assert.Equal(t, fake1.KeyId(), fake2.KeyId())
+	collisions := CollidingKeyIds([]*Pubkey{fake1, key1, fake2})
+	assert.Equal(t, 1, len(collisions))
+	assert.Equal(t, []string{fp1, fp2}, collisions["deadbeefcafef00d"])
+}
+
+func TestCapabilities(t *testing.T) {
+	key := MustInputAscKey(t, "sksdigest.asc")
+	assert.Equal(t, byte(0x03), key.KeyFlags())
+	assert.Equal(t, byte(0x0c), key.subkeys[0].Flags())
+	assert.Equal(t, "[SC] [E]", key.Capabilities())
+
+	key = MustInputAscKey(t, "crosscert.asc")
+	assert.Equal(t, "[C] [S]", key.Capabilities())
+
+	// Revoked subkeys do not count.
+	key = MustInputAscKey(t, "revoked_subkey.asc")
+	assert.Equal(t, "[SC]", key.Capabilities())
+
+	// No flags declared.
+	assert.Equal(t, "[]", (&Pubkey{}).Capabilities())
+	assert.Equal(t, "SCEA", usageLetters(0x2f))
+}
+
+func TestCanEncrypt(t *testing.T) {
+	now := time.Now()
+	key := MustInputAscKey(t, "sksdigest.asc")
+	assert.True(t, key.CanEncrypt(now))
+
+	// Not once the encryption subkey is revoked or expired.
+	lifetime := uint32(1)
+	key.subkeys[0].bindingSig.Signature.KeyLifetimeSecs = &lifetime
+	assert.False(t, key.CanEncrypt(now))
+	assert.False(t, MustInputAscKey(t, "revoked_subkey.asc").CanEncrypt(now))
+
+	// Nor when the key itself is revoked.
+	key = MustInputAscKey(t, "revoked_uid.asc")
+	assert.Equal(t, "[SC] [E]", key.Capabilities())
+	assert.False(t, key.CanEncrypt(now))
+
+	// A sign-only key.
+	key = MustInputAscKey(t, "crosscert.asc")
+	assert.False(t, key.CanEncrypt(now))
+	assert.False(t, (&Pubkey{}).CanEncrypt(now))
+}
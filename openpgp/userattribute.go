@@ -21,6 +21,8 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"strings"
 	"time"
@@ -54,10 +56,92 @@ func (uat *UserAttribute) calcScopedDigest(pubkey *Pubkey) string {
 	h := sha256.New()
 	h.Write([]byte(pubkey.RFingerprint))
 	h.Write([]byte("{uat}"))
-	h.Write(uat.Packet)
+	h.Write(canonicalPacket(uat.Packet))
 	return toAscii85String(h.Sum(nil))
 }
 
+// AttributeSubpacket is one subpacket of a user attribute, of any type.
+type AttributeSubpacket struct {
+	Type     uint8
+	Contents []byte
+}
+
+// Subpackets returns every subpacket in the user attribute with its type and
+// raw contents, including types other than images.
+func (uat *UserAttribute) Subpackets() ([]AttributeSubpacket, error) {
+	if uat.UserAttribute == nil {
+		return nil, ErrPacketRecordState
+	}
+	var result []AttributeSubpacket
+	for _, sp := range uat.UserAttribute.Contents {
+		result = append(result, AttributeSubpacket{Type: sp.SubType, Contents: sp.Contents})
+	}
+	return result, nil
+}
+
+// Images returns the JPEG data of each image subpacket in the user attribute,
+// without the image header.
+func (uat *UserAttribute) Images() (result [][]byte) {
+	subpackets, err := uat.Subpackets()
+	if err != nil {
+		return nil
+	}
+	for _, sp := range subpackets {
+		if sp.Type == packet.UserAttrImageSubpacket && len(sp.Contents) > 16 {
+			result = append(result, sp.Contents[16:])
+		}
+	}
+	return
+}
+
+// ImageDigests returns the hex-encoded SHA-256 digest of each image in the
+// user attribute. Unlike the scoped digest, these depend only on the image
+// contents, so the same photo is recognized across packets and keys.
+func (uat *UserAttribute) ImageDigests() (result []string) {
+	for _, img := range uat.Images() {
+		h := sha256.Sum256(img)
+		result = append(result, hex.EncodeToString(h[:]))
+	}
+	return
+}
+
+// HasImage returns whether any of the key's user attributes contains an
+// image, such as a photo ID.
+func (pubkey *Pubkey) HasImage() bool {
+	for _, uat := range pubkey.userAttributes {
+		if len(uat.Images()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexImages returns whether keys are flagged by whether they have a photo
+// ID, so that they can be searched for.
+func (s *Settings) IndexImages() bool {
+	return s.GetBool("hockeypuck.openpgp.indexImages")
+}
+
+// ApplyImageIndex flags whether the key has an image in its user
+// attributes, if configured to index images. The key's state must be saved
+// for the flag to be searchable.
+func ApplyImageIndex(pubkey *Pubkey) {
+	if !Config().IndexImages() {
+		return
+	}
+	if pubkey.HasImage() {
+		pubkey.State |= PacketStateHasImage
+	} else {
+		pubkey.State &^= PacketStateHasImage
+	}
+}
+
+// HasImageExpr returns the SQL condition selecting keys in the
+// openpgp_pubkey table that have been flagged as having an image.
+func HasImageExpr() string {
+	return fmt.Sprintf("state & %d != 0", PacketStateHasImage)
+}
+
 func (uat *UserAttribute) Serialize(w io.Writer) error {
 	_, err := w.Write(uat.Packet)
 	return err
@@ -86,6 +170,9 @@ func (uat *UserAttribute) setPacket(p packet.Packet) error {
 }
 
 func (uat *UserAttribute) Read() (err error) {
+	if uat.Packet, err = unpackBytes(uat.Packet); err != nil {
+		return
+	}
 	buf := bytes.NewBuffer(uat.Packet)
 	var p packet.Packet
 	if p, err = packet.Read(buf); err != nil {
@@ -112,7 +199,7 @@ func NewUserAttribute(op *packet.OpaquePacket) (uat *UserAttribute, err error) {
 
 func (uat *UserAttribute) init() (err error) {
 	uat.Creation = NeverExpires
-	uat.Expiration = time.Unix(0, 0)
+	uat.Expiration = time.Unix(0, 0).UTC()
 	return
 }
 
@@ -169,7 +256,7 @@ func (uat *UserAttribute) linkSelfSigs(pubkey *Pubkey) {
 				if uat.selfSignature == nil || sig.Creation.Unix() > uat.selfSignature.Creation.Unix() {
 					uat.selfSignature = sig
 				}
-				if uat.revSig != nil && sig.Creation.Unix() > uat.selfSignature.Creation.Unix() {
+				if uat.revSig != nil && sig.Creation.Unix() > uat.revSig.Creation.Unix() {
 					// A self-certification more recent than a revocation effectively cancels it.
 					uat.revSig = nil
 					uat.RevSigDigest = sql.NullString{"", false}
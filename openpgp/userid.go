@@ -21,9 +21,12 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"database/sql"
+	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
+	"unicode"
 
 	"code.google.com/p/go.crypto/openpgp/packet"
 
@@ -53,11 +56,158 @@ type UserId struct {
 
 func (uid *UserId) Signatures() []*Signature { return uid.signatures }
 
+// Parse splits the user ID into its "Name (comment) <email>" components.
+// Missing components are returned empty. A user ID consisting of a single
+// bare email address is returned as the email.
+func (uid *UserId) Parse() (name, comment, email string) {
+	rest := strings.TrimSpace(uid.Keywords)
+	if lt := strings.LastIndex(rest, "<"); lt >= 0 {
+		if gt := strings.Index(rest[lt:], ">"); gt >= 0 {
+			email = strings.TrimSpace(rest[lt+1 : lt+gt])
+			rest = rest[:lt] + rest[lt+gt+1:]
+		}
+	} else if strings.Contains(rest, "@") && !strings.ContainsAny(rest, " \t()") {
+		return "", "", rest
+	}
+	if lp := strings.Index(rest, "("); lp >= 0 {
+		if rp := strings.LastIndex(rest, ")"); rp > lp {
+			comment = strings.TrimSpace(rest[lp+1 : rp])
+			rest = rest[:lp] + rest[rp+1:]
+		}
+	}
+	name = strings.Join(strings.Fields(rest), " ")
+	return
+}
+
+// User ID keyword indexing strategies.
+const (
+	// IndexModeExact indexes the whole user ID, for exact-match lookups.
+	IndexModeExact = "exact"
+	// IndexModeFulltext indexes the words of the user ID.
+	IndexModeFulltext = "fulltext"
+	// IndexModeTrigram indexes the trigrams of the words of the user ID,
+	// for substring and similarity lookups.
+	IndexModeTrigram = "trigram"
+)
+
+// IndexMode returns how user ID keywords are indexed for searching:
+// IndexModeExact, IndexModeFulltext or IndexModeTrigram.
+func (s *Settings) IndexMode() string {
+	return strings.ToLower(s.GetStringDefault("hockeypuck.openpgp.indexMode", IndexModeFulltext))
+}
+
+// validateIndexMode returns an error if the index mode is not known.
+func (s *Settings) validateIndexMode() error {
+	switch mode := s.IndexMode(); mode {
+	case IndexModeExact, IndexModeFulltext, IndexModeTrigram:
+		return nil
+	default:
+		return fmt.Errorf("hockeypuck.openpgp.indexMode: unknown mode %q", mode)
+	}
+}
+
+// IndexTerms returns the terms under which the user ID is indexed in the
+// given mode. In exact mode this is the whole user ID. In fulltext mode it
+// is the distinct lower-cased words, split on anything not a letter or
+// digit. In trigram mode it is the distinct trigrams of those words, each
+// padded with two spaces before and one after, as by PostgreSQL pg_trgm.
+// Returns nil for an unknown mode.
+func (uid *UserId) IndexTerms(mode string) []string {
+	switch mode {
+	case IndexModeExact:
+		return []string{uid.Keywords}
+	case IndexModeFulltext, IndexModeTrigram:
+	default:
+		return nil
+	}
+	terms := make(map[string]bool)
+	for _, word := range indexWords(uid.Keywords) {
+		if mode == IndexModeFulltext {
+			terms[word] = true
+			continue
+		}
+		addTrigrams(terms, "  "+word+" ")
+	}
+	return sortedTerms(terms)
+}
+
+// indexWords returns the lower-cased words of s, split on anything not a
+// letter or digit.
+func indexWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func addTrigrams(terms map[string]bool, s string) {
+	runes := []rune(s)
+	for i := 0; i+3 <= len(runes); i++ {
+		terms[string(runes[i:i+3])] = true
+	}
+}
+
+func sortedTerms(terms map[string]bool) []string {
+	var result []string
+	for term := range terms {
+		result = append(result, term)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// tsLexemes formats terms as quoted lexemes for PostgreSQL tsvector or
+// tsquery input, joined by sep.
+func tsLexemes(terms []string, sep string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		term = strings.Replace(term, `\`, `\\`, -1)
+		quoted[i] = "'" + strings.Replace(term, "'", "''", -1) + "'"
+	}
+	return strings.Join(quoted, sep)
+}
+
+// indexVector returns the SQL expression, given the placeholder for its
+// argument, which computes the keywords_fulltext vector of the user ID in the
+// given index mode, and the argument. Fulltext terms are normalized by
+// PostgreSQL, while exact and trigram terms are stored as they are.
+func (uid *UserId) indexVector(mode, param string) (expr string, arg string) {
+	terms := uid.IndexTerms(mode)
+	if mode == IndexModeFulltext {
+		return "to_tsvector(" + param + ")", strings.Join(terms, " ")
+	}
+	return param + "::tsvector", tsLexemes(terms, " ")
+}
+
+// indexQuery returns the SQL expression, given the placeholder for its
+// argument, which matches a search against keywords_fulltext vectors made
+// by indexVector in the given index mode, and the argument. In trigram mode,
+// each search word matches words containing it, or starting with it if it is
+// shorter than a trigram.
+func indexQuery(search, mode, param string) (expr string, arg string) {
+	var terms []string
+	switch mode {
+	case IndexModeFulltext:
+		return "to_tsquery(" + param + ")", strings.Join(strings.Split(search, " "), "+")
+	case IndexModeTrigram:
+		trigrams := make(map[string]bool)
+		for _, word := range indexWords(search) {
+			if len([]rune(word)) < 3 {
+				word = "  " + word
+			}
+			addTrigrams(trigrams, word)
+		}
+		terms = sortedTerms(trigrams)
+	default:
+		terms = (&UserId{Keywords: search}).IndexTerms(mode)
+	}
+	return param + "::tsquery", tsLexemes(terms, " & ")
+}
+
 func (uid *UserId) calcScopedDigest(pubkey *Pubkey) string {
 	h := sha256.New()
 	h.Write([]byte(pubkey.RFingerprint))
 	h.Write([]byte("{uid}"))
-	h.Write(uid.Packet)
+	h.Write(canonicalPacket(uid.Packet))
 	return toAscii85String(h.Sum(nil))
 }
 
@@ -89,6 +239,9 @@ func (uid *UserId) setPacket(p packet.Packet) error {
 }
 
 func (uid *UserId) Read() (err error) {
+	if uid.Packet, err = unpackBytes(uid.Packet); err != nil {
+		return
+	}
 	buf := bytes.NewBuffer(uid.Packet)
 	var p packet.Packet
 	if p, err = packet.Read(buf); err != nil {
@@ -115,7 +268,7 @@ func NewUserId(op *packet.OpaquePacket) (uid *UserId, err error) {
 
 func (uid *UserId) init() (err error) {
 	uid.Creation = NeverExpires
-	uid.Expiration = time.Unix(0, 0)
+	uid.Expiration = time.Unix(0, 0).UTC()
 	uid.Keywords = util.CleanUtf8(uid.UserId.Id)
 	return
 }
@@ -142,6 +295,13 @@ func (uid *UserId) RemoveSignature(sig *Signature) {
 	uid.signatures = removeSignature(uid.signatures, sig)
 }
 
+// IsRevoked returns whether the key owner has revoked the user ID, with a
+// certification revocation more recent than its latest self-signature.
+// A self-signature made after the revocation certifies the user ID again.
+func (uid *UserId) IsRevoked() bool {
+	return uid.revSig != nil || uid.RevSigDigest.Valid
+}
+
 func (uid *UserId) linkSelfSigs(pubkey *Pubkey) {
 	for _, sig := range uid.signatures {
 		if !strings.HasPrefix(pubkey.RFingerprint, sig.RIssuerKeyId) {
@@ -177,7 +337,7 @@ func (uid *UserId) linkSelfSigs(pubkey *Pubkey) {
 					// Choose the most-recent self-signature on the uid
 					uid.selfSignature = sig
 				}
-				if uid.revSig != nil && sig.Creation.Unix() > uid.selfSignature.Creation.Unix() {
+				if uid.revSig != nil && sig.Creation.Unix() > uid.revSig.Creation.Unix() {
 					// A self-certification more recent than a revocation effectively cancels it.
 					uid.revSig = nil
 					uid.RevSigDigest = sql.NullString{"", false}
@@ -32,7 +32,7 @@ func init() {
 	hockeypuck.SetConfig("")
 }
 
-func MustInput(t *testing.T, name string) *os.File {
+func MustInput(t testing.TB, name string) *os.File {
 	_, thisFile, _, ok := runtime.Caller(0)
 	if !ok {
 		t.Fatal("Cannot locate unit test data files")
@@ -20,20 +20,19 @@ package openpgp
 import (
 	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 
 	. "github.com/hockeypuck/hockeypuck/errors"
 	"github.com/hockeypuck/hockeypuck/hkp"
-	"github.com/hockeypuck/hockeypuck/util"
 )
 
 const LOOKUP_RESULT_LIMIT = 100
@@ -118,9 +117,21 @@ func (w *Worker) Lookup(l *hkp.Lookup) {
 	}
 	var keys []*Pubkey
 	var limit int = LOOKUP_RESULT_LIMIT
+	var truncated bool
 	var err error
 	if l.Op == hkp.HashGet {
 		keys, err = w.LookupHash(l.Search)
+	} else if l.Op == hkp.Index || l.Op == hkp.Vindex {
+		// Expired keys are hidden once the grace period, if any, has passed.
+		var hide func(*Pubkey) bool
+		var expiredBefore time.Time
+		if Config().HideExpired() {
+			now := time.Now()
+			grace, _ := Config().ExpiredGracePeriod()
+			expiredBefore = now.Add(-grace)
+			hide = func(key *Pubkey) bool { return key.IsExpired(now) }
+		}
+		keys, truncated, err = w.lookupIndexKeys(l.Search, hkp.Config().MaxIndexResults(), expiredBefore, hide)
 	} else {
 		keys, err = w.LookupKeys(l.Search, limit)
 	}
@@ -136,9 +147,9 @@ func (w *Worker) Lookup(l *hkp.Lookup) {
 	case hkp.HashGet:
 		resp = &KeyringResponse{keys}
 	case hkp.Index:
-		resp = &IndexResponse{Lookup: l, Keys: keys}
+		resp = &IndexResponse{Lookup: l, Keys: keys, Truncated: truncated}
 	case hkp.Vindex:
-		resp = &IndexResponse{Lookup: l, Keys: keys, Verbose: true}
+		resp = &IndexResponse{Lookup: l, Keys: keys, Verbose: true, Truncated: truncated}
 	default:
 		resp = &ErrorResponse{ErrUnsupportedOperation}
 		return
@@ -149,7 +160,7 @@ func (w *Worker) Lookup(l *hkp.Lookup) {
 func (w *Worker) HashQuery(hq *hkp.HashQuery) {
 	var uuids []string
 	for _, digest := range hq.Digests {
-		uuid, err := w.lookupMd5Uuid(digest)
+		uuid, err := w.lookupDigestUuid(digest)
 		if err != nil {
 			log.Printf("Hashquery lookup [%s] failed: %q\n", digest, err)
 			if err == ErrKeyNotFound {
@@ -175,24 +186,50 @@ func (w *Worker) HashQuery(hq *hkp.HashQuery) {
 }
 
 func (w *Worker) LookupKeys(search string, limit int) (keys []*Pubkey, err error) {
-	uuids, err := w.lookupPubkeyUuids(search, limit)
+	uuids, err := w.lookupPubkeyUuids(search, limit, time.Time{})
 	return w.fetchKeys(uuids).GoodKeys(), err
 }
 
+// lookupIndexKeys looks up at most limit keys matching the search for an
+// index listing, and whether more keys matched. Matches over the limit are
+// dropped before their keys are fetched. If expiredBefore is set, user ID
+// searches leave out keys whose stored expiration is earlier. Keys for which
+// hide returns true, if given, are then left out of those fetched, so fewer
+// than limit keys may be listed even if more matched.
+func (w *Worker) lookupIndexKeys(search string, limit int, expiredBefore time.Time, hide func(*Pubkey) bool) (keys []*Pubkey, truncated bool, err error) {
+	uuids, err := w.lookupPubkeyUuids(search, limit+1, expiredBefore)
+	uuids, truncated = limitUuids(uuids, limit)
+	for _, key := range w.fetchKeys(uuids).GoodKeys() {
+		if hide == nil || !hide(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, truncated, err
+}
+
+// limitUuids returns the first limit UUIDs, and whether any were dropped.
+func limitUuids(uuids []string, limit int) ([]string, bool) {
+	if len(uuids) > limit {
+		return uuids[:limit], true
+	}
+	return uuids, false
+}
+
 func (w *Worker) LookupHash(digest string) ([]*Pubkey, error) {
-	uuid, err := w.lookupMd5Uuid(digest)
+	uuid, err := w.lookupDigestUuid(digest)
 	return w.fetchKeys([]string{uuid}).GoodKeys(), err
 }
 
-func (w *Worker) lookupPubkeyUuids(search string, limit int) (uuids []string, err error) {
+func (w *Worker) lookupPubkeyUuids(search string, limit int, expiredBefore time.Time) (uuids []string, err error) {
 	if strings.HasPrefix(search, "0x") {
 		return w.lookupKeyidUuids(search[2:])
 	}
-	return w.lookupKeywordUuids(search, limit)
+	return w.lookupKeywordUuids(search, limit, expiredBefore)
 }
 
-func (w *Worker) lookupMd5Uuid(hash string) (uuid string, err error) {
-	rows, err := w.db.Queryx(`SELECT uuid FROM openpgp_pubkey WHERE md5 = $1`,
+// lookupDigestUuid looks up a key by its recon digest.
+func (w *Worker) lookupDigestUuid(hash string) (uuid string, err error) {
+	rows, err := w.db.Queryx(`SELECT uuid FROM openpgp_pubkey WHERE `+Config().ReconDigestExpr()+` = $1`,
 		strings.ToLower(hash))
 	if err == sql.ErrNoRows {
 		return "", ErrKeyNotFound
@@ -214,25 +251,21 @@ func (w *Worker) lookupMd5Uuid(hash string) (uuid string, err error) {
 	return
 }
 
-func (w *Worker) lookupKeyidUuids(keyId string) (uuids []string, err error) {
-	keyId = strings.ToLower(keyId)
-	raw, err := hex.DecodeString(keyId)
+func (w *Worker) lookupKeyidUuids(search string) (uuids []string, err error) {
+	keyId, err := ParseKeyId(search)
 	if err != nil {
-		return nil, ErrInvalidKeyId
+		return nil, err
+	}
+	rKeyId := keyId.Reversed()
+	if keyId.IsFingerprint() {
+		return []string{rKeyId}, nil
 	}
-	rKeyId := util.Reverse(keyId)
 	var compareOp string
-	switch len(raw) {
-	case 4:
-		compareOp = "LIKE $1 || '________________________________'"
+	switch len(keyId) {
 	case 8:
-		compareOp = "LIKE $1 || '________________________'"
-	case 16:
-		return []string{rKeyId}, nil
-	case 20:
-		return []string{rKeyId}, nil
+		compareOp = "LIKE $1 || '________________________________'"
 	default:
-		return nil, ErrInvalidKeyId
+		compareOp = "LIKE $1 || '________________________'"
 	}
 	rows, err := w.db.Queryx(fmt.Sprintf(`
 SELECT uuid FROM openpgp_pubkey WHERE uuid %s
@@ -258,13 +291,25 @@ func flattenUuidRows(rows *sqlx.Rows) (uuids []string, err error) {
 	return
 }
 
-func (w *Worker) lookupKeywordUuids(search string, limit int) (uuids []string, err error) {
-	search = strings.Join(strings.Split(search, " "), "+")
+// lookupKeywordUuids looks up at most limit keys with user IDs matching the
+// search. If expiredBefore is set, keys which expired before then are left
+// out.
+func (w *Worker) lookupKeywordUuids(search string, limit int, expiredBefore time.Time) (uuids []string, err error) {
+	query, search := indexQuery(search, Config().IndexMode(), "$1")
 	log.Println("keyword:", search)
 	log.Println("limit:", limit)
-	rows, err := w.db.Queryx(`
+	var rows *sqlx.Rows
+	if expiredBefore.IsZero() {
+		rows, err = w.db.Queryx(`
 SELECT DISTINCT pubkey_uuid FROM openpgp_uid
-WHERE keywords_fulltext @@ to_tsquery($1) LIMIT $2`, search, limit)
+WHERE keywords_fulltext @@ `+query+` LIMIT $2`, search, limit)
+	} else {
+		rows, err = w.db.Queryx(`
+SELECT DISTINCT openpgp_uid.pubkey_uuid FROM openpgp_uid
+JOIN openpgp_pubkey ON openpgp_pubkey.uuid = openpgp_uid.pubkey_uuid
+WHERE keywords_fulltext @@ `+query+` AND openpgp_pubkey.expiration >= $3
+LIMIT $2`, search, limit, expiredBefore)
+	}
 	if err == sql.ErrNoRows {
 		return nil, ErrKeyNotFound
 	} else if err != nil {
@@ -291,7 +336,7 @@ func (w *Worker) LookupKey(keyid string) (pubkey *Pubkey, err error) {
 
 func (w *Worker) fetchKeys(uuids []string) (results ReadKeyResults) {
 	for _, uuid := range uuids {
-		key, err := w.FetchKey(uuid)
+		key, err := w.fetchCachedKey(uuid)
 		results = append(results, &ReadKeyResult{Pubkey: key, Error: err})
 		if err != nil {
 			log.Println("Fetch key:", err)
@@ -300,6 +345,21 @@ func (w *Worker) fetchKeys(uuids []string) (results ReadKeyResults) {
 	return
 }
 
+// fetchCachedKey returns the key from the parsed key cache, reading it from
+// the database and caching it if it is not there.
+func (w *Worker) fetchCachedKey(uuid string) (*Pubkey, error) {
+	cache := cachedKeys()
+	if pubkey := cache.Get(uuid); pubkey != nil {
+		return pubkey, nil
+	}
+	gen := cache.Generation()
+	pubkey, err := w.FetchKey(uuid)
+	if err == nil {
+		cache.Put(pubkey, gen)
+	}
+	return pubkey, err
+}
+
 func (w *Worker) FetchKey(uuid string) (pubkey *Pubkey, err error) {
 	pubkey = new(Pubkey)
 	err = w.db.Get(pubkey, `SELECT * FROM openpgp_pubkey WHERE uuid = $1`, uuid)
@@ -408,12 +468,11 @@ SELECT * FROM openpgp_sig sig WHERE pubkey_uuid = $1 AND subkey_uuid = $2
 	Resolve(pubkey)
 
 	digest := SksDigest(pubkey, md5.New())
-	if digest != pubkey.Md5 {
+	if digest != pubkey.Md5 && !pubkey.IsTombstone() {
 		// TODO: make this a WARN level message when we use loggo
 		log.Println("digest mismatch for key [%s]: indexed=%s material=%s",
 			pubkey.Fingerprint(), pubkey.Md5, digest)
 	}
-
 	return
 }
 
@@ -28,6 +28,8 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/hockeypuck/hockeypuck"
+	Errors "github.com/hockeypuck/hockeypuck/errors"
+	"github.com/hockeypuck/hockeypuck/hkp"
 )
 
 func connectString() string {
@@ -131,3 +133,50 @@ func testReadDigestDups(t *testing.T, testfile string) {
 	}
 	assert.Equal(t, len(opkr.Packets), 24)
 }
+
+func TestReadOnly(t *testing.T) {
+	defer hockeypuck.SetConfig("")
+
+	hockeypuck.SetConfig(`
+[hockeypuck]
+readOnly=true
+`)
+	assert.Nil(t, Config().Validate())
+	assert.True(t, Config().ReconPull())
+
+	// Submissions are refused before reaching the database.
+	w := &Worker{}
+	a := hkp.NewAdd()
+	go w.Add(a)
+	resp := <-a.Response()
+	assert.Equal(t, Errors.ErrReadOnly, resp.Error())
+
+	hockeypuck.SetConfig(`
+[hockeypuck]
+readOnly=true
+[hockeypuck.conflux.recon]
+readOnlyPull=false
+`)
+	assert.Nil(t, Config().Validate())
+	assert.False(t, Config().ReconPull())
+	resp = w.recoverKey(&RecoverKey{})
+	assert.Equal(t, Errors.ErrReadOnly, resp.Error())
+
+	// readOnlyPull only applies to a read-only keyserver.
+	hockeypuck.SetConfig(`
+[hockeypuck.conflux.recon]
+readOnlyPull=false
+`)
+	assert.True(t, Config().ReconPull())
+
+	for _, conf := range []string{`
+[hockeypuck]
+readOnly="yes"
+`, `
+[hockeypuck.conflux.recon]
+readOnlyPull=1
+`} {
+		hockeypuck.SetConfig(conf)
+		assert.NotNil(t, Config().Validate(), conf)
+	}
+}
@@ -39,6 +39,15 @@ const APPLICATION_ERROR = "APPLICATION ERROR"
 // Response for HTTP 400.
 const BAD_REQUEST = "BAD REQUEST"
 
+// Response for HTTP 403.
+const FORBIDDEN = "FORBIDDEN"
+
+// Response for HTTP 429.
+const TOO_MANY_REQUESTS = "TOO MANY REQUESTS"
+
+// Response for HTTP 501.
+const NOT_IMPLEMENTED = "NOT IMPLEMENTED"
+
 // Path to Hockeypuck's installed www directory
 func init() {
 	flag.String("webroot", "",